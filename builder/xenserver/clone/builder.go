@@ -0,0 +1,188 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	hconfig "github.com/hashicorp/packer-plugin-sdk/template/config"
+	xsclient "github.com/terra-farm/go-xen-api-client"
+	xscommon "github.com/xenserver/packer-builder-xenserver/builder/xenserver/common"
+)
+
+// Builder provisions a clone or copy of an existing template, VM or
+// snapshot and turns it into a new template. The VM boots from its own disks,
+// so there is no ISO, boot command or HTTP server involved.
+type Builder struct {
+	config xscommon.Config
+	runner multistep.Runner
+}
+
+func (self *Builder) ConfigSpec() hcldec.ObjectSpec { return self.config.FlatMapstructure().HCL2Spec() }
+
+func (self *Builder) Prepare(raws ...interface{}) (params []string, warns []string, retErr error) {
+
+	var errs *packer.MultiError
+
+	err := hconfig.Decode(&self.config, &hconfig.DecodeOpts{
+		Interpolate: true,
+	}, raws...)
+
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
+	errs = packer.MultiErrorAppend(
+		errs, self.config.CommonConfig.Prepare(self.config.GetInterpContext(), &self.config.PackerConfig)...)
+	errs = packer.MultiErrorAppend(errs, self.config.SSHConfig.Prepare(self.config.GetInterpContext())...)
+
+	// Set default values. vCPUs and memory are left at zero, which keeps
+	// those of the template.
+
+	if self.config.VCPUsMax != 0 && self.config.VCPUsAtStartup > self.config.VCPUsMax {
+		self.config.VCPUsAtStartup = self.config.VCPUsMax
+	}
+
+	if self.config.RawInstallTimeout == "" {
+		self.config.RawInstallTimeout = "20m"
+	}
+
+	// Copying onto another SR needs a full copy
+	if self.config.SrName != "" {
+		self.config.FullCopy = true
+	}
+
+	// Validation
+
+	self.config.InstallTimeout, err = time.ParseDuration(self.config.RawInstallTimeout)
+	if err != nil {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("Failed to parse install_timeout: %s", err))
+	}
+
+	if self.config.CloneTemplate == "" {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("clone_template must be specified"))
+	}
+
+	if len(self.config.BootCommand) > 0 {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("boot_command is not supported, the clone boots from its own disks"))
+	}
+
+	if self.config.IPGetter == "http" {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("ip_getter 'http' is not supported, there is no HTTP server to fetch from"))
+	}
+
+	if len(errs.Errors) > 0 {
+		retErr = errors.New(errs.Error())
+	}
+
+	return nil, nil, retErr
+
+}
+
+func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
+	state, logout, err := xscommon.NewBuildState(ctx, self.config, ui, hook)
+	if err != nil {
+		return nil, err
+	}
+	defer logout()
+
+	// A full copy onto sr_name needs room there for the disks of the
+	// template; a fast clone takes next to none
+	var copyTemplate string
+	if self.config.SrName != "" {
+		copyTemplate = self.config.CloneTemplate
+	}
+
+	//Build the steps
+	steps := []multistep.Step{
+		new(xscommon.StepPreflight),
+		&xscommon.StepPrepareOutputDir{
+			Force: self.config.PackerForce,
+			Path:  self.config.OutputDir,
+		},
+		&xscommon.StepFindVdi{
+			VdiName:    self.config.ToolsIsoName,
+			VdiUuidKey: "tools_vdi_uuid",
+		},
+		&xscommon.StepGetVmTemplate{
+			SkipStep: self.config.SkipSetTemplate,
+		},
+		&xscommon.StepCheckFreeSpace{
+			CopyTemplate: copyTemplate,
+			CopySR:       self.config.GetSR,
+		},
+		&xscommon.StepCreateInstance{
+			AssumePreInstalledOS: true,
+		},
+		&xscommon.StepAttachVdi{
+			VdiUuidKey: "tools_vdi_uuid",
+			VdiType:    xsclient.VbdTypeCD,
+		},
+		new(xscommon.StepAttachExistingDisks),
+		new(xscommon.StepStartVmPaused),
+		new(xscommon.StepSetVmHostSshAddress),
+		new(xscommon.StepBootWait),
+		&xscommon.StepWaitForIP{
+			Timeout: self.config.InstallTimeout,
+		},
+		&xscommon.StepForwardPortOverSSH{
+			RemotePort:  xscommon.InstanceSSHPort,
+			RemoteDest:  xscommon.InstanceSSHIP,
+			HostPortMin: self.config.HostPortMin,
+			HostPortMax: self.config.HostPortMax,
+			ResultKey:   "local_ssh_port",
+		},
+		&communicator.StepConnect{
+			Config:    &self.config.SSHConfig.Comm,
+			Host:      xscommon.InstanceSSHIP,
+			SSHConfig: self.config.Comm.SSHConfigFunc(),
+			SSHPort:   xscommon.InstanceSSHPort,
+		},
+		new(commonsteps.StepProvision),
+		new(xscommon.StepShutdown),
+	}
+
+	if !self.config.SkipSetTemplate {
+		steps = append(steps,
+			&xscommon.StepCleanUpTemplate{
+				Force: self.config.PackerForce,
+			},
+			new(xscommon.StepSetVmToTemplate))
+	}
+
+	steps = append(steps,
+		&xscommon.StepDetachVdi{
+			VdiUuidKey: "tools_vdi_uuid",
+		},
+		new(xscommon.StepDetachExistingDisks),
+		new(xscommon.StepExport))
+
+	self.runner = &multistep.BasicRunner{Steps: steps}
+	self.runner.Run(ctx, state)
+
+	if rawErr, ok := state.GetOk("error"); ok {
+		return nil, rawErr.(error)
+	}
+
+	// If we were interrupted or cancelled, then just exit.
+	if _, ok := state.GetOk(multistep.StateCancelled); ok {
+		return nil, errors.New("Build was cancelled.")
+	}
+	if _, ok := state.GetOk(multistep.StateHalted); ok {
+		return nil, errors.New("Build was halted.")
+	}
+
+	artifact, _ := xscommon.NewArtifact(self.config.OutputDir)
+
+	return artifact, nil
+}
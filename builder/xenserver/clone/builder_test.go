@@ -0,0 +1,352 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/xapitest"
+)
+
+func testConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"remote_host":      "localhost",
+		"remote_username":  "admin",
+		"remote_password":  "admin",
+		"vm_name":          "foo",
+		"clone_template":   "base",
+		"shutdown_command": "yes",
+		"ssh_username":     "foo",
+
+		common.BuildNameConfigKey: "foo",
+	}
+}
+
+func TestBuilder_ImplementsBuilder(t *testing.T) {
+	var raw interface{}
+	raw = &Builder{}
+	if _, ok := raw.(packer.Builder); !ok {
+		t.Error("Builder must implement builder.")
+	}
+}
+
+func TestBuilderPrepare_Defaults(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if b.config.VCPUsMax != 0 || b.config.VMMemory != 0 {
+		t.Errorf("vCPUs and memory should be kept from the template: %d, %d", b.config.VCPUsMax, b.config.VMMemory)
+	}
+
+	if b.config.FullCopy {
+		t.Errorf("should fast clone by default")
+	}
+
+	if b.config.Format != "xva" {
+		t.Errorf("bad format: %s", b.config.Format)
+	}
+
+	if b.config.KeepVM != "never" {
+		t.Errorf("bad keep instance: %s", b.config.KeepVM)
+	}
+}
+
+func TestBuilderPrepare_BootCommand(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	config["boot_command"] = []string{"<enter>"}
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_CloneTemplate(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	delete(config, "clone_template")
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["clone_template"] = "base"
+	b = Builder{}
+	_, warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+func TestBuilderPrepare_IPGetter(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	config["ip_getter"] = "http"
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["ip_getter"] = "tools"
+	b = Builder{}
+	_, warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+func TestBuilderPrepare_SrName(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	config["sr_name"] = "NFS storage"
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if !b.config.FullCopy {
+		t.Errorf("sr_name should imply a full copy")
+	}
+}
+
+func testRunConfig(t *testing.T, server *xapitest.Server) (map[string]interface{}, string) {
+	// The base template a previous build left behind
+	server.Create("VM", xapitest.Record{
+		"name_label":        "base",
+		"is_a_template":     true,
+		"VCPUs_max":         "4",
+		"VCPUs_at_startup":  "4",
+		"memory_static_max": fmt.Sprint(4096 << 20),
+		"HVM_boot_params":   map[string]interface{}{"firmware": "uefi"},
+	})
+
+	config := testConfig()
+	dir := server.Configure(t, config)
+	return config, dir
+}
+
+func TestBuilderRun(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server)
+	config["vm_description"] = "app"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	artifact, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if artifact == nil {
+		t.Fatal("should have an artifact")
+	}
+
+	if n := server.Calls("VM.clone"); n != 1 {
+		t.Errorf("should have fast cloned the template once, got %d calls", n)
+	}
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	vm := server.Records("VM")[vms[0]]
+	if vm["is_a_template"] != true {
+		t.Errorf("VM should have been turned into a template")
+	}
+	if vm["name_description"] != "app" {
+		t.Errorf("bad description: %q", vm["name_description"])
+	}
+	if vm["VCPUs_max"] != "4" || vm["memory_static_max"] != fmt.Sprint(4096<<20) {
+		t.Errorf("vCPUs and memory of the template should have been kept: %v, %v", vm["VCPUs_max"], vm["memory_static_max"])
+	}
+	if firmware := vm["HVM_boot_params"].(map[string]interface{})["firmware"]; firmware != "uefi" {
+		t.Errorf("firmware of the template should have been kept, got %v", firmware)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "output", "foo.xva")); err != nil {
+		t.Errorf("should have exported the VM: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "output", "foo.xva.sha256")); err != nil {
+		t.Errorf("should have recorded the checksum of the export: %s", err)
+	}
+}
+
+func TestBuilderRun_VCPUs(t *testing.T) {
+	// The template starts with all of its 4 vCPUs, which setting either
+	// value alone must not leave above the maximum
+	cases := []struct {
+		config         map[string]interface{}
+		max, atStartup string
+	}{
+		{map[string]interface{}{"vcpus_max": 2}, "2", "2"},
+		{map[string]interface{}{"vcpus_atstartup": 6}, "6", "6"},
+		{map[string]interface{}{"vcpus_max": 8, "vcpus_atstartup": 2}, "8", "2"},
+	}
+
+	for _, tc := range cases {
+		server := xapitest.NewServer()
+		defer server.Close()
+
+		config, _ := testRunConfig(t, server)
+		config["format"] = "none"
+		for key, value := range tc.config {
+			config[key] = value
+		}
+
+		var b Builder
+		if _, _, err := b.Prepare(config); err != nil {
+			t.Fatalf("should not have error: %s", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+			t.Fatalf("%v: should not have error: %s", tc.config, err)
+		}
+
+		vms := server.Find("VM", "foo")
+		if len(vms) != 1 {
+			t.Fatalf("bad: expected one VM, got %d", len(vms))
+		}
+		vm := server.Records("VM")[vms[0]]
+		if vm["VCPUs_max"] != tc.max || vm["VCPUs_at_startup"] != tc.atStartup {
+			t.Errorf("%v: expected %s vCPUs, %s at startup, got %v, %v", tc.config, tc.max, tc.atStartup, vm["VCPUs_max"], vm["VCPUs_at_startup"])
+		}
+	}
+}
+
+func TestBuilderRun_FullCopy(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	server.Create("SR", xapitest.Record{
+		"name_label":   "NFS storage",
+		"type":         "nfs",
+		"content_type": "user",
+	})
+
+	config, _ := testRunConfig(t, server)
+	config["sr_name"] = "NFS storage"
+	config["vm_memory"] = 2048
+	config["format"] = "none"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if n := server.Calls("VM.copy"); n != 1 {
+		t.Errorf("should have copied the template once, got %d calls", n)
+	}
+	if n := server.Calls("VM.clone"); n != 0 {
+		t.Errorf("should not have fast cloned the template, got %d calls", n)
+	}
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	if memory := server.Records("VM")[vms[0]]["memory_static_max"]; memory != fmt.Sprint(2048<<20) {
+		t.Errorf("bad memory: %v", memory)
+	}
+}
+
+func TestBuilderRun_FullCopyFreeSpace(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	server.Create("SR", xapitest.Record{
+		"name_label":    "NFS storage",
+		"type":          "nfs",
+		"content_type":  "user",
+		"physical_size": fmt.Sprint(10 << 30),
+	})
+
+	config, _ := testRunConfig(t, server)
+	config["sr_name"] = "NFS storage"
+
+	// The disk of the template does not fit on the SR it is copied to
+	base := server.Find("VM", "base")[0]
+	vdi := server.Create("VDI", xapitest.Record{
+		"name_label":   "base disk",
+		"virtual_size": fmt.Sprint(20 << 30),
+	})
+	session, err := server.Invoke("session.login_with_password", []interface{}{server.Username, server.Password, "1.0", "test"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, err = server.Invoke("VBD.create", []interface{}{session, map[string]interface{}{
+		"VM":   base,
+		"VDI":  vdi,
+		"type": "Disk",
+	}})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var b Builder
+	if _, _, err := b.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err == nil || !strings.Contains(err.Error(), "Not enough free space") {
+		t.Fatalf("expected a free space error, got %v", err)
+	}
+	if n := server.Calls("VM.copy"); n != 0 {
+		t.Errorf("should not have copied the template, got %d calls", n)
+	}
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"context"
+	"log"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// NewBuildState logs in to XAPI and returns the state shared by the steps
+// of a build: the client, the config, the hook and a ui that redacts the
+// credentials. Calling the returned function logs out again.
+func NewBuildState(ctx context.Context, config Config, ui packer.Ui, hook packer.Hook) (*multistep.BasicStateBag, func(), error) {
+	ui = SetupRedaction(ui, config.Password, config.SessionID)
+
+	//Setup XAPI client
+	transport, err := config.Transport()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := NewXenAPIClient(ctx, config.HostIps, config.Credentials(), config.APIProtocol, transport)
+	if err != nil {
+		return nil, nil, err
+	}
+	logout := func() {
+		if err := c.Logout(); err != nil {
+			log.Printf("Unable to log out of XAPI session: %s", err.Error())
+		}
+	}
+
+	ui.Say("XAPI client session established")
+
+	//Share state between the other steps using a statebag
+	state := new(multistep.BasicStateBag)
+	state.Put("client", c)
+	state.Put("config", config)
+	state.Put("commonconfig", config.CommonConfig)
+	state.Put("hook", hook)
+	state.Put("ui", ui)
+
+	return state, logout, nil
+}
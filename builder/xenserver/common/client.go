@@ -1,511 +1,609 @@
 package common
 
 import (
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"log"
 
-	xmlrpc "github.com/amfranz/go-xmlrpc-client"
 	xenapi "github.com/terra-farm/go-xen-api-client"
 )
 
-type XenAPIClient struct {
-	Session  interface{}
-	Host     string
-	Url      string
-	Username string
-	Password string
-	RPC      *xmlrpc.Client
+// Client is the typed XAPI interface the steps depend on. *Connection
+// implements it against a pool, over either protocol and with every call
+// retried and failed over as described there; tests may substitute a fake,
+// usually by embedding Client and overriding the methods the step under
+// test calls.
+type Client interface {
+	VMClient
+	VDIClient
+	VBDClient
+	SRClient
+	NetworkClient
+	HostClient
+	TaskClient
+}
+
+type VMClient interface {
+	GetVMByUUID(ctx context.Context, uuid string) (xenapi.VMRef, error)
+	GetVMByNameLabel(ctx context.Context, name string) ([]xenapi.VMRef, error)
+	GetVMUUID(ctx context.Context, vm xenapi.VMRef) (string, error)
+	GetVMNameLabel(ctx context.Context, vm xenapi.VMRef) (string, error)
+	GetVMNameDescription(ctx context.Context, vm xenapi.VMRef) (string, error)
+	GetVMIsATemplate(ctx context.Context, vm xenapi.VMRef) (bool, error)
+	GetVMDomid(ctx context.Context, vm xenapi.VMRef) (int, error)
+	GetVMResidentOn(ctx context.Context, vm xenapi.VMRef) (xenapi.HostRef, error)
+	GetVMVBDs(ctx context.Context, vm xenapi.VMRef) ([]xenapi.VBDRef, error)
+	GetVMVIFs(ctx context.Context, vm xenapi.VMRef) ([]xenapi.VIFRef, error)
+	GetVMConsoles(ctx context.Context, vm xenapi.VMRef) ([]xenapi.ConsoleRef, error)
+	GetVMPlatform(ctx context.Context, vm xenapi.VMRef) (map[string]string, error)
+	GetVMOtherConfig(ctx context.Context, vm xenapi.VMRef) (map[string]string, error)
+	GetVMVCPUsMax(ctx context.Context, vm xenapi.VMRef) (int, error)
+	GetVMVCPUsAtStartup(ctx context.Context, vm xenapi.VMRef) (int, error)
+	GetVMMemoryStaticMax(ctx context.Context, vm xenapi.VMRef) (int, error)
+	GetConsoleLocation(ctx context.Context, console xenapi.ConsoleRef) (string, error)
+
+	CloneVM(ctx context.Context, vm xenapi.VMRef, name string) (xenapi.VMRef, error)
+
+	// CopyVM makes a full copy of vm with its disks on sr, or on the SRs
+	// they are on if sr is empty.
+	CopyVM(ctx context.Context, vm xenapi.VMRef, name string, sr xenapi.SRRef) (xenapi.VMRef, error)
+	DestroyVM(ctx context.Context, vm xenapi.VMRef) error
+	StartVM(ctx context.Context, vm xenapi.VMRef, paused, force bool) error
+	UnpauseVM(ctx context.Context, vm xenapi.VMRef) error
+	CleanShutdownVM(ctx context.Context, vm xenapi.VMRef) error
+	HardShutdownVM(ctx context.Context, vm xenapi.VMRef) error
+
+	SetVMIsATemplate(ctx context.Context, vm xenapi.VMRef, isATemplate bool) error
+	SetVMNameLabel(ctx context.Context, vm xenapi.VMRef, name string) error
+	SetVMNameDescription(ctx context.Context, vm xenapi.VMRef, description string) error
+	SetVMVCPUsMax(ctx context.Context, vm xenapi.VMRef, vcpus int) error
+	SetVMVCPUsAtStartup(ctx context.Context, vm xenapi.VMRef, vcpus int) error
+	SetVMMemoryLimits(ctx context.Context, vm xenapi.VMRef, staticMin, staticMax, dynamicMin, dynamicMax int) error
+	SetVMPlatform(ctx context.Context, vm xenapi.VMRef, platform map[string]string) error
+	SetVMOtherConfig(ctx context.Context, vm xenapi.VMRef, otherConfig map[string]string) error
+	RemoveFromVMOtherConfig(ctx context.Context, vm xenapi.VMRef, key string) error
+	SetVMHVMBootPolicy(ctx context.Context, vm xenapi.VMRef, policy string) error
+	GetVMHVMBootParams(ctx context.Context, vm xenapi.VMRef) (map[string]string, error)
+	SetVMHVMBootParams(ctx context.Context, vm xenapi.VMRef, params map[string]string) error
+	AddVMTag(ctx context.Context, vm xenapi.VMRef, tag string) error
+
+	// WaitForVMPowerState blocks until the VM is in the given power state.
+	WaitForVMPowerState(ctx context.Context, vm xenapi.VMRef, powerState xenapi.VMPowerState) error
+}
+
+type VDIClient interface {
+	GetVDIByUUID(ctx context.Context, uuid string) (xenapi.VDIRef, error)
+	GetVDIByNameLabel(ctx context.Context, name string) ([]xenapi.VDIRef, error)
+	GetVDIUUID(ctx context.Context, vdi xenapi.VDIRef) (string, error)
+	GetVDINameLabel(ctx context.Context, vdi xenapi.VDIRef) (string, error)
+	GetVDIVirtualSize(ctx context.Context, vdi xenapi.VDIRef) (int, error)
+	CreateVDI(ctx context.Context, record xenapi.VDIRecord) (xenapi.VDIRef, error)
+	CloneVDI(ctx context.Context, vdi xenapi.VDIRef) (xenapi.VDIRef, error)
+	SetVDINameLabel(ctx context.Context, vdi xenapi.VDIRef, name string) error
+	ResizeVDI(ctx context.Context, vdi xenapi.VDIRef, size int) error
+	DestroyVDI(ctx context.Context, vdi xenapi.VDIRef) error
+}
+
+type VBDClient interface {
+	GetVBDVDI(ctx context.Context, vbd xenapi.VBDRef) (xenapi.VDIRef, error)
+	GetVBDType(ctx context.Context, vbd xenapi.VBDRef) (xenapi.VbdType, error)
+	GetVBDUserdevice(ctx context.Context, vbd xenapi.VBDRef) (string, error)
+	CreateVBD(ctx context.Context, record xenapi.VBDRecord) (xenapi.VBDRef, error)
+	UnplugVBD(ctx context.Context, vbd xenapi.VBDRef) error
+	DestroyVBD(ctx context.Context, vbd xenapi.VBDRef) error
+}
+
+type SRClient interface {
+	GetSRByUUID(ctx context.Context, uuid string) (xenapi.SRRef, error)
+	GetSRByNameLabel(ctx context.Context, name string) ([]xenapi.SRRef, error)
+	GetSRNameLabel(ctx context.Context, sr xenapi.SRRef) (string, error)
+	GetSRType(ctx context.Context, sr xenapi.SRRef) (string, error)
+	GetSRContentType(ctx context.Context, sr xenapi.SRRef) (string, error)
+	GetSRPhysicalSize(ctx context.Context, sr xenapi.SRRef) (int, error)
+	GetSRPhysicalUtilisation(ctx context.Context, sr xenapi.SRRef) (int, error)
+	GetAllSRs(ctx context.Context) ([]xenapi.SRRef, error)
+
+	// GetDefaultSR returns the default SR of the pool.
+	GetDefaultSR(ctx context.Context) (xenapi.SRRef, error)
+}
+
+type NetworkClient interface {
+	GetNetworkByUUID(ctx context.Context, uuid string) (xenapi.NetworkRef, error)
+	GetNetworkByNameLabel(ctx context.Context, name string) ([]xenapi.NetworkRef, error)
+	GetNetworkNameLabel(ctx context.Context, network xenapi.NetworkRef) (string, error)
+
+	// GetManagementNetwork returns the network of the pool's management
+	// interface.
+	GetManagementNetwork(ctx context.Context) (xenapi.NetworkRef, error)
+
+	CreateVIF(ctx context.Context, record xenapi.VIFRecord) (xenapi.VIFRef, error)
+	DestroyVIF(ctx context.Context, vif xenapi.VIFRef) error
+	GetVIFNetwork(ctx context.Context, vif xenapi.VIFRef) (xenapi.NetworkRef, error)
+	GetVIFDevice(ctx context.Context, vif xenapi.VIFRef) (string, error)
+	GetVIFMAC(ctx context.Context, vif xenapi.VIFRef) (string, error)
+}
+
+type HostClient interface {
+	GetAllHosts(ctx context.Context) ([]xenapi.HostRef, error)
+	GetHostAddress(ctx context.Context, host xenapi.HostRef) (string, error)
+	GetHostSoftwareVersion(ctx context.Context, host xenapi.HostRef) (map[string]string, error)
+	CallHostPlugin(ctx context.Context, host xenapi.HostRef, plugin, fn string, args map[string]string) (string, error)
+}
+
+type TaskClient interface {
+	CreateTask(ctx context.Context, name, description string) (xenapi.TaskRef, error)
+	DestroyTask(ctx context.Context, task xenapi.TaskRef) error
+	GetTaskResult(ctx context.Context, task xenapi.TaskRef) (string, error)
+	GetTaskErrorInfo(ctx context.Context, task xenapi.TaskRef) ([]string, error)
+
+	// WaitForTask blocks until the task is no longer pending and returns
+	// the status it ended with. progress, if not nil, is called whenever
+	// the progress of the task changes.
+	WaitForTask(ctx context.Context, task xenapi.TaskRef, progress func(float64)) (xenapi.TaskStatusType, error)
+}
+
+var _ Client = (*Connection)(nil)
+
+// VM associated functions
+
+func (c *Connection) GetVMByUUID(ctx context.Context, uuid string) (xenapi.VMRef, error) {
+	return decodeRef[xenapi.VMRef](c.Call(ctx, "VM.get_by_uuid", uuid))
 }
 
-type APIResult struct {
-	Status           string
-	Value            interface{}
-	ErrorDescription string
+func (c *Connection) GetVMByNameLabel(ctx context.Context, name string) ([]xenapi.VMRef, error) {
+	return decodeRefs[xenapi.VMRef](c.Call(ctx, "VM.get_by_name_label", name))
 }
 
-type XenAPIObject struct {
-	Ref    string
-	Client *XenAPIClient
+func (c *Connection) GetVMUUID(ctx context.Context, vm xenapi.VMRef) (string, error) {
+	return decodeString(c.Call(ctx, "VM.get_uuid", vm))
 }
 
-type Host XenAPIObject
-type VM XenAPIObject
-type SR XenAPIObject
-type VDI XenAPIObject
-type Network XenAPIObject
-type VBD XenAPIObject
-type VIF XenAPIObject
-type PIF XenAPIObject
-type Pool XenAPIObject
-type Task XenAPIObject
+func (c *Connection) GetVMNameLabel(ctx context.Context, vm xenapi.VMRef) (string, error) {
+	return decodeString(c.Call(ctx, "VM.get_name_label", vm))
+}
 
-type VDIType int
+func (c *Connection) GetVMNameDescription(ctx context.Context, vm xenapi.VMRef) (string, error) {
+	return decodeString(c.Call(ctx, "VM.get_name_description", vm))
+}
 
-const (
-	_ VDIType = iota
-	Disk
-	CD
-	Floppy
-)
+func (c *Connection) GetVMIsATemplate(ctx context.Context, vm xenapi.VMRef) (bool, error) {
+	return decodeBool(c.Call(ctx, "VM.get_is_a_template", vm))
+}
 
-type TaskStatusType int
+func (c *Connection) GetVMDomid(ctx context.Context, vm xenapi.VMRef) (int, error) {
+	return decodeInt(c.Call(ctx, "VM.get_domid", vm))
+}
 
-const (
-	_ TaskStatusType = iota
-	Pending
-	Success
-	Failure
-	Cancelling
-	Cancelled
-)
+func (c *Connection) GetVMResidentOn(ctx context.Context, vm xenapi.VMRef) (xenapi.HostRef, error) {
+	return decodeRef[xenapi.HostRef](c.Call(ctx, "VM.get_resident_on", vm))
+}
 
-func (c *XenAPIClient) RPCCall(result interface{}, method string, params []interface{}) (err error) {
-	fmt.Println(params)
-	p := xmlrpc.Params{Params: params}
-	err = c.RPC.Call(method, p, result)
-	return err
+func (c *Connection) GetVMVBDs(ctx context.Context, vm xenapi.VMRef) ([]xenapi.VBDRef, error) {
+	return decodeRefs[xenapi.VBDRef](c.Call(ctx, "VM.get_VBDs", vm))
 }
 
-func (client *XenAPIClient) Login() (err error) {
-	//Do loging call
-	result := xmlrpc.Struct{}
+func (c *Connection) GetVMVIFs(ctx context.Context, vm xenapi.VMRef) ([]xenapi.VIFRef, error) {
+	return decodeRefs[xenapi.VIFRef](c.Call(ctx, "VM.get_VIFs", vm))
+}
 
-	params := make([]interface{}, 2)
-	params[0] = client.Username
-	params[1] = client.Password
+func (c *Connection) GetVMConsoles(ctx context.Context, vm xenapi.VMRef) ([]xenapi.ConsoleRef, error) {
+	return decodeRefs[xenapi.ConsoleRef](c.Call(ctx, "VM.get_consoles", vm))
+}
 
-	err = client.RPCCall(&result, "session.login_with_password", params)
-	client.Session = result["Value"]
-	return err
+func (c *Connection) GetVMPlatform(ctx context.Context, vm xenapi.VMRef) (map[string]string, error) {
+	return decodeStringMap(c.Call(ctx, "VM.get_platform", vm))
 }
 
-func (client *XenAPIClient) APICall(result *APIResult, method string, params ...interface{}) (err error) {
-	if client.Session == nil {
-		fmt.Println("Error: no session")
-		return fmt.Errorf("No session. Unable to make call")
-	}
+func (c *Connection) GetVMOtherConfig(ctx context.Context, vm xenapi.VMRef) (map[string]string, error) {
+	return decodeStringMap(c.Call(ctx, "VM.get_other_config", vm))
+}
 
-	//Make a params slice which will include the session
-	p := make([]interface{}, len(params)+1)
-	p[0] = client.Session
+func (c *Connection) GetVMVCPUsMax(ctx context.Context, vm xenapi.VMRef) (int, error) {
+	return decodeInt(c.Call(ctx, "VM.get_VCPUs_max", vm))
+}
 
-	if params != nil {
-		for idx, element := range params {
-			p[idx+1] = element
-		}
-	}
+func (c *Connection) GetVMVCPUsAtStartup(ctx context.Context, vm xenapi.VMRef) (int, error) {
+	return decodeInt(c.Call(ctx, "VM.get_VCPUs_at_startup", vm))
+}
 
-	res := xmlrpc.Struct{}
+func (c *Connection) GetVMMemoryStaticMax(ctx context.Context, vm xenapi.VMRef) (int, error) {
+	return decodeInt(c.Call(ctx, "VM.get_memory_static_max", vm))
+}
 
-	err = client.RPCCall(&res, method, p)
+func (c *Connection) GetConsoleLocation(ctx context.Context, console xenapi.ConsoleRef) (string, error) {
+	return decodeString(c.Call(ctx, "console.get_location", console))
+}
 
-	if err != nil {
-		return err
+func (c *Connection) CloneVM(ctx context.Context, vm xenapi.VMRef, name string) (xenapi.VMRef, error) {
+	return decodeRef[xenapi.VMRef](c.Call(ctx, "VM.clone", vm, name))
+}
+
+func (c *Connection) CopyVM(ctx context.Context, vm xenapi.VMRef, name string, sr xenapi.SRRef) (xenapi.VMRef, error) {
+	if sr == "" {
+		sr = "OpaqueRef:NULL"
 	}
+	return decodeRef[xenapi.VMRef](c.Call(ctx, "VM.copy", vm, name, sr))
+}
 
-	result.Status = res["Status"].(string)
+func (c *Connection) DestroyVM(ctx context.Context, vm xenapi.VMRef) error {
+	_, err := c.Call(ctx, "VM.destroy", vm)
+	return err
+}
 
-	if result.Status != "Success" {
-		fmt.Println("Encountered an API error: ", result.Status)
-		fmt.Println(res["ErrorDescription"])
-		return fmt.Errorf("API Error: %s", res["ErrorDescription"])
-	} else {
-		result.Value = res["Value"]
-	}
-	return
+func (c *Connection) StartVM(ctx context.Context, vm xenapi.VMRef, paused, force bool) error {
+	_, err := c.Call(ctx, "VM.start", vm, paused, force)
+	return err
 }
 
-func (client *XenAPIClient) GetHosts() (hosts []*Host, err error) {
-	hosts = make([]*Host, 0)
-	result := APIResult{}
-	_ = client.APICall(&result, "host.get_all")
-	for _, elem := range result.Value.([]interface{}) {
-		host := new(Host)
-		host.Ref = elem.(string)
-		host.Client = client
-		hosts = append(hosts, host)
-	}
-	return
+func (c *Connection) UnpauseVM(ctx context.Context, vm xenapi.VMRef) error {
+	_, err := c.Call(ctx, "VM.unpause", vm)
+	return err
 }
 
-func (client *XenAPIClient) GetPools() (pools []*Pool, err error) {
-	pools = make([]*Pool, 0)
-	result := APIResult{}
-	err = client.APICall(&result, "pool.get_all")
-	if err != nil {
-		return pools, err
-	}
+func (c *Connection) CleanShutdownVM(ctx context.Context, vm xenapi.VMRef) error {
+	_, err := c.Call(ctx, "VM.clean_shutdown", vm)
+	return err
+}
 
-	for _, elem := range result.Value.([]interface{}) {
-		pool := new(Pool)
-		pool.Ref = elem.(string)
-		pool.Client = client
-		pools = append(pools, pool)
-	}
+func (c *Connection) HardShutdownVM(ctx context.Context, vm xenapi.VMRef) error {
+	_, err := c.Call(ctx, "VM.hard_shutdown", vm)
+	return err
+}
 
-	return pools, nil
+func (c *Connection) SetVMIsATemplate(ctx context.Context, vm xenapi.VMRef, isATemplate bool) error {
+	_, err := c.Call(ctx, "VM.set_is_a_template", vm, isATemplate)
+	return err
 }
 
-func (client *XenAPIClient) GetDefaultSR() (sr *SR, err error) {
-	pools, err := client.GetPools()
+func (c *Connection) SetVMNameLabel(ctx context.Context, vm xenapi.VMRef, name string) error {
+	_, err := c.Call(ctx, "VM.set_name_label", vm, name)
+	return err
+}
 
-	if err != nil {
-		return nil, err
-	}
+func (c *Connection) SetVMNameDescription(ctx context.Context, vm xenapi.VMRef, description string) error {
+	_, err := c.Call(ctx, "VM.set_name_description", vm, description)
+	return err
+}
 
-	pool_rec, err := pools[0].GetRecord()
+func (c *Connection) SetVMVCPUsMax(ctx context.Context, vm xenapi.VMRef, vcpus int) error {
+	_, err := c.Call(ctx, "VM.set_VCPUs_max", vm, vcpus)
+	return err
+}
 
-	if err != nil {
-		return nil, err
-	}
+func (c *Connection) SetVMVCPUsAtStartup(ctx context.Context, vm xenapi.VMRef, vcpus int) error {
+	_, err := c.Call(ctx, "VM.set_VCPUs_at_startup", vm, vcpus)
+	return err
+}
 
-	if pool_rec["default_SR"] == "" {
-		return nil, errors.New("No default_SR specified for the pool.")
-	}
+func (c *Connection) SetVMMemoryLimits(ctx context.Context, vm xenapi.VMRef, staticMin, staticMax, dynamicMin, dynamicMax int) error {
+	_, err := c.Call(ctx, "VM.set_memory_limits", vm, staticMin, staticMax, dynamicMin, dynamicMax)
+	return err
+}
 
-	sr = new(SR)
-	sr.Ref = pool_rec["default_SR"].(string)
-	sr.Client = client
+func (c *Connection) SetVMPlatform(ctx context.Context, vm xenapi.VMRef, platform map[string]string) error {
+	_, err := c.Call(ctx, "VM.set_platform", vm, stringMap(platform))
+	return err
+}
 
-	return sr, nil
+func (c *Connection) SetVMOtherConfig(ctx context.Context, vm xenapi.VMRef, otherConfig map[string]string) error {
+	_, err := c.Call(ctx, "VM.set_other_config", vm, stringMap(otherConfig))
+	return err
 }
 
-func (client *XenAPIClient) GetVMByUuid(vm_uuid string) (vm *VM, err error) {
-	vm = new(VM)
-	result := APIResult{}
-	err = client.APICall(&result, "VM.get_by_uuid", vm_uuid)
-	if err != nil {
-		return nil, err
-	}
-	vm.Ref = result.Value.(string)
-	vm.Client = client
-	return
+func (c *Connection) RemoveFromVMOtherConfig(ctx context.Context, vm xenapi.VMRef, key string) error {
+	_, err := c.Call(ctx, "VM.remove_from_other_config", vm, key)
+	return err
 }
 
-func (client *XenAPIClient) GetVMByNameLabel(name_label string) (vms []*VM, err error) {
-	vms = make([]*VM, 0)
-	result := APIResult{}
-	err = client.APICall(&result, "VM.get_by_name_label", name_label)
-	if err != nil {
-		return vms, err
-	}
+func (c *Connection) SetVMHVMBootPolicy(ctx context.Context, vm xenapi.VMRef, policy string) error {
+	_, err := c.Call(ctx, "VM.set_HVM_boot_policy", vm, policy)
+	return err
+}
 
-	for _, elem := range result.Value.([]interface{}) {
-		vm := new(VM)
-		vm.Ref = elem.(string)
-		vm.Client = client
-		vms = append(vms, vm)
-	}
+func (c *Connection) GetVMHVMBootParams(ctx context.Context, vm xenapi.VMRef) (map[string]string, error) {
+	return decodeStringMap(c.Call(ctx, "VM.get_HVM_boot_params", vm))
+}
 
-	return vms, nil
+func (c *Connection) SetVMHVMBootParams(ctx context.Context, vm xenapi.VMRef, params map[string]string) error {
+	_, err := c.Call(ctx, "VM.set_HVM_boot_params", vm, stringMap(params))
+	return err
 }
 
-func (client *XenAPIClient) GetNetworkByUuid(network_uuid string) (network *Network, err error) {
-	network = new(Network)
-	result := APIResult{}
-	err = client.APICall(&result, "network.get_by_uuid", network_uuid)
-	if err != nil {
-		return nil, err
-	}
-	network.Ref = result.Value.(string)
-	network.Client = client
-	return
+func (c *Connection) AddVMTag(ctx context.Context, vm xenapi.VMRef, tag string) error {
+	_, err := c.Call(ctx, "VM.add_tags", vm, tag)
+	return err
 }
 
-func (client *XenAPIClient) GetNetworkByNameLabel(name_label string) (networks []*Network, err error) {
-	networks = make([]*Network, 0)
-	result := APIResult{}
-	err = client.APICall(&result, "network.get_by_name_label", name_label)
-	if err != nil {
-		return networks, err
-	}
+// VDI associated functions
 
-	for _, elem := range result.Value.([]interface{}) {
-		network := new(Network)
-		network.Ref = elem.(string)
-		network.Client = client
-		networks = append(networks, network)
-	}
+func (c *Connection) GetVDIByUUID(ctx context.Context, uuid string) (xenapi.VDIRef, error) {
+	return decodeRef[xenapi.VDIRef](c.Call(ctx, "VDI.get_by_uuid", uuid))
+}
 
-	return networks, nil
+func (c *Connection) GetVDIByNameLabel(ctx context.Context, name string) ([]xenapi.VDIRef, error) {
+	return decodeRefs[xenapi.VDIRef](c.Call(ctx, "VDI.get_by_name_label", name))
 }
 
-func (client *XenAPIClient) GetVdiByNameLabel(name_label string) (vdis []*VDI, err error) {
-	vdis = make([]*VDI, 0)
-	result := APIResult{}
-	err = client.APICall(&result, "VDI.get_by_name_label", name_label)
-	if err != nil {
-		return vdis, err
-	}
+func (c *Connection) GetVDIUUID(ctx context.Context, vdi xenapi.VDIRef) (string, error) {
+	return decodeString(c.Call(ctx, "VDI.get_uuid", vdi))
+}
 
-	for _, elem := range result.Value.([]interface{}) {
-		vdi := new(VDI)
-		vdi.Ref = elem.(string)
-		vdi.Client = client
-		vdis = append(vdis, vdi)
-	}
+func (c *Connection) GetVDINameLabel(ctx context.Context, vdi xenapi.VDIRef) (string, error) {
+	return decodeString(c.Call(ctx, "VDI.get_name_label", vdi))
+}
 
-	return vdis, nil
+func (c *Connection) GetVDIVirtualSize(ctx context.Context, vdi xenapi.VDIRef) (int, error) {
+	return decodeInt(c.Call(ctx, "VDI.get_virtual_size", vdi))
 }
 
-func (client *XenAPIClient) GetVdiByUuid(vdi_uuid string) (vdi *VDI, err error) {
-	vdi = new(VDI)
-	result := APIResult{}
-	err = client.APICall(&result, "VDI.get_by_uuid", vdi_uuid)
-	if err != nil {
-		return nil, err
-	}
-	vdi.Ref = result.Value.(string)
-	vdi.Client = client
-	return
+func (c *Connection) CreateVDI(ctx context.Context, record xenapi.VDIRecord) (xenapi.VDIRef, error) {
+	return decodeRef[xenapi.VDIRef](c.Call(ctx, "VDI.create", map[string]interface{}{
+		"name_label":       record.NameLabel,
+		"name_description": record.NameDescription,
+		"SR":               record.SR,
+		"virtual_size":     record.VirtualSize,
+		"type":             record.Type,
+		"sharable":         record.Sharable,
+		"read_only":        record.ReadOnly,
+		"other_config":     stringMap(record.OtherConfig),
+		"xenstore_data":    stringMap(record.XenstoreData),
+		"sm_config":        stringMap(record.SmConfig),
+		"tags":             stringSet(record.Tags),
+	}))
 }
 
-func (client *XenAPIClient) GetPIFs() (pifs []*PIF, err error) {
-	pifs = make([]*PIF, 0)
-	result := APIResult{}
-	err = client.APICall(&result, "PIF.get_all")
-	if err != nil {
-		return pifs, err
-	}
-	for _, elem := range result.Value.([]interface{}) {
-		pif := new(PIF)
-		pif.Ref = elem.(string)
-		pif.Client = client
-		pifs = append(pifs, pif)
-	}
+func (c *Connection) CloneVDI(ctx context.Context, vdi xenapi.VDIRef) (xenapi.VDIRef, error) {
+	return decodeRef[xenapi.VDIRef](c.Call(ctx, "VDI.clone", vdi, map[string]string{}))
+}
 
-	return pifs, nil
+func (c *Connection) SetVDINameLabel(ctx context.Context, vdi xenapi.VDIRef, name string) error {
+	_, err := c.Call(ctx, "VDI.set_name_label", vdi, name)
+	return err
 }
 
-// Host associated functions
+func (c *Connection) ResizeVDI(ctx context.Context, vdi xenapi.VDIRef, size int) error {
+	_, err := c.Call(ctx, "VDI.resize", vdi, size)
+	return err
+}
 
-func (self *Host) GetSoftwareVersion() (versions map[string]interface{}, err error) {
-	versions = make(map[string]interface{})
+func (c *Connection) DestroyVDI(ctx context.Context, vdi xenapi.VDIRef) error {
+	_, err := c.Call(ctx, "VDI.destroy", vdi)
+	return err
+}
 
-	result := APIResult{}
-	err = self.Client.APICall(&result, "host.get_software_version", self.Ref)
-	if err != nil {
-		return nil, err
-	}
+// VBD associated functions
 
-	for k, v := range result.Value.(xmlrpc.Struct) {
-		versions[k] = v.(string)
-	}
-	return
+func (c *Connection) GetVBDVDI(ctx context.Context, vbd xenapi.VBDRef) (xenapi.VDIRef, error) {
+	return decodeRef[xenapi.VDIRef](c.Call(ctx, "VBD.get_VDI", vbd))
 }
 
-func (self *Host) CallPlugin(plugin, function string, args map[string]string) (res string, err error) {
+func (c *Connection) GetVBDType(ctx context.Context, vbd xenapi.VBDRef) (xenapi.VbdType, error) {
+	return decodeRef[xenapi.VbdType](c.Call(ctx, "VBD.get_type", vbd))
+}
 
-	args_rec := make(xmlrpc.Struct)
-	for key, value := range args {
-		args_rec[key] = value
-	}
+func (c *Connection) GetVBDUserdevice(ctx context.Context, vbd xenapi.VBDRef) (string, error) {
+	return decodeString(c.Call(ctx, "VBD.get_userdevice", vbd))
+}
 
-	result := APIResult{}
-	err = self.Client.APICall(&result, "host.call_plugin", self.Ref, plugin, function, args_rec)
-	if err != nil {
-		return "", err
-	}
+func (c *Connection) CreateVBD(ctx context.Context, record xenapi.VBDRecord) (xenapi.VBDRef, error) {
+	return decodeRef[xenapi.VBDRef](c.Call(ctx, "VBD.create", map[string]interface{}{
+		"VM":                   record.VM,
+		"VDI":                  record.VDI,
+		"userdevice":           record.Userdevice,
+		"bootable":             record.Bootable,
+		"mode":                 record.Mode,
+		"type":                 record.Type,
+		"unpluggable":          record.Unpluggable,
+		"empty":                record.Empty,
+		"other_config":         stringMap(record.OtherConfig),
+		"qos_algorithm_type":   record.QosAlgorithmType,
+		"qos_algorithm_params": stringMap(record.QosAlgorithmParams),
+	}))
+}
 
-	// The plugin should return a string value
-	res = result.Value.(string)
-	return
+func (c *Connection) UnplugVBD(ctx context.Context, vbd xenapi.VBDRef) error {
+	_, err := c.Call(ctx, "VBD.unplug", vbd)
+	return err
 }
 
-// VM associated functions
+func (c *Connection) DestroyVBD(ctx context.Context, vbd xenapi.VBDRef) error {
+	_, err := c.Call(ctx, "VBD.destroy", vbd)
+	return err
+}
 
-func (self *VM) Clone(label string) (new_instance *VM, err error) {
-	new_instance = new(VM)
+// SR associated functions
 
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.clone", self.Ref, label)
-	if err != nil {
-		return nil, err
-	}
-	new_instance.Ref = result.Value.(string)
-	new_instance.Client = self.Client
-	return
+func (c *Connection) GetSRByUUID(ctx context.Context, uuid string) (xenapi.SRRef, error) {
+	return decodeRef[xenapi.SRRef](c.Call(ctx, "SR.get_by_uuid", uuid))
 }
 
-func (self *VM) Destroy() (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.destroy", self.Ref)
-	if err != nil {
-		return err
-	}
-	return
+func (c *Connection) GetSRByNameLabel(ctx context.Context, name string) ([]xenapi.SRRef, error) {
+	return decodeRefs[xenapi.SRRef](c.Call(ctx, "SR.get_by_name_label", name))
 }
 
-func (self *VM) Start(paused, force bool) (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.start", self.Ref, paused, force)
-	if err != nil {
-		return err
-	}
-	return
+func (c *Connection) GetSRNameLabel(ctx context.Context, sr xenapi.SRRef) (string, error) {
+	return decodeString(c.Call(ctx, "SR.get_name_label", sr))
 }
 
-func (self *VM) CleanShutdown() (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.clean_shutdown", self.Ref)
-	if err != nil {
-		return err
-	}
-	return
+func (c *Connection) GetSRType(ctx context.Context, sr xenapi.SRRef) (string, error) {
+	return decodeString(c.Call(ctx, "SR.get_type", sr))
 }
 
-func Unpause(c *Connection, vmRef xenapi.VMRef) (err error) {
-	err = c.client.VM.Unpause(c.session, vmRef)
-	if err != nil {
-		return err
-	}
-	return
+func (c *Connection) GetSRContentType(ctx context.Context, sr xenapi.SRRef) (string, error) {
+	return decodeString(c.Call(ctx, "SR.get_content_type", sr))
 }
 
-func (self *VM) SetHVMBoot(policy, bootOrder string) (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.set_HVM_boot_policy", self.Ref, policy)
-	if err != nil {
-		return err
-	}
-	result = APIResult{}
-	params := make(xmlrpc.Struct)
-	params["order"] = bootOrder
-	err = self.Client.APICall(&result, "VM.set_HVM_boot_params", self.Ref, params)
-	if err != nil {
-		return err
-	}
-	return
+func (c *Connection) GetSRPhysicalSize(ctx context.Context, sr xenapi.SRRef) (int, error) {
+	return decodeInt(c.Call(ctx, "SR.get_physical_size", sr))
 }
 
-func (self *VM) SetPVBootloader(pv_bootloader, pv_args string) (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.set_PV_bootloader", self.Ref, pv_bootloader)
-	if err != nil {
-		return err
-	}
-	result = APIResult{}
-	err = self.Client.APICall(&result, "VM.set_PV_bootloader_args", self.Ref, pv_args)
-	if err != nil {
-		return err
-	}
-	return
+func (c *Connection) GetSRPhysicalUtilisation(ctx context.Context, sr xenapi.SRRef) (int, error) {
+	return decodeInt(c.Call(ctx, "SR.get_physical_utilisation", sr))
 }
 
-func (self *VM) GetDomainId() (domid string, err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.get_domid", self.Ref)
-	if err != nil {
-		return "", err
-	}
-	domid = result.Value.(string)
-	return domid, nil
+func (c *Connection) GetAllSRs(ctx context.Context) ([]xenapi.SRRef, error) {
+	return decodeRefs[xenapi.SRRef](c.Call(ctx, "SR.get_all"))
 }
 
-func (self *VM) GetPowerState() (state string, err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.get_power_state", self.Ref)
+func (c *Connection) GetDefaultSR(ctx context.Context) (xenapi.SRRef, error) {
+	// The pool records are decoded field by field, so allowed_operations
+	// values added in newer releases do not get in the way
+	records, err := c.Call(ctx, "pool.get_all_records")
 	if err != nil {
 		return "", err
 	}
-	state = result.Value.(string)
-	return state, nil
+	pools, _ := toStruct(records)
+	for _, record := range pools {
+		fields, _ := toStruct(record)
+		return decodeRef[xenapi.SRRef](fields["default_SR"], nil)
+	}
+	return "", errors.New("failed to find the pool")
 }
 
-func (self *VM) GetUuid() (uuid string, err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.get_uuid", self.Ref)
-	if err != nil {
-		return "", err
-	}
-	uuid = result.Value.(string)
-	return uuid, nil
+// Network associated functions
+
+func (c *Connection) GetNetworkByUUID(ctx context.Context, uuid string) (xenapi.NetworkRef, error) {
+	return decodeRef[xenapi.NetworkRef](c.Call(ctx, "network.get_by_uuid", uuid))
+}
+
+func (c *Connection) GetNetworkByNameLabel(ctx context.Context, name string) ([]xenapi.NetworkRef, error) {
+	return decodeRefs[xenapi.NetworkRef](c.Call(ctx, "network.get_by_name_label", name))
 }
 
-func (self *VM) GetVBDs() (vbds []VBD, err error) {
-	vbds = make([]VBD, 0)
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.get_VBDs", self.Ref)
+func (c *Connection) GetNetworkNameLabel(ctx context.Context, network xenapi.NetworkRef) (string, error) {
+	return decodeString(c.Call(ctx, "network.get_name_label", network))
+}
+
+func (c *Connection) GetManagementNetwork(ctx context.Context) (xenapi.NetworkRef, error) {
+	records, err := c.Call(ctx, "PIF.get_all_records")
 	if err != nil {
-		return vbds, err
+		return "", err
 	}
-	for _, elem := range result.Value.([]interface{}) {
-		vbd := VBD{}
-		vbd.Ref = elem.(string)
-		vbd.Client = self.Client
-		vbds = append(vbds, vbd)
+	pifs, _ := toStruct(records)
+	for _, record := range pifs {
+		fields, _ := toStruct(record)
+		if fields["management"] == true {
+			return decodeRef[xenapi.NetworkRef](fields["network"], nil)
+		}
 	}
+	return "", errors.New("no PIF is used for management")
+}
 
-	return vbds, nil
+func (c *Connection) CreateVIF(ctx context.Context, record xenapi.VIFRecord) (xenapi.VIFRef, error) {
+	return decodeRef[xenapi.VIFRef](c.Call(ctx, "VIF.create", map[string]interface{}{
+		"device":               record.Device,
+		"network":              record.Network,
+		"VM":                   record.VM,
+		"MAC":                  record.MAC,
+		"MTU":                  record.MTU,
+		"other_config":         stringMap(record.OtherConfig),
+		"qos_algorithm_type":   record.QosAlgorithmType,
+		"qos_algorithm_params": stringMap(record.QosAlgorithmParams),
+		"locking_mode":         record.LockingMode,
+	}))
 }
 
-func GetDisks(c *Connection, vmRef xenapi.VMRef) (vdis []xenapi.VDIRef, err error) {
-	// Return just data disks (non-isos)
-	vdis = make([]xenapi.VDIRef, 0)
-	vbds, err := c.client.VM.GetVBDs(c.session, vmRef)
-	if err != nil {
-		return nil, err
-	}
+func (c *Connection) DestroyVIF(ctx context.Context, vif xenapi.VIFRef) error {
+	_, err := c.Call(ctx, "VIF.destroy", vif)
+	return err
+}
 
-	for _, vbd := range vbds {
-		rec, err := c.client.VBD.GetRecord(c.session, vbd)
-		if err != nil {
-			return nil, err
-		}
-		if rec.Type == "Disk" {
+func (c *Connection) GetVIFNetwork(ctx context.Context, vif xenapi.VIFRef) (xenapi.NetworkRef, error) {
+	return decodeRef[xenapi.NetworkRef](c.Call(ctx, "VIF.get_network", vif))
+}
 
-			vdi, err := c.client.VBD.GetVDI(c.session, vbd)
-			if err != nil {
-				return nil, err
-			}
-			vdis = append(vdis, vdi)
+func (c *Connection) GetVIFDevice(ctx context.Context, vif xenapi.VIFRef) (string, error) {
+	return decodeString(c.Call(ctx, "VIF.get_device", vif))
+}
 
-		}
-	}
-	return vdis, nil
+func (c *Connection) GetVIFMAC(ctx context.Context, vif xenapi.VIFRef) (string, error) {
+	return decodeString(c.Call(ctx, "VIF.get_MAC", vif))
 }
 
-func (self *VM) GetGuestMetricsRef() (ref string, err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.get_guest_metrics", self.Ref)
-	if err != nil {
-		return "", nil
-	}
-	ref = result.Value.(string)
-	return ref, err
+// Host associated functions
+
+func (c *Connection) GetAllHosts(ctx context.Context) ([]xenapi.HostRef, error) {
+	return decodeRefs[xenapi.HostRef](c.Call(ctx, "host.get_all"))
 }
 
-func (self *VM) GetGuestMetrics() (metrics map[string]interface{}, err error) {
-	metrics_ref, err := self.GetGuestMetricsRef()
-	if err != nil {
-		return nil, err
+func (c *Connection) GetHostAddress(ctx context.Context, host xenapi.HostRef) (string, error) {
+	return decodeString(c.Call(ctx, "host.get_address", host))
+}
+
+func (c *Connection) GetHostSoftwareVersion(ctx context.Context, host xenapi.HostRef) (map[string]string, error) {
+	return decodeStringMap(c.Call(ctx, "host.get_software_version", host))
+}
+
+func (c *Connection) CallHostPlugin(ctx context.Context, host xenapi.HostRef, plugin, fn string, args map[string]string) (string, error) {
+	return decodeString(c.Call(ctx, "host.call_plugin", host, plugin, fn, stringMap(args)))
+}
+
+// Task associated functions
+
+func (c *Connection) CreateTask(ctx context.Context, name, description string) (xenapi.TaskRef, error) {
+	return decodeRef[xenapi.TaskRef](c.Call(ctx, "task.create", name, description))
+}
+
+func (c *Connection) DestroyTask(ctx context.Context, task xenapi.TaskRef) error {
+	_, err := c.Call(ctx, "task.destroy", task)
+	return err
+}
+
+func (c *Connection) GetTaskResult(ctx context.Context, task xenapi.TaskRef) (string, error) {
+	return decodeString(c.Call(ctx, "task.get_result", task))
+}
+
+func (c *Connection) GetTaskErrorInfo(ctx context.Context, task xenapi.TaskRef) ([]string, error) {
+	return decodeStrings(c.Call(ctx, "task.get_error_info", task))
+}
+
+// stringMap and stringSet make sure maps and sets are sent as empty rather
+// than null when not set.
+
+func stringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
 	}
-	if metrics_ref == "OpaqueRef:NULL" {
-		return nil, nil
+	return m
+}
+
+func stringSet(s []string) []string {
+	if s == nil {
+		return []string{}
 	}
+	return s
+}
 
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM_guest_metrics.get_record", metrics_ref)
+// Helpers built on Client
+
+func GetDisks(ctx context.Context, c Client, vmRef xenapi.VMRef) (vdis []xenapi.VDIRef, err error) {
+	// Return just data disks (non-isos)
+	vbds, err := c.GetVMVBDs(ctx, vmRef)
 	if err != nil {
 		return nil, err
 	}
-	return result.Value.(xmlrpc.Struct), nil
-}
 
-func (self *VM) SetStaticMemoryRange(min, max uint) (err error) {
-	result := APIResult{}
-	strMin := fmt.Sprintf("%d", min)
-	strMax := fmt.Sprintf("%d", max)
-	err = self.Client.APICall(&result, "VM.set_memory_limits", self.Ref, strMin, strMax, strMin, strMax)
-	if err != nil {
-		return err
+	vdis = make([]xenapi.VDIRef, 0)
+	for _, vbd := range vbds {
+		vbdType, err := c.GetVBDType(ctx, vbd)
+		if err != nil {
+			return nil, err
+		}
+		if vbdType != xenapi.VbdTypeDisk {
+			continue
+		}
+		vdi, err := c.GetVBDVDI(ctx, vbd)
+		if err != nil {
+			return nil, err
+		}
+		vdis = append(vdis, vdi)
 	}
-	return
+	return vdis, nil
 }
 
-func ConnectVdi(c *Connection, vmRef xenapi.VMRef, vdiRef xenapi.VDIRef, vbdType xenapi.VbdType) (err error) {
+func ConnectVdi(ctx context.Context, c Client, vmRef xenapi.VMRef, vdiRef xenapi.VDIRef, vbdType xenapi.VbdType) (err error) {
 
 	var mode xenapi.VbdMode
 	var unpluggable bool
@@ -529,7 +627,7 @@ func ConnectVdi(c *Connection, vmRef xenapi.VMRef, vdiRef xenapi.VDIRef, vbdType
 		t = xenapi.VbdTypeFloppy
 	}
 
-	vbd_ref, err := c.client.VBD.Create(c.session, xenapi.VBDRecord{
+	vbd_ref, err := c.CreateVBD(ctx, xenapi.VBDRecord{
 		VM:         xenapi.VMRef(vmRef),
 		VDI:        xenapi.VDIRef(vdiRef),
 		Userdevice: "autodetect",
@@ -547,39 +645,25 @@ func ConnectVdi(c *Connection, vmRef xenapi.VMRef, vdiRef xenapi.VDIRef, vbdType
 		return err
 	}
 
-	fmt.Println("VBD Ref:", vbd_ref)
-
-	uuid, err := c.client.VBD.GetUUID(c.session, vbd_ref)
-
-	fmt.Println("VBD UUID: ", uuid)
-	/*
-	   // 2. Plug VBD (Non need - the VM hasn't booted.
-	   // @todo - check VM state
-	   result = APIResult{}
-	   err = self.Client.APICall(&result, "VBD.plug", vbd_ref)
-
-	   if err != nil {
-	       return err
-	   }
-	*/
+	log.Printf("Created VBD '%s'", vbd_ref)
+	// The VBD is not plugged, as the VM hasn't booted yet
 	return
 }
 
-func DisconnectVdi(c *Connection, vmRef xenapi.VMRef, vdi xenapi.VDIRef) error {
-	vbds, err := c.client.VM.GetVBDs(c.session, vmRef)
+func DisconnectVdi(ctx context.Context, c Client, vmRef xenapi.VMRef, vdi xenapi.VDIRef) error {
+	vbds, err := c.GetVMVBDs(ctx, vmRef)
 	if err != nil {
 		return fmt.Errorf("Unable to get VM VBDs: %s", err.Error())
 	}
 
 	for _, vbd := range vbds {
-		rec, err := c.client.VBD.GetRecord(c.session, vbd)
+		recVdi, err := c.GetVBDVDI(ctx, vbd)
 		if err != nil {
-			return fmt.Errorf("Could not get record for VBD '%s': %s", vbd, err.Error())
+			return fmt.Errorf("Could not get VDI of VBD '%s': %s", vbd, err.Error())
 		}
-		recVdi := rec.VDI
 		if recVdi == vdi {
-			_ = c.client.VBD.Unplug(c.session, vbd)
-			err = c.client.VBD.Destroy(c.session, vbd)
+			_ = c.UnplugVBD(ctx, vbd)
+			err = c.DestroyVBD(ctx, vbd)
 			if err != nil {
 				return fmt.Errorf("Could not destroy VBD '%s': %s", vbd, err.Error())
 			}
@@ -593,23 +677,19 @@ func DisconnectVdi(c *Connection, vmRef xenapi.VMRef, vdi xenapi.VDIRef) error {
 	return fmt.Errorf("Could not find VBD for VDI '%s'", vdi)
 }
 
-func (self *VM) SetPlatform(params map[string]string) (err error) {
-	result := APIResult{}
-	platform_rec := make(xmlrpc.Struct)
-	for key, value := range params {
-		platform_rec[key] = value
-	}
-
-	err = self.Client.APICall(&result, "VM.set_platform", self.Ref, platform_rec)
-
-	if err != nil {
-		return err
+func AddVMTags(ctx context.Context, c Client, vmRef xenapi.VMRef, tags []string) error {
+	for _, tag := range tags {
+		log.Printf("Adding tag %s to VM %s\n", tag, vmRef)
+		err := c.AddVMTag(ctx, vmRef, tag)
+		if err != nil {
+			return err
+		}
 	}
-	return
+	return nil
 }
 
-func ConnectNetwork(c *Connection, networkRef xenapi.NetworkRef, vmRef xenapi.VMRef, device string) (*xenapi.VIFRef, error) {
-	vif, err := c.client.VIF.Create(c.session, xenapi.VIFRecord{
+func ConnectNetwork(ctx context.Context, c Client, networkRef xenapi.NetworkRef, vmRef xenapi.VMRef, device string) (*xenapi.VIFRef, error) {
+	vif, err := c.CreateVIF(ctx, xenapi.VIFRecord{
 		Network:     networkRef,
 		VM:          vmRef,
 		Device:      device,
@@ -624,205 +704,6 @@ func ConnectNetwork(c *Connection, networkRef xenapi.NetworkRef, vmRef xenapi.VM
 	return &vif, nil
 }
 
-func AddVMTags(c *Connection, vmRef xenapi.VMRef, tags []string) error {
-	for _, tag := range tags {
-		log.Printf("Adding tag %s to VM %s\n", tag, vmRef)
-		err := c.GetClient().VM.AddTags(c.session, vmRef, tag)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-//      Setters
-
-func (self *VM) SetIsATemplate(is_a_template bool) (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VM.set_is_a_template", self.Ref, is_a_template)
-	if err != nil {
-		return err
-	}
-	return
-}
-
-// SR associated functions
-
-func (self *SR) CreateVdi(name_label string, size int64) (vdi *VDI, err error) {
-	vdi = new(VDI)
-
-	vdi_rec := make(xmlrpc.Struct)
-	vdi_rec["name_label"] = name_label
-	vdi_rec["SR"] = self.Ref
-	vdi_rec["virtual_size"] = fmt.Sprintf("%d", size)
-	vdi_rec["type"] = "user"
-	vdi_rec["sharable"] = false
-	vdi_rec["read_only"] = false
-
-	oc := make(xmlrpc.Struct)
-	oc["temp"] = "temp"
-	vdi_rec["other_config"] = oc
-
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VDI.create", vdi_rec)
-	if err != nil {
-		return nil, err
-	}
-
-	vdi.Ref = result.Value.(string)
-	vdi.Client = self.Client
-
-	return
-}
-
-// Network associated functions
-
-func (self *Network) GetAssignedIPs() (ip_map map[string]string, err error) {
-	ip_map = make(map[string]string, 0)
-	result := APIResult{}
-	err = self.Client.APICall(&result, "network.get_assigned_ips", self.Ref)
-	if err != nil {
-		return ip_map, err
-	}
-	for k, v := range result.Value.(xmlrpc.Struct) {
-		ip_map[k] = v.(string)
-	}
-	return ip_map, nil
-}
-
-// PIF associated functions
-
-func (self *PIF) GetRecord() (record map[string]interface{}, err error) {
-	record = make(map[string]interface{})
-	result := APIResult{}
-	err = self.Client.APICall(&result, "PIF.get_record", self.Ref)
-	if err != nil {
-		return record, err
-	}
-	for k, v := range result.Value.(xmlrpc.Struct) {
-		record[k] = v
-	}
-	return record, nil
-}
-
-// Pool associated functions
-
-func (self *Pool) GetRecord() (record map[string]interface{}, err error) {
-	record = make(map[string]interface{})
-	result := APIResult{}
-	err = self.Client.APICall(&result, "pool.get_record", self.Ref)
-	if err != nil {
-		return record, err
-	}
-	for k, v := range result.Value.(xmlrpc.Struct) {
-		record[k] = v
-	}
-	return record, nil
-}
-
-// VBD associated functions
-func (self *VBD) GetRecord() (record map[string]interface{}, err error) {
-	record = make(map[string]interface{})
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VBD.get_record", self.Ref)
-	if err != nil {
-		return record, err
-	}
-	for k, v := range result.Value.(xmlrpc.Struct) {
-		record[k] = v
-	}
-	return record, nil
-}
-
-func (self *VBD) GetVDI() (vdi *VDI, err error) {
-	vbd_rec, err := self.GetRecord()
-	if err != nil {
-		return nil, err
-	}
-
-	vdi = new(VDI)
-	vdi.Ref = vbd_rec["VDI"].(string)
-	vdi.Client = self.Client
-
-	return vdi, nil
-}
-
-func (self *VBD) Eject() (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VBD.eject", self.Ref)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (self *VBD) Unplug() (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VBD.unplug", self.Ref)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (self *VBD) Destroy() (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VBD.destroy", self.Ref)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// VIF associated functions
-
-func (self *VIF) Destroy() (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VIF.destroy", self.Ref)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// VDI associated functions
-
-func (self *VDI) GetUuid() (vdi_uuid string, err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VDI.get_uuid", self.Ref)
-	if err != nil {
-		return "", err
-	}
-	vdi_uuid = result.Value.(string)
-	return vdi_uuid, nil
-}
-
-func (self *VDI) GetVBDs() (vbds []VBD, err error) {
-	vbds = make([]VBD, 0)
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VDI.get_VBDs", self.Ref)
-	if err != nil {
-		return vbds, err
-	}
-	for _, elem := range result.Value.([]interface{}) {
-		vbd := VBD{}
-		vbd.Ref = elem.(string)
-		vbd.Client = self.Client
-		vbds = append(vbds, vbd)
-	}
-
-	return vbds, nil
-}
-
-func (self *VDI) Destroy() (err error) {
-	result := APIResult{}
-	err = self.Client.APICall(&result, "VDI.destroy", self.Ref)
-	if err != nil {
-		return err
-	}
-	return
-}
-
 // Expose a VDI using the Transfer VM
 // (Legacy VHD export)
 
@@ -830,9 +711,9 @@ type TransferRecord struct {
 	UrlFull string `xml:"url_full,attr"`
 }
 
-func Expose(c *Connection, vdiRef xenapi.VDIRef, format string) (url string, err error) {
+func Expose(ctx context.Context, c Client, vdiRef xenapi.VDIRef, format string) (url string, err error) {
 
-	hosts, err := c.client.Host.GetAll(c.session)
+	hosts, err := c.GetAllHosts(ctx)
 
 	if err != nil {
 		err = errors.New(fmt.Sprintf("Could not retrieve hosts in the pool: %s", err.Error()))
@@ -852,7 +733,7 @@ func Expose(c *Connection, vdiRef xenapi.VDIRef, format string) (url string, err
 	args["network_uuid"] = "management"
 	args["timeout_minutes"] = "5"
 
-	handle, err := c.client.Host.CallPlugin(c.session, host, "transfer", "expose", args)
+	handle, err := c.CallHostPlugin(ctx, host, "transfer", "expose", args)
 
 	if err != nil {
 		err = errors.New(fmt.Sprintf("Error whilst exposing VDI %s: %s", vdiRef, err.Error()))
@@ -861,7 +742,7 @@ func Expose(c *Connection, vdiRef xenapi.VDIRef, format string) (url string, err
 
 	args = make(map[string]string)
 	args["record_handle"] = handle
-	record_xml, err := c.client.Host.CallPlugin(c.session, host, "transfer", "get_record", args)
+	record_xml, err := c.CallHostPlugin(ctx, host, "transfer", "get_record", args)
 
 	if err != nil {
 		err = errors.New(fmt.Sprintf("Unable to retrieve transfer record for VDI %s: %s", vdiRef, err.Error()))
@@ -888,15 +769,15 @@ func Expose(c *Connection, vdiRef xenapi.VDIRef, format string) (url string, err
 	return
 }
 
-func Unexpose(c *Connection, vdiRef xenapi.VDIRef) (err error) {
+func Unexpose(ctx context.Context, c Client, vdiRef xenapi.VDIRef) (err error) {
 
-	disk_uuid, err := c.client.VDI.GetUUID(c.session, vdiRef)
+	disk_uuid, err := c.GetVDIUUID(ctx, vdiRef)
 
 	if err != nil {
 		return err
 	}
 
-	hosts, err := c.client.Host.GetAll(c.session)
+	hosts, err := c.GetAllHosts(ctx)
 
 	if err != nil {
 		err = errors.New(fmt.Sprintf("Could not retrieve hosts in the pool: %s", err.Error()))
@@ -908,7 +789,7 @@ func Unexpose(c *Connection, vdiRef xenapi.VDIRef) (err error) {
 	args := make(map[string]string)
 	args["vdi_uuid"] = disk_uuid
 
-	result, err := c.client.Host.CallPlugin(c.session, host, "transfer", "unexpose", args)
+	result, err := c.CallHostPlugin(ctx, host, "transfer", "unexpose", args)
 
 	if err != nil {
 		return err
@@ -918,68 +799,3 @@ func Unexpose(c *Connection, vdiRef xenapi.VDIRef) (err error) {
 
 	return nil
 }
-
-// Task associated functions
-
-// func (self *Task) GetResult() (object *XenAPIObject, err error) {
-// 	result := APIResult{}
-// 	err = self.Client.APICall(&result, "task.get_result", self.Ref)
-// 	if err != nil {
-// 		return
-// 	}
-// 	switch ref := result.Value.(type) {
-// 	case string:
-// 		// @fixme: xapi currently sends us an xmlrpc-encoded string via xmlrpc.
-// 		// This seems to be a bug in xapi. Remove this workaround when it's fixed
-// 		re := regexp.MustCompile("^<value><array><data><value>([^<]*)</value>.*</data></array></value>$")
-// 		match := re.FindStringSubmatch(ref)
-// 		if match == nil {
-// 			object = nil
-// 		} else {
-// 			object = &XenAPIObject{
-// 				Ref:    match[1],
-// 				Client: self.Client,
-// 			}
-// 		}
-// 	case nil:
-// 		object = nil
-// 	default:
-// 		err = fmt.Errorf("task.get_result: unknown value type %T (expected string or nil)", ref)
-// 	}
-// 	return
-// }
-
-// Client Initiator
-type Connection struct {
-	client   *xenapi.Client
-	session  xenapi.SessionRef
-	Host     string
-	Username string
-	Password string
-}
-
-func (c Connection) GetSession() string {
-	return string(c.session)
-}
-
-func NewXenAPIClient(host, username, password string) (*Connection, error) {
-	client, err := xenapi.NewClient("https://"+host, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	session, err := client.Session.LoginWithPassword(username, password, "1.0", "packer")
-	if err != nil {
-		return nil, err
-	}
-
-	return &Connection{client, session, host, username, password}, nil
-}
-
-func (c *Connection) GetClient() *xenapi.Client {
-	return c.client
-}
-
-func (c *Connection) GetSessionRef() xenapi.SessionRef {
-	return c.session
-}
@@ -1,9 +1,12 @@
 package common
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/common"
@@ -14,29 +17,138 @@ import (
 
 // DiskConfig represents a virtual disk to be created on the VM
 type DiskConfig struct {
-	Name   string `mapstructure:"disk_name"`
-	Size   uint   `mapstructure:"disk_size"`
-	SRName string `mapstructure:"sr_name"`
+	Name        string `mapstructure:"disk_name"`
+	Description string `mapstructure:"disk_description"`
+	Size        uint   `mapstructure:"disk_size"`
+	SRName      string `mapstructure:"sr_name"`
+
+	// VDI settings
+	Sharable    bool              `mapstructure:"sharable"`
+	SMConfig    map[string]string `mapstructure:"sm_config"`
+	OtherConfig map[string]string `mapstructure:"other_config"`
+
+	// VBD settings
+	Userdevice         string            `mapstructure:"userdevice"`
+	Bootable           bool              `mapstructure:"bootable"`
+	Mode               string            `mapstructure:"mode"`
+	QoSAlgorithmType   string            `mapstructure:"qos_algorithm_type"`
+	QoSAlgorithmParams map[string]string `mapstructure:"qos_algorithm_params"`
+}
+
+// ExistingDiskConfig is a VDI that already exists in the pool, to attach to
+// the VM during the build
+type ExistingDiskConfig struct {
+	// Name label or UUID of the VDI
+	VDI string `mapstructure:"vdi"`
+	// Attach a clone of the VDI rather than the VDI itself
+	Clone bool `mapstructure:"clone"`
+	// Leave the disk attached to the final template
+	Keep bool `mapstructure:"keep"`
+}
+
+// prepare validates the disk at index i of disks and normalises its mode.
+func (d *DiskConfig) prepare(i int) []error {
+	var errs []error
+
+	d.Mode = strings.ToUpper(d.Mode)
+	switch d.Mode {
+	case "", string(xenapi.VbdModeRW), string(xenapi.VbdModeRO):
+	default:
+		errs = append(errs, fmt.Errorf("disks[%d]: mode must be one of 'RW', 'RO'", i))
+	}
+
+	if d.Userdevice != "" && d.Userdevice != "autodetect" {
+		if _, err := strconv.ParseUint(d.Userdevice, 10, 8); err != nil {
+			errs = append(errs, fmt.Errorf("disks[%d]: userdevice must be a device number or 'autodetect'", i))
+		}
+	}
+
+	switch d.QoSAlgorithmType {
+	case "", "ionice":
+	default:
+		errs = append(errs, fmt.Errorf("disks[%d]: qos_algorithm_type must be 'ionice'", i))
+	}
+	if d.QoSAlgorithmType == "" && len(d.QoSAlgorithmParams) != 0 {
+		errs = append(errs, fmt.Errorf("disks[%d]: qos_algorithm_params needs a qos_algorithm_type", i))
+	}
+
+	return errs
+}
+
+// VDIRecord returns the VDI to create for the disk on sr.
+func (d DiskConfig) VDIRecord(sr xenapi.SRRef) xenapi.VDIRecord {
+	otherConfig := map[string]string{
+		"temp": "temp",
+	}
+	for key, value := range d.OtherConfig {
+		otherConfig[key] = value
+	}
+
+	return xenapi.VDIRecord{
+		NameLabel:       d.Name,
+		NameDescription: d.Description,
+		VirtualSize:     int(d.Size * 1024 * 1024),
+		Type:            "user",
+		Sharable:        d.Sharable,
+		ReadOnly:        false,
+		SR:              sr,
+		SmConfig:        d.SMConfig,
+		OtherConfig:     otherConfig,
+	}
+}
+
+// VBDRecord returns the VBD attaching vdi, created from the disk, to vm.
+func (d DiskConfig) VBDRecord(vm xenapi.VMRef, vdi xenapi.VDIRef) xenapi.VBDRecord {
+	userdevice := d.Userdevice
+	if userdevice == "" {
+		userdevice = "autodetect"
+	}
+	mode := xenapi.VbdMode(d.Mode)
+	if mode == "" {
+		mode = xenapi.VbdModeRW
+	}
+
+	return xenapi.VBDRecord{
+		VM:                 vm,
+		VDI:                vdi,
+		Userdevice:         userdevice,
+		Bootable:           d.Bootable,
+		Mode:               mode,
+		Type:               xenapi.VbdTypeDisk,
+		QosAlgorithmType:   d.QoSAlgorithmType,
+		QosAlgorithmParams: d.QoSAlgorithmParams,
+	}
 }
 
 type CommonConfig struct {
-	Username    string `mapstructure:"remote_username"`
-	Password    string `mapstructure:"remote_password"`
-	HostIp      string `mapstructure:"remote_host"`
-	HostSshPort uint   `mapstructure:"remote_ssh_port"`
-
-	VMName             string       `mapstructure:"vm_name"`
-	VMDescription      string       `mapstructure:"vm_description"`
-	SrName             string       `mapstructure:"sr_name"`
-	SrISOName          string       `mapstructure:"sr_iso_name" required:"false"`
-	DiskName           string       `mapstructure:"disk_name"`
-	DiskSize           uint         `mapstructure:"disk_size"`
-	Disks              []DiskConfig `mapstructure:"disks"`
-	CDFiles            []string     `mapstructure:"cd_files"`
-	FloppyFiles        []string     `mapstructure:"floppy_files"`
-	NetworkNames       []string     `mapstructure:"network_names"`
-	ExportNetworkNames []string     `mapstructure:"export_network_names"`
-	VMTags             []string     `mapstructure:"vm_tags"`
+	Username        string   `mapstructure:"remote_username"`
+	Password        string   `mapstructure:"remote_password"`
+	SessionID       string   `mapstructure:"remote_session_id"`
+	CredentialsFile string   `mapstructure:"remote_credentials_file"`
+	HostIp          string   `mapstructure:"remote_host"`
+	HostIps         []string `mapstructure:"remote_hosts"`
+	HostSshPort     uint     `mapstructure:"remote_ssh_port"`
+
+	CAFile                string   `mapstructure:"remote_ca_file"`
+	TLSFingerprint        string   `mapstructure:"remote_tls_fingerprint"`
+	TLSFingerprints       []string `mapstructure:"remote_tls_fingerprints"`
+	InsecureSkipTLSVerify bool     `mapstructure:"remote_insecure_skip_tls_verify"`
+
+	APIProtocol string `mapstructure:"remote_api_protocol"`
+
+	VMName             string               `mapstructure:"vm_name"`
+	VMDescription      string               `mapstructure:"vm_description"`
+	SrName             string               `mapstructure:"sr_name"`
+	SrISOName          string               `mapstructure:"sr_iso_name" required:"false"`
+	DiskName           string               `mapstructure:"disk_name"`
+	DiskSize           uint                 `mapstructure:"disk_size"`
+	Disks              []DiskConfig         `mapstructure:"disks"`
+	ExistingDisks      []ExistingDiskConfig `mapstructure:"existing_disks"`
+	CDFiles            []string             `mapstructure:"cd_files"`
+	FloppyFiles        []string             `mapstructure:"floppy_files"`
+	NetworkNames       []string             `mapstructure:"network_names"`
+	ExportNetworkNames []string             `mapstructure:"export_network_names"`
+	VMTags             []string             `mapstructure:"vm_tags"`
 
 	HostPortMin uint `mapstructure:"host_port_min"`
 	HostPortMax uint `mapstructure:"host_port_max"`
@@ -59,10 +171,44 @@ type CommonConfig struct {
 	//	SSHHostPortMax    uint   `mapstructure:"ssh_host_port_max"`
 	SSHConfig `mapstructure:",squash"`
 
-	OutputDir string `mapstructure:"output_directory"`
-	Format    string `mapstructure:"format"`
-	KeepVM    string `mapstructure:"keep_vm"`
-	IPGetter  string `mapstructure:"ip_getter"`
+	OutputDir string   `mapstructure:"output_directory"`
+	Format    string   `mapstructure:"format"`
+	Formats   []string `mapstructure:"formats"`
+	KeepVM    string   `mapstructure:"keep_vm"`
+	IPGetter  string   `mapstructure:"ip_getter"`
+
+	ExportParallelism uint   `mapstructure:"export_parallelism"`
+	OVFDiskFormat     string `mapstructure:"ovf_disk_format"`
+}
+
+// prepareFormats checks the export formats, which have to be exported to
+// different files.
+func (c CommonConfig) prepareFormats() []error {
+	var errs []error
+
+	seen := make(map[string]bool)
+	for _, format := range c.Formats {
+		switch format {
+		case "xva", "xva_compressed", "vdi_raw", "vdi_vhd", "vdi_qcow2", "vdi_vmdk", "ova", "ovf", "none":
+		default:
+			errs = append(errs, fmt.Errorf("format must be one of 'xva', 'xva_compressed', 'vdi_raw', 'vdi_vhd', 'vdi_qcow2', 'vdi_vmdk', 'ova', 'ovf', 'none', not '%s'", format))
+		}
+		if seen[format] {
+			errs = append(errs, fmt.Errorf("format '%s' is given more than once", format))
+		}
+		seen[format] = true
+	}
+
+	if seen["none"] && len(c.Formats) > 1 {
+		errs = append(errs, errors.New("format 'none' cannot be given with other formats"))
+	}
+	if seen["xva"] && seen["xva_compressed"] {
+		errs = append(errs, errors.New("formats 'xva' and 'xva_compressed' both export to the same file"))
+	}
+	if seen["ovf"] && seen["vdi_"+c.OVFDiskFormat] {
+		errs = append(errs, fmt.Errorf("formats 'ovf' and 'vdi_%s' both export the disks to the same files", c.OVFDiskFormat))
+	}
+	return errs
 }
 
 func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig) []error {
@@ -133,7 +279,6 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		c.Comm.SSHPort = 22
 	}
 
-
 	if c.OutputDir == "" {
 		c.OutputDir = fmt.Sprintf("output-%s", pc.PackerBuildName)
 	}
@@ -142,30 +287,102 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		c.VMName = fmt.Sprintf("packer-%s-{{timestamp}}", pc.PackerBuildName)
 	}
 
-	if c.Format == "" {
+	if c.Format == "" && len(c.Formats) == 0 {
 		c.Format = "xva"
 	}
 
+	if c.ExportParallelism == 0 {
+		c.ExportParallelism = 1
+	}
+
+	if c.OVFDiskFormat == "" {
+		c.OVFDiskFormat = "vmdk"
+	}
+
 	if c.KeepVM == "" {
 		c.KeepVM = "never"
 	}
 
+	if c.APIProtocol == "" {
+		c.APIProtocol = ProtocolXMLRPC
+	}
+
 	if c.IPGetter == "" {
 		c.IPGetter = "auto"
 	}
 
 	// Validation
 
-	if c.Username == "" {
-		errs = append(errs, errors.New("remote_username must be specified."))
+	if err := c.resolveCredentials(); err != nil {
+		errs = append(errs, err)
 	}
 
-	if c.Password == "" {
-		errs = append(errs, errors.New("remote_password must be specified."))
+	// An existing session needs neither
+	if c.SessionID == "" {
+		if c.Username == "" {
+			errs = append(errs, errors.New("remote_username must be specified."))
+		}
+
+		if c.Password == "" {
+			errs = append(errs, errors.New("remote_password must be specified."))
+		}
+	} else if err := c.hostSSHCredentials(); err != nil {
+		// The boot command and the communicator's port forward both SSH to
+		// the host, which a session cannot do
+		if c.Comm.Type != "none" {
+			errs = append(errs, fmt.Errorf("remote_session_id without a password needs communicator = \"none\": %s", err))
+		}
+		if len(c.BootCommand) > 0 {
+			errs = append(errs, fmt.Errorf("remote_session_id without a password cannot type a boot_command: %s", err))
+		}
 	}
 
-	if c.HostIp == "" {
-		errs = append(errs, errors.New("remote_host must be specified."))
+	if c.HostIp == "" && len(c.HostIps) == 0 {
+		errs = append(errs, errors.New("remote_host or remote_hosts must be specified."))
+	}
+
+	// remote_host, if given, is always the first host tried
+	if c.HostIp != "" {
+		hosts := []string{c.HostIp}
+		for _, host := range c.HostIps {
+			if host != c.HostIp {
+				hosts = append(hosts, host)
+			}
+		}
+		c.HostIps = hosts
+	}
+	if c.HostIp == "" && len(c.HostIps) > 0 {
+		c.HostIp = c.HostIps[0]
+	}
+
+	if _, err := c.TLSConfig(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.APIProtocol {
+	case ProtocolXMLRPC, ProtocolJSONRPC:
+	default:
+		errs = append(errs, errors.New("remote_api_protocol must be one of 'xmlrpc', 'jsonrpc'"))
+	}
+
+	for i, disk := range c.ExistingDisks {
+		if disk.VDI == "" {
+			errs = append(errs, fmt.Errorf("existing_disks[%d]: vdi must be specified", i))
+		}
+	}
+
+	userdevices := make(map[string]int)
+	for i := range c.Disks {
+		errs = append(errs, c.Disks[i].prepare(i)...)
+
+		userdevice := c.Disks[i].Userdevice
+		if userdevice == "" || userdevice == "autodetect" {
+			continue
+		}
+		if j, ok := userdevices[userdevice]; ok {
+			errs = append(errs, fmt.Errorf("disks[%d]: userdevice %s is already used by disks[%d]", i, userdevice, j))
+		}
+		userdevices[userdevice] = i
 	}
 
 	if c.HostPortMin > c.HostPortMax {
@@ -205,11 +422,19 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		errs = append(errs, errors.New("An ssh_username must be specified."))
 	}
 
-	switch c.Format {
-	case "xva", "xva_compressed", "vdi_raw", "vdi_vhd", "none":
+	switch c.OVFDiskFormat {
+	case "vmdk", "vhd":
 	default:
-		errs = append(errs, errors.New("format must be one of 'xva', 'vdi_raw', 'vdi_vhd', 'none'"))
+		errs = append(errs, errors.New("ovf_disk_format must be one of 'vmdk', 'vhd'"))
+	}
+
+	if c.Format != "" && len(c.Formats) > 0 {
+		errs = append(errs, errors.New("Only one of format or formats can be specified"))
+	}
+	if len(c.Formats) == 0 {
+		c.Formats = []string{c.Format}
 	}
+	errs = append(errs, c.prepareFormats()...)
 
 	switch c.KeepVM {
 	case "always", "never", "on_success":
@@ -243,81 +468,22 @@ func (c CommonConfig) ShouldKeepVM(state multistep.StateBag) bool {
 	}
 }
 
-func (config CommonConfig) GetSR(c *Connection) (xenapi.SRRef, error) {
-	if config.SrName == "" {
-		return getDefaultSR(c)
-	} else {
-		var srRef xenapi.SRRef
-
-		// Use the provided name label to find the SR to use
-		srs, err := c.GetClient().SR.GetByNameLabel(c.session, config.SrName)
-
-		if err != nil {
-			return srRef, err
-		}
-
-		switch {
-		case len(srs) == 0:
-			return srRef, fmt.Errorf("Couldn't find a SR with the specified name-label '%s'", config.SrName)
-		case len(srs) > 1:
-			return srRef, fmt.Errorf("Found more than one SR with the name '%s'. The name must be unique", config.SrName)
-		}
-
-		return srs[0], nil
-	}
+// GetSR returns the SR given by sr_name, or the default SR of the pool.
+func (config CommonConfig) GetSR(ctx context.Context, c SRClient) (xenapi.SRRef, error) {
+	return findSR(ctx, c, config.SrName)
 }
 
-func (config CommonConfig) GetISOSR(c *Connection) (xenapi.SRRef, error) {
-	var srRef xenapi.SRRef
-	if config.SrISOName == "" {
-		return getDefaultSR(c)
-
-	} else {
-		// Use the provided name label to find the SR to use
-		srs, err := c.GetClient().SR.GetByNameLabel(c.session, config.SrISOName)
-
-		if err != nil {
-			return srRef, err
-		}
-
-		switch {
-		case len(srs) == 0:
-			return srRef, fmt.Errorf("Couldn't find a SR with the specified name-label '%s'", config.SrISOName)
-		case len(srs) > 1:
-			return srRef, fmt.Errorf("Found more than one SR with the name '%s'. The name must be unique", config.SrISOName)
-		}
-
-		return srs[0], nil
-	}
+// GetISOSR returns the SR given by sr_iso_name, or the default SR of the
+// pool.
+func (config CommonConfig) GetISOSR(ctx context.Context, c SRClient) (xenapi.SRRef, error) {
+	return findSR(ctx, c, config.SrISOName)
 }
 
-func getDefaultSR(c *Connection) (xenapi.SRRef, error) {
-	var srRef xenapi.SRRef
-	client := c.GetClient()
-	hostRef, err := client.Session.GetThisHost(c.session, c.session)
-
-	if err != nil {
-		return srRef, err
-	}
-
-	// The current version of the go-xen-api-client does not fully support XenAPI version 8.2
-	// In particular, some values for the pool `allowed_operations` are not recognised, resulting
-	// in a parse error when retrieving pool records. As a workaround, we only fetch pool refs.
-	pool_refs, err := client.Pool.GetAll(c.session)
-
-	if err != nil {
-		return srRef, err
-	}
-
-	for _, pool_ref := range pool_refs {
-		pool_master, err := client.Pool.GetMaster(c.session, pool_ref)
-		if err != nil {
-			return srRef, err
-		}
-		if pool_master == hostRef {
-			return client.Pool.GetDefaultSR(c.session, pool_ref)
-		}
+// GetDiskSR returns the SR to create disk on: its own sr_name if it has
+// one, else the one the VM uses.
+func (config CommonConfig) GetDiskSR(ctx context.Context, c SRClient, disk DiskConfig) (xenapi.SRRef, error) {
+	if disk.SRName != "" {
+		return findSR(ctx, c, disk.SRName)
 	}
-
-	return srRef, errors.New(fmt.Sprintf("failed to find default SR on host '%s'", hostRef))
+	return config.GetSR(ctx, c)
 }
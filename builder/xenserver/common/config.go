@@ -1,4 +1,4 @@
-//go:generate packer-sdc mapstructure-to-hcl2 -type Config,DiskConfig
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config,DiskConfig,ExistingDiskConfig
 package common
 
 import (
@@ -16,6 +16,7 @@ type Config struct {
 	VCPUsAtStartup uint              `mapstructure:"vcpus_atstartup"`
 	VMMemory       uint              `mapstructure:"vm_memory"`
 	CloneTemplate  string            `mapstructure:"clone_template"`
+	FullCopy       bool              `mapstructure:"full_copy"`
 	VMOtherConfig  map[string]string `mapstructure:"vm_other_config"`
 
 	ISOChecksum string   `mapstructure:"iso_checksum"`
@@ -23,6 +24,15 @@ type Config struct {
 	ISOUrl      string   `mapstructure:"iso_url"`
 	ISOName     string   `mapstructure:"iso_name"`
 
+	ImageChecksum string   `mapstructure:"image_checksum"`
+	ImageUrls     []string `mapstructure:"image_urls"`
+	ImageUrl      string   `mapstructure:"image_url"`
+	ImageFormat   string   `mapstructure:"image_format"`
+
+	CloudInitUserData      string `mapstructure:"cloud_init_user_data"`
+	CloudInitMetaData      string `mapstructure:"cloud_init_meta_data"`
+	CloudInitNetworkConfig string `mapstructure:"cloud_init_network_config"`
+
 	PlatformArgs map[string]string `mapstructure:"platform_args"`
 
 	RawInstallTimeout string        `mapstructure:"install_timeout"`
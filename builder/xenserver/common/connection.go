@@ -0,0 +1,476 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	xenapi "github.com/terra-farm/go-xen-api-client"
+)
+
+const (
+	// Number of times a call is retried after a transient failure before
+	// the error is handed back to the caller.
+	connectionMaxRetries = 10
+
+	connectionInitialBackoff = 1 * time.Second
+	connectionMaxBackoff     = 30 * time.Second
+
+	// Upper bound on HOST_IS_SLAVE redirects followed during a single login,
+	// so that a pool in the middle of a master election cannot loop forever.
+	connectionMaxRedirects = 3
+)
+
+// Connection is the handle every step uses to talk to XAPI. It owns the
+// session and transparently re-establishes it when it expires or when
+// xapi is restarted underneath a long running build.
+//
+// If the configured host turns out to be a pool member rather than the
+// master, the connection follows the redirect and keeps talking to the
+// master from then on; GetHost always returns the address in use.
+//
+// The hosts the connection was created with are kept around so that, should
+// the master become unreachable mid-build, the connection can find its way
+// to whichever member has taken over.
+//
+// Calls are made over XML-RPC unless the connection was created for
+// JSON-RPC; either way the values are decoded by the Client methods rather
+// than by go-xen-api-client, so records with fields or enum values newer
+// than that library can still be read.
+type Connection struct {
+	Credentials
+
+	hosts    []string
+	protocol string
+
+	// transport carries the TLS settings and is shared by the XAPI client
+	// and every HTTP request made to the pool.
+	transport *http.Transport
+
+	// loginMu serialises everything that replaces the session, so that
+	// concurrent callers noticing the same failure only log in once.
+	loginMu sync.Mutex
+
+	mu      sync.RWMutex
+	host    string
+	rpc     caller
+	session xenapi.SessionRef
+}
+
+// Credentials are what a Connection authenticates with. A SessionID, the
+// opaque reference of a session created elsewhere, is used as is and never
+// logged out; should it expire, the connection logs in with the username
+// and password instead, if it has them.
+type Credentials struct {
+	Username  string
+	Password  string
+	SessionID string
+}
+
+// NewXenAPIClient logs in to the first of hosts that answers, speaking
+// protocol, one of ProtocolXMLRPC and ProtocolJSONRPC. The hosts should all
+// be members of the same pool.
+func NewXenAPIClient(ctx context.Context, hosts []string, credentials Credentials, protocol string, transport *http.Transport) (*Connection, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("no XenServer host to connect to")
+	}
+	if _, err := newCaller(protocol, hosts[0], transport); err != nil {
+		return nil, err
+	}
+
+	c := &Connection{
+		Credentials: credentials,
+		hosts:       hosts,
+		protocol:    protocol,
+		transport:   transport,
+		host:        hosts[0],
+	}
+
+	err := retry(ctx, "login", isTransient, c.loginAny)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Call invokes the XAPI method, such as "VM.get_uuid", with the current
+// session followed by params, and returns the value as decoded from the
+// wire. Steps should prefer the typed Client methods, which are built on it.
+//
+// If XAPI reports that the session is no longer valid, a new session is
+// created and the call is made again. Transport errors are retried with an
+// exponential backoff until either the call succeeds, the retries are
+// exhausted or ctx is done. Only methods that read the state of the pool are
+// retried whatever the transport error; any other call is made again only
+// if it provably never reached xapi, see isUnsent.
+func (c *Connection) Call(ctx context.Context, method string, params ...interface{}) (interface{}, error) {
+	return c.call(ctx, false, method, params)
+}
+
+// CallConcurrently is like Call, but makes the call with a client of its
+// own. The shared XML-RPC client sends one request at a time and may not be
+// used from several goroutines, so this is meant for calls that block on
+// the pool, such as event.from, or that run alongside the steps of the
+// build.
+func (c *Connection) CallConcurrently(ctx context.Context, method string, params ...interface{}) (interface{}, error) {
+	return c.call(ctx, true, method, params)
+}
+
+func (c *Connection) call(ctx context.Context, fresh bool, method string, params []interface{}) (value interface{}, err error) {
+	attempt := func() (xenapi.SessionRef, error) {
+		rpc, session := c.current()
+		if fresh {
+			var err error
+			if rpc, err = newCaller(c.protocol, c.GetHost(), c.transport); err != nil {
+				return session, err
+			}
+		}
+		var err error
+		value, err = rpc.call(method, append([]interface{}{session}, params...))
+		return session, err
+	}
+
+	// A call that changes the pool may well have been run even though its
+	// answer was lost, and making it again could, say, create a second VM
+	// that no cleanup knows about.
+	retryable := isTransient
+	if !isReadOnly(method) {
+		retryable = isUnsent
+	}
+
+	err = retry(ctx, "call", retryable, func() error {
+		session, err := attempt()
+		switch {
+		case err == nil:
+			return nil
+		case isSessionInvalid(err), isHostIsSlave(err):
+			log.Printf("XAPI session is no longer valid, logging in again: %s", err.Error())
+			if loginErr := c.relogin(session); loginErr != nil {
+				return loginErr
+			}
+			// The original call never went through, so go again straight away
+			_, err = attempt()
+		case isTransient(err):
+			c.failover(session)
+		}
+		return err
+	})
+	return
+}
+
+// Logout terminates the XAPI session. It is meant to be called once the
+// build, including every step cleanup, has finished. A session that was
+// handed in through Credentials.SessionID belongs to whoever created it and
+// is left alone.
+func (c *Connection) Logout() error {
+	rpc, session := c.current()
+	if session == "" || string(session) == c.SessionID {
+		return nil
+	}
+
+	_, err := rpc.call("session.logout", []interface{}{session})
+
+	c.mu.Lock()
+	c.session = ""
+	c.mu.Unlock()
+
+	return err
+}
+
+// GetHost returns the address of the pool master the connection is
+// currently talking to. It is the address to use for the HTTP handlers.
+func (c *Connection) GetHost() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.host
+}
+
+// GetSession returns the opaque reference of the current session, as used
+// for the session_id parameter of the HTTP handlers.
+func (c *Connection) GetSession() string {
+	_, session := c.current()
+	return string(session)
+}
+
+// HTTPClient returns a client for the XAPI HTTP handlers, such as the
+// import and export ones, using the same TLS settings as the API calls.
+func (c *Connection) HTTPClient() *http.Client {
+	return &http.Client{Transport: c.transport}
+}
+
+// TLSConfig returns the TLS settings to use for a raw connection to
+// serverName, as needed for the console tunnel.
+func (c *Connection) TLSConfig(serverName string) *tls.Config {
+	config := c.transport.TLSClientConfig.Clone()
+	config.ServerName = serverName
+	return config
+}
+
+func (c *Connection) current() (caller, xenapi.SessionRef) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rpc, c.session
+}
+
+func (c *Connection) reconnect() error {
+	return c.connect(c.GetHost())
+}
+
+func (c *Connection) connect(host string) error {
+	rpc, err := newCaller(c.protocol, host, c.transport)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.host = host
+	c.rpc = rpc
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *Connection) login() error {
+	for redirects := 0; ; redirects++ {
+		rpc, _ := c.current()
+
+		session, err := c.authenticate(rpc)
+		if master, ok := masterAddress(err); ok && redirects < connectionMaxRedirects {
+			log.Printf("Host '%s' is not the pool master, connecting to '%s' instead", c.GetHost(), master)
+			if err := c.connect(master); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		AddSecrets(string(session))
+
+		c.mu.Lock()
+		c.session = session
+		c.mu.Unlock()
+
+		return nil
+	}
+}
+
+// authenticate returns the session to use on rpc: the one given in the
+// credentials if it is still valid, else a new one from the username and
+// password.
+func (c *Connection) authenticate(rpc caller) (xenapi.SessionRef, error) {
+	if c.SessionID != "" {
+		session := xenapi.SessionRef(c.SessionID)
+		_, err := rpc.call("session.get_uuid", []interface{}{session, session})
+		if err == nil || !isSessionInvalid(err) || c.Password == "" {
+			return session, err
+		}
+		log.Printf("The given XAPI session is no longer valid, logging in with the password instead")
+		c.SessionID = ""
+	}
+	return decodeRef[xenapi.SessionRef](rpc.call("session.login_with_password", []interface{}{c.Username, c.Password, "1.0", "packer"}))
+}
+
+// loginAny logs in to each candidate host in turn until one succeeds. Only
+// transport errors move on to the next host; anything else, such as bad
+// credentials, would fail the same way everywhere in the pool.
+func (c *Connection) loginAny() (err error) {
+	for _, host := range c.candidates() {
+		if err = c.connect(host); err != nil {
+			return err
+		}
+		if err = c.login(); err == nil || !isTransient(err) {
+			return err
+		}
+		log.Printf("Unable to log in to XAPI on '%s': %s", host, err.Error())
+	}
+	return err
+}
+
+// candidates returns the hosts to try when looking for the pool master: the
+// one currently in use first, then the configured ones in order.
+func (c *Connection) candidates() []string {
+	hosts := []string{c.GetHost()}
+	for _, host := range c.hosts {
+		if host != hosts[0] {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// relogin replaces the session unless another caller already did so since
+// stale was handed out.
+func (c *Connection) relogin(stale xenapi.SessionRef) error {
+	c.loginMu.Lock()
+	defer c.loginMu.Unlock()
+
+	if _, session := c.current(); session != stale {
+		return nil
+	}
+	return c.login()
+}
+
+// failover is run after a transport error. If the current master still
+// accepts the session only the client is recreated, as net/rpc permanently
+// shuts one down after a failed read. Otherwise the candidate hosts are
+// tried in turn, following HOST_IS_SLAVE redirects, so that the connection
+// ends up on whichever member is now the master. Failures are only logged:
+// the caller's retry loop will come back here on its next attempt.
+func (c *Connection) failover(stale xenapi.SessionRef) {
+	c.loginMu.Lock()
+	defer c.loginMu.Unlock()
+
+	if _, session := c.current(); session != stale {
+		return
+	}
+
+	if err := c.reconnect(); err == nil {
+		rpc, _ := c.current()
+		if _, err := rpc.call("session.get_uuid", []interface{}{stale, stale}); err == nil {
+			return
+		}
+	}
+
+	log.Printf("Lost contact with the pool master '%s', looking for the current master", c.GetHost())
+	if err := c.loginAny(); err != nil {
+		log.Printf("Unable to reach the pool master: %s", err.Error())
+		return
+	}
+	log.Printf("Reconnected to the pool master '%s'", c.GetHost())
+}
+
+// retry runs fn until it succeeds or fails with an error that retryable
+// rejects, backing off exponentially between attempts.
+func retry(ctx context.Context, what string, retryable func(error) bool, fn func() error) error {
+	backoff := connectionInitialBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err) || attempt >= connectionMaxRetries {
+			return err
+		}
+
+		log.Printf("XAPI %s failed (attempt %d/%d), retrying in %s: %s",
+			what, attempt+1, connectionMaxRetries, backoff, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > connectionMaxBackoff {
+			backoff = connectionMaxBackoff
+		}
+	}
+}
+
+func xapiErrorCode(err error) string {
+	var xapiErr *APIError
+	if errors.As(err, &xapiErr) {
+		return xapiErr.Code
+	}
+	return ""
+}
+
+func isSessionInvalid(err error) bool {
+	return xapiErrorCode(err) == xenapi.ERR_SESSION_INVALID
+}
+
+func isHostIsSlave(err error) bool {
+	return xapiErrorCode(err) == xenapi.ERR_HOST_IS_SLAVE
+}
+
+// masterAddress extracts the address of the pool master from a
+// HOST_IS_SLAVE error, which XAPI reports as the first error parameter.
+func masterAddress(err error) (string, bool) {
+	var xapiErr *APIError
+	if !errors.As(err, &xapiErr) || xapiErr.Code != xenapi.ERR_HOST_IS_SLAVE || len(xapiErr.Params) == 0 || xapiErr.Params[0] == "" {
+		return "", false
+	}
+	return xapiErr.Params[0], true
+}
+
+// isTransient reports whether err is worth retrying: the request either
+// never reached xapi or xapi went away before answering.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch xapiErrorCode(err) {
+	case "":
+	case "HOST_STILL_BOOTING", "TOO_BUSY":
+		return true
+	default:
+		return false
+	}
+
+	if isTLSVerificationError(err) {
+		return false
+	}
+
+	if errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isUnsent reports whether err shows that a call was never run by xapi:
+// either the connection to it could not be set up, or xapi turned the call
+// away before running it. Such a call is safe to make again, whatever it
+// does.
+func isUnsent(err error) bool {
+	switch xapiErrorCode(err) {
+	case "":
+	case "HOST_STILL_BOOTING", "TOO_BUSY":
+		return true
+	default:
+		return false
+	}
+
+	if isTLSVerificationError(err) {
+		return false
+	}
+
+	// net/rpc refuses to send anything on a client it has shut down
+	if errors.Is(err, rpc.ErrShutdown) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect") {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	return errors.As(err, &dnsErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr)
+}
+
+// isReadOnly reports whether method, such as "VM.get_power_state", only
+// reads the state of the pool, so that making it twice does no harm.
+func isReadOnly(method string) bool {
+	_, name, _ := strings.Cut(method, ".")
+	return strings.HasPrefix(name, "get_") || method == "event.from"
+}
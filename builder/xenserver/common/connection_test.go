@@ -0,0 +1,60 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/xapitest"
+)
+
+func testConnection(t *testing.T, server *xapitest.Server) *Connection {
+	transport, err := CommonConfig{TLSFingerprint: server.Fingerprint()}.Transport()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	credentials := Credentials{Username: server.Username, Password: server.Password}
+	c, err := NewXenAPIClient(context.Background(), []string{server.Host()}, credentials, ProtocolXMLRPC, transport)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	return c
+}
+
+func TestConnectionCall_LostResponse(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	// Both methods run, but the response is lost the first time round
+	for _, method := range []string{"VM.get_all", "VM.clone"} {
+		server.Handle(method, func(params []interface{}) (interface{}, error) {
+			value, err := server.Invoke(method, params)
+			if server.Calls(method) == 1 {
+				return nil, xapitest.ErrLostResponse
+			}
+			return value, err
+		})
+	}
+
+	c := testConnection(t, server)
+	ctx := context.Background()
+
+	if _, err := c.Call(ctx, "VM.get_all"); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if n := server.Calls("VM.get_all"); n != 2 {
+		t.Errorf("a read should have been retried, got %d calls", n)
+	}
+
+	template := server.Find("VM", xapitest.DefaultTemplate)[0]
+	if _, err := c.Call(ctx, "VM.clone", template, "foo"); err == nil {
+		t.Fatal("should have error")
+	}
+	if n := server.Calls("VM.clone"); n != 1 {
+		t.Errorf("a clone that may have gone through should not have been retried, got %d calls", n)
+	}
+	if n := len(server.Find("VM", "foo")); n != 1 {
+		t.Errorf("bad: expected one clone, got %d", n)
+	}
+}
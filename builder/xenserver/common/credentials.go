@@ -0,0 +1,80 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables consulted for the XAPI credentials when they are
+// not part of the template. They are also the keys of remote_credentials_file.
+const (
+	EnvUsername = "XAPI_USERNAME"
+	EnvPassword = "XAPI_PASSWORD"
+)
+
+// Credentials returns what the connection to the pool authenticates with.
+func (c CommonConfig) Credentials() Credentials {
+	return Credentials{
+		Username:  c.Username,
+		Password:  c.Password,
+		SessionID: c.SessionID,
+	}
+}
+
+// resolveCredentials fills in the username and password the template left
+// out, first from remote_credentials_file and then from the environment.
+func (c *CommonConfig) resolveCredentials() error {
+	if c.CredentialsFile != "" {
+		values, err := readCredentialsFile(c.CredentialsFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read remote_credentials_file: %s", err.Error())
+		}
+		if c.Username == "" {
+			c.Username = values[EnvUsername]
+		}
+		if c.Password == "" {
+			c.Password = values[EnvPassword]
+		}
+	}
+
+	if c.Username == "" {
+		c.Username = os.Getenv(EnvUsername)
+	}
+	if c.Password == "" {
+		c.Password = os.Getenv(EnvPassword)
+	}
+	return nil
+}
+
+// readCredentialsFile parses a file of KEY=value lines, in the format of an
+// environment file. Blank lines and lines starting with '#' are skipped and
+// values may be quoted.
+func readCredentialsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, line)
+		}
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,351 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskformat"
+)
+
+const (
+	// downloadAttempts is how many times a download is tried before giving
+	// up.
+	downloadAttempts = 5
+
+	// downloadBufferSize is the size of the reads from the network.
+	downloadBufferSize = 1024 * 1024
+
+	// checksumSuffix is appended to the name of a downloaded file for the
+	// file that records its SHA-256.
+	checksumSuffix = ".sha256"
+)
+
+// downloadBackoff is how long to wait before retrying a failed download,
+// doubled after each attempt.
+var downloadBackoff = 5 * time.Second
+
+// httpStatusError is an unexpected HTTP status of a download.
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("GET request got unexpected status code: %s", e.status)
+}
+
+// errCannotRestart is the error of a download that the server started over
+// rather than resuming, which disks being converted cannot be.
+var errCannotRestart = errors.New("server started the download over, which disks being converted cannot be")
+
+// writeError is an error writing what was downloaded, which retrying the
+// download doesn't help with.
+type writeError struct {
+	err error
+}
+
+func (e writeError) Error() string {
+	return e.err.Error()
+}
+
+func (e writeError) Unwrap() error {
+	return e.err
+}
+
+// download is a file being downloaded: how much of it has been written,
+// the SHA-256 of that, and how large it is expected to be.
+//
+// If converter is set, what is downloaded is a raw disk that the converter
+// writes to the file as an image of another format instead.
+type download struct {
+	fh        *os.File
+	converter io.WriteCloser
+	written   int64
+	hash      hash.Hash
+	expected  int64
+	progress  *downloadProgress
+}
+
+func (d *download) Write(b []byte) (int, error) {
+	var out io.Writer = io.MultiWriter(d.fh, d.hash)
+	if d.converter != nil {
+		out = d.converter
+	}
+	n, err := out.Write(b)
+	d.written += int64(n)
+	d.progress.add(int64(n))
+	if err != nil {
+		return n, writeError{err}
+	}
+	return n, nil
+}
+
+// resume gets the file ready to carry on writing at d.written, dropping
+// anything a failed write may have left past it. A converter carries on
+// where it stopped by itself.
+func (d *download) resume() error {
+	if d.converter != nil {
+		return nil
+	}
+	if _, err := d.fh.Seek(d.written, io.SeekStart); err != nil {
+		return err
+	}
+	return d.fh.Truncate(d.written)
+}
+
+// restart throws away what has been downloaded so far.
+func (d *download) restart() error {
+	if d.converter != nil {
+		return errCannotRestart
+	}
+	d.progress.add(-d.written)
+	d.written = 0
+	d.hash.Reset()
+	return d.resume()
+}
+
+// downloadFile downloads url to filename, retrying with backoff when the
+// download fails. It downloads to a partial file, renamed to filename once
+// complete, so that filename is never left incomplete.
+//
+// Retries ask for the rest of the file with a Range header, which
+// export_raw_vdi honours. A server that sends the whole file again instead,
+// as export does, gets the download started over.
+//
+// The SHA-256 of the file is computed as it is written and recorded next to
+// it, see writeChecksum.
+//
+// The download counts towards progress, which downloads running together
+// share, with estimate as its size until the server gives it.
+func downloadFile(ctx context.Context, client *http.Client, url, filename string, estimate int64, progress *downloadProgress) error {
+	return fetch(ctx, client, url, filename, "", estimate, progress)
+}
+
+// downloadDisk downloads the raw disk of size bytes at url, converting it to
+// an image of the given format at filename as it arrives. It is otherwise
+// the same as downloadFile, except that a server that doesn't resume
+// downloads fails it.
+func downloadDisk(ctx context.Context, client *http.Client, url, filename string, format diskformat.Format, size int64, progress *downloadProgress) error {
+	return fetch(ctx, client, url, filename, format, size, progress)
+}
+
+// fetch downloads url to filename, converting it to format unless it is
+// empty.
+func fetch(ctx context.Context, client *http.Client, url, filename string, format diskformat.Format, estimate int64, progress *downloadProgress) (err error) {
+	partial := filename + ".part"
+	fh, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		fh.Close()
+		if err != nil {
+			os.Remove(partial)
+		}
+	}()
+
+	d := &download{fh: fh, hash: sha256.New(), expected: estimate, progress: progress}
+	if format != "" {
+		d.converter, err = diskformat.NewWriter(fh, format, estimate, filepath.Base(filename))
+		if err != nil {
+			return err
+		}
+	}
+	progress.expect(estimate)
+	backoff := downloadBackoff
+	for attempt := 1; ; attempt++ {
+		err = d.get(ctx, client, url)
+		if err == nil {
+			break
+		}
+
+		var statusErr httpStatusError
+		if errors.As(err, &statusErr) && statusErr.code < 500 {
+			// The request itself is wrong, no point in trying it again
+			return err
+		}
+		if errors.As(err, new(writeError)) || errors.Is(err, errCannotRestart) {
+			return err
+		}
+		if ctx.Err() != nil || attempt == downloadAttempts {
+			return err
+		}
+
+		progress.ui.Message(fmt.Sprintf("Download of '%s' failed after %s: %s. Retrying in %s...",
+			filepath.Base(filename), formatBytes(d.written), err.Error(), backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+
+	if d.converter != nil {
+		if err = d.converter.Close(); err != nil {
+			return fmt.Errorf("Unable to write %s image: %s", format, err.Error())
+		}
+	}
+	if err = fh.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(partial, filename); err != nil {
+		return err
+	}
+	if d.converter != nil {
+		return checksumFile(filename)
+	}
+	return writeChecksum(filename, d.hash.Sum(nil))
+}
+
+// get downloads url, or the rest of it if part of it was downloaded
+// already.
+func (d *download) get(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if d.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.written))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && d.written > 0:
+		if start := rangeStart(resp.Header.Get("Content-Range")); start != d.written {
+			return fmt.Errorf("server resumed the download at %d rather than %d", start, d.written)
+		}
+		log.Printf("Resuming download at %d bytes", d.written)
+		if err := d.resume(); err != nil {
+			return err
+		}
+	case resp.StatusCode == http.StatusOK:
+		if d.written > 0 {
+			log.Printf("Server doesn't support resuming downloads, starting over")
+			if err := d.restart(); err != nil {
+				return err
+			}
+		}
+	default:
+		return httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	// Servers streaming what they export may not give a length
+	if resp.ContentLength >= 0 {
+		length := d.written + resp.ContentLength
+		d.progress.expect(length - d.expected)
+		d.expected = length
+	}
+
+	_, err = io.CopyBuffer(d, resp.Body, make([]byte, downloadBufferSize))
+	return err
+}
+
+// rangeStart returns the first byte of a Content-Range such as
+// "bytes 100-199/200", or -1.
+func rangeStart(contentRange string) int64 {
+	r, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return -1
+	}
+	start, _, _ := strings.Cut(r, "-")
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// downloadProgress reports the progress of one or more downloads every 5%.
+type downloadProgress struct {
+	ui packer.Ui
+
+	mu         sync.Mutex
+	total      int64
+	written    int64
+	percentage int64
+}
+
+const progressMarker = 5
+
+func newDownloadProgress(ui packer.Ui) *downloadProgress {
+	return &downloadProgress{ui: ui}
+}
+
+// expect adds n bytes to the total expected.
+func (p *downloadProgress) expect(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total += n
+}
+
+// add counts n more bytes downloaded, or n fewer if negative.
+func (p *downloadProgress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.written += n
+	if p.total <= 0 {
+		return
+	}
+	percentage := min(p.written*100/p.total, 100) / progressMarker * progressMarker
+	if percentage > p.percentage {
+		p.percentage = percentage
+		p.ui.Message(fmt.Sprintf("Downloading... %d%%", percentage))
+	}
+}
+
+// writeChecksum records the SHA-256 of filename in filename.sha256, in the
+// format of sha256sum so that `sha256sum -c` checks it.
+func writeChecksum(filename string, sum []byte) error {
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum), filepath.Base(filename))
+	return os.WriteFile(filename+checksumSuffix, []byte(line), 0644)
+}
+
+// readChecksum returns the SHA-256 of filename recorded by writeChecksum, as
+// hex.
+func readChecksum(filename string) (string, error) {
+	line, err := os.ReadFile(filename + checksumSuffix)
+	if err != nil {
+		return "", err
+	}
+	sum, _, ok := strings.Cut(string(line), " ")
+	if !ok {
+		return "", fmt.Errorf("bad checksum file for '%s'", filepath.Base(filename))
+	}
+	return sum, nil
+}
+
+// checksumFile computes the SHA-256 of filename and records it as
+// writeChecksum does, for files that weren't downloaded by downloadFile.
+func checksumFile(filename string) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, fh, make([]byte, downloadBufferSize)); err != nil {
+		return err
+	}
+	return writeChecksum(filename, h.Sum(nil))
+}
@@ -0,0 +1,246 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskformat"
+)
+
+// flakyServer serves content, breaking off the first failures responses
+// after sending half of what was asked for. It honours Range headers if
+// ranges is set.
+type flakyServer struct {
+	content  []byte
+	ranges   bool
+	failures int
+
+	mu     sync.Mutex
+	served int
+	ranged int
+}
+
+func (f *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	fail := f.failures > 0
+	f.failures--
+	f.mu.Unlock()
+
+	if !f.ranges {
+		r.Header.Del("Range")
+	} else if r.Header.Get("Range") != "" {
+		f.mu.Lock()
+		f.ranged++
+		f.mu.Unlock()
+	}
+
+	var out http.ResponseWriter = &countingWriter{ResponseWriter: w, f: f, fail: fail}
+	http.ServeContent(out, r, "", time.Time{}, bytes.NewReader(f.content))
+}
+
+// countingWriter counts the bytes served, and aborts the connection half
+// way through if fail is set.
+type countingWriter struct {
+	http.ResponseWriter
+	f    *flakyServer
+	fail bool
+	left int
+	init bool
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if !w.init {
+		w.init = true
+		length, _ := strconv.Atoi(w.Header().Get("Content-Length"))
+		w.left = length / 2
+	}
+	if w.fail {
+		if len(b) > w.left {
+			b = b[:w.left]
+		}
+		w.left -= len(b)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.f.mu.Lock()
+	w.f.served += n
+	w.f.mu.Unlock()
+	if w.fail && w.left == 0 {
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	return n, err
+}
+
+func testDownload(t *testing.T, f *flakyServer) (string, error) {
+	backoff := downloadBackoff
+	downloadBackoff = time.Millisecond
+	t.Cleanup(func() { downloadBackoff = backoff })
+
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "disk.raw")
+	err := downloadFile(context.Background(), server.Client(), server.URL+"/export_raw_vdi", filename, 0, newDownloadProgress(packer.TestUi(t)))
+	return filename, err
+}
+
+func checkDownload(t *testing.T, filename string, content []byte) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("should have downloaded the file: %s", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("downloaded file differs from what was served")
+	}
+
+	sum := sha256.Sum256(content)
+	checksum, err := os.ReadFile(filename + ".sha256")
+	if err != nil {
+		t.Fatalf("should have recorded the checksum: %s", err)
+	}
+	if expected := hex.EncodeToString(sum[:]) + "  disk.raw\n"; string(checksum) != expected {
+		t.Errorf("bad checksum: %q, expected %q", checksum, expected)
+	}
+
+	if _, err := os.Stat(filename + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial file should have been renamed")
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	content := bytes.Repeat([]byte("disk"), 256*1024)
+	f := &flakyServer{content: content, ranges: true}
+	filename, err := testDownload(t, f)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	checkDownload(t, filename, content)
+}
+
+func TestDownloadFile_Resume(t *testing.T) {
+	content := bytes.Repeat([]byte("disk"), 256*1024)
+	f := &flakyServer{content: content, ranges: true, failures: 2}
+	filename, err := testDownload(t, f)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	checkDownload(t, filename, content)
+
+	if f.ranged != 2 {
+		t.Errorf("should have resumed twice, got %d range requests", f.ranged)
+	}
+	if f.served != len(content) {
+		t.Errorf("resumed downloads should not have been sent anything twice: %d bytes for %d", f.served, len(content))
+	}
+}
+
+func TestDownloadFile_StartOver(t *testing.T) {
+	content := bytes.Repeat([]byte("disk"), 256*1024)
+	f := &flakyServer{content: content, failures: 1}
+	filename, err := testDownload(t, f)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	checkDownload(t, filename, content)
+
+	if f.served != len(content)+len(content)/2 {
+		t.Errorf("should have started over, got %d bytes for %d", f.served, len(content))
+	}
+}
+
+func TestDownloadFile_GiveUp(t *testing.T) {
+	f := &flakyServer{content: []byte("disk"), ranges: true, failures: downloadAttempts}
+	filename, err := testDownload(t, f)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	for _, name := range []string{filename, filename + ".part", filename + ".sha256"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s should not have been left behind", name)
+		}
+	}
+}
+
+func TestDownloadFile_NotFound(t *testing.T) {
+	backoff := downloadBackoff
+	downloadBackoff = time.Hour
+	defer func() { downloadBackoff = backoff }()
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "disk.raw")
+	err := downloadFile(context.Background(), server.Client(), server.URL, filename, 0, newDownloadProgress(packer.TestUi(t)))
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("should have failed without retrying, got %v", err)
+	}
+}
+
+func TestDownloadDisk(t *testing.T) {
+	backoff := downloadBackoff
+	downloadBackoff = time.Millisecond
+	t.Cleanup(func() { downloadBackoff = backoff })
+
+	content := make([]byte, 1024*1024)
+	copy(content[4096:], bytes.Repeat([]byte("disk"), 64*1024))
+	f := &flakyServer{content: content, ranges: true, failures: 2}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "disk.qcow2")
+	err := downloadDisk(context.Background(), server.Client(), server.URL, filename, diskformat.QCOW2, int64(len(content)), newDownloadProgress(packer.TestUi(t)))
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if f.ranged != 2 {
+		t.Errorf("should have resumed twice, got %d range requests", f.ranged)
+	}
+
+	raw := filepath.Join(dir, "disk.raw")
+	if _, err := diskformat.ConvertToRaw(raw, filename, diskformat.QCOW2); err != nil {
+		t.Fatalf("should have written a qcow2 image: %s", err)
+	}
+	if data, err := os.ReadFile(raw); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("qcow2 image differs from what was served: %v", err)
+	}
+	if _, err := os.Stat(filename + ".sha256"); err != nil {
+		t.Errorf("should have recorded the checksum: %s", err)
+	}
+}
+
+func TestDownloadDisk_StartOver(t *testing.T) {
+	backoff := downloadBackoff
+	downloadBackoff = time.Millisecond
+	t.Cleanup(func() { downloadBackoff = backoff })
+
+	content := bytes.Repeat([]byte("disk"), 256*1024)
+	f := &flakyServer{content: content, failures: 1}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "disk.vmdk")
+	err := downloadDisk(context.Background(), server.Client(), server.URL, filename, diskformat.VMDK, int64(len(content)), newDownloadProgress(packer.TestUi(t)))
+	if err == nil || !strings.Contains(err.Error(), "started the download over") {
+		t.Fatalf("should have failed when the server started over, got %v", err)
+	}
+	// Each request takes one off failures
+	if requests := 1 - f.failures; requests != 2 {
+		t.Errorf("should have given up without retrying, got %d requests", requests)
+	}
+	if _, err := os.Stat(filename + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial file should not have been left behind")
+	}
+}
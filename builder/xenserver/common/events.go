@@ -0,0 +1,186 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	xenapi "github.com/terra-farm/go-xen-api-client"
+)
+
+// eventFromTimeout is how long a single event.from call may block on the
+// pool before returning with no events.
+const eventFromTimeout = 30 * time.Second
+
+// Event is a change to a XAPI object, as reported by event.from.
+type Event struct {
+	Class string
+	Ref   string
+
+	// Operation is "add", "mod" or "del"
+	Operation string
+
+	// Snapshot holds the fields of the object after the change, as they
+	// travel over XML-RPC. It is empty for "del" events.
+	Snapshot map[string]interface{}
+}
+
+// WatchEvents subscribes to changes to the given classes, e.g. "vm", or
+// "task/OpaqueRef:..." for a single object, and calls fn with each of them.
+// fn is first called with an "add" event for every existing object, so the
+// current state need not be fetched separately.
+//
+// WatchEvents returns once fn returns true or an error. If ctx is done
+// first, it returns TimeoutError if the deadline was exceeded and
+// InterruptedError otherwise.
+func (c *Connection) WatchEvents(ctx context.Context, classes []string, fn func(Event) (bool, error)) error {
+	token := ""
+	for {
+		var events []Event
+		var err error
+		done := make(chan struct{})
+		go func() {
+			// event.from cannot be interrupted, so the call is left to
+			// finish in the background if ctx is done first
+			defer close(done)
+			events, token, err = c.eventFrom(ctx, classes, token)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return waitError(ctx)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return waitError(ctx)
+			}
+			return err
+		}
+
+		for _, event := range events {
+			complete, err := fn(event)
+			if err != nil || complete {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Connection) eventFrom(ctx context.Context, classes []string, token string) ([]Event, string, error) {
+	result, err := c.CallConcurrently(ctx, "event.from", classes, token, eventFromTimeout.Seconds())
+	if err != nil {
+		return nil, token, fmt.Errorf("Unable to get events: %s", err.Error())
+	}
+
+	batch, ok := toStruct(result)
+	if !ok {
+		return nil, token, fmt.Errorf("Unexpected event.from result %v", result)
+	}
+	items, _ := batch["events"].([]interface{})
+	events := make([]Event, 0, len(items))
+	for _, item := range items {
+		fields, ok := toStruct(item)
+		if !ok {
+			return nil, token, fmt.Errorf("Unexpected event %v", item)
+		}
+		event := Event{
+			Class:     fmt.Sprint(fields["class"]),
+			Ref:       fmt.Sprint(fields["ref"]),
+			Operation: fmt.Sprint(fields["operation"]),
+		}
+		event.Snapshot, _ = toStruct(fields["snapshot"])
+		events = append(events, event)
+	}
+
+	next, ok := batch["token"].(string)
+	if !ok {
+		return nil, token, fmt.Errorf("Unexpected event.from token %v", batch["token"])
+	}
+	return events, next, nil
+}
+
+func (c *Connection) WaitForVMPowerState(ctx context.Context, vm xenapi.VMRef, powerState xenapi.VMPowerState) error {
+	return c.WatchEvents(ctx, []string{"vm/" + string(vm)}, func(event Event) (bool, error) {
+		if event.Operation == "del" {
+			return false, fmt.Errorf("VM '%s' was destroyed", vm)
+		}
+		return event.Snapshot["power_state"] == string(powerState), nil
+	})
+}
+
+func (c *Connection) WaitForTask(ctx context.Context, task xenapi.TaskRef, progress func(float64)) (xenapi.TaskStatusType, error) {
+	var status xenapi.TaskStatusType
+	err := c.WatchEvents(ctx, []string{"task/" + string(task)}, func(event Event) (bool, error) {
+		if event.Operation == "del" {
+			return false, fmt.Errorf("Task '%s' was destroyed", task)
+		}
+		status = xenapi.TaskStatusType(fmt.Sprint(event.Snapshot["status"]))
+		if status != xenapi.TaskStatusTypePending {
+			return true, nil
+		}
+		if value, ok := event.Snapshot["progress"].(float64); ok && progress != nil {
+			progress(value)
+		}
+		return false, nil
+	})
+	return status, err
+}
+
+// WatchGuestIP calls fn with the address the guest tools report for the
+// first network interface of the VM, at first and then whenever it
+// changes, until fn returns true or an error.
+func WatchGuestIP(ctx context.Context, c *Connection, vm xenapi.VMRef, fn func(ip string) (bool, error)) error {
+	// Only the VM and its own guest metrics are watched, so that the rest
+	// of the pool does not wake the build up. The guest metrics are only
+	// known once the guest tools have started, and the VM may be given new
+	// ones later on, so the subscription is made again whenever they change.
+	metrics := "OpaqueRef:NULL"
+	ip := ""
+	for {
+		classes := []string{"vm/" + string(vm)}
+		if metrics != "" && metrics != "OpaqueRef:NULL" {
+			classes = append(classes, "vm_guest_metrics/"+metrics)
+		}
+
+		resubscribe := false
+		err := c.WatchEvents(ctx, classes, func(event Event) (bool, error) {
+			switch {
+			case event.Class == "vm" && event.Operation == "del":
+				return false, fmt.Errorf("VM '%s' was destroyed", vm)
+
+			case event.Class == "vm":
+				ref := fmt.Sprint(event.Snapshot["guest_metrics"])
+				if ref == metrics {
+					return false, nil
+				}
+				metrics = ref
+				resubscribe = true
+				return true, nil
+
+			case event.Ref == metrics && event.Operation != "del":
+				networks, _ := toStruct(event.Snapshot["networks"])
+				value, _ := networks["0/ip"].(string)
+				if value == "" || value == ip {
+					return false, nil
+				}
+				ip = value
+				return fn(ip)
+			}
+			return false, nil
+		})
+		if err != nil || !resubscribe {
+			return err
+		}
+	}
+}
+
+// waitError turns the reason ctx is done into the errors returned by
+// InterruptibleWait.
+func waitError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return TimeoutError{}
+	}
+	return InterruptedError{}
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	xenapi "github.com/terra-farm/go-xen-api-client"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/xapitest"
+)
+
+func TestWatchGuestIP(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	session, err := server.Invoke("session.login_with_password", []interface{}{server.Username, server.Password, "1.0", "test"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	set := func(method, ref string, value interface{}) {
+		if _, err := server.Invoke(method, []interface{}{session, ref, value}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	vm := server.Create("VM", xapitest.Record{"name_label": "foo", "guest_metrics": "OpaqueRef:NULL"})
+	other := server.Create("VM_guest_metrics", xapitest.Record{"networks": map[string]interface{}{"0/ip": "192.0.2.20"}})
+
+	c := testConnection(t, server)
+	ips := make(chan string, 2)
+	done := make(chan error)
+	go func() {
+		done <- WatchGuestIP(context.Background(), c, xenapi.VMRef(vm), func(ip string) (bool, error) {
+			ips <- ip
+			return ip == "192.0.2.12", nil
+		})
+	}()
+
+	// Wait for the watch to block on the pool
+	for server.Calls("event.from") < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		set("VM_guest_metrics.set_networks", other, map[string]interface{}{"0/ip": fmt.Sprintf("192.0.2.%d", 21+i)})
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := server.Calls("event.from"); n != 2 {
+		t.Errorf("the guest metrics of other VMs should not have woken the watch up, got %d event.from calls", n)
+	}
+
+	metrics := server.Create("VM_guest_metrics", xapitest.Record{"networks": map[string]interface{}{"0/ip": "192.0.2.11"}})
+	set("VM.set_guest_metrics", vm, metrics)
+	if ip := <-ips; ip != "192.0.2.11" {
+		t.Errorf("bad IP: %s", ip)
+	}
+
+	set("VM_guest_metrics.set_networks", metrics, map[string]interface{}{"0/ip": "192.0.2.12"})
+	if ip := <-ips; ip != "192.0.2.12" {
+		t.Errorf("bad IP: %s", ip)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
@@ -1,12 +1,13 @@
 package common
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
@@ -25,16 +26,25 @@ func appendQuery(urlstring, k, v string) (string, error) {
 	return u.String(), err
 }
 
-func HTTPUpload(import_url string, fh *os.File, state multistep.StateBag) (result string, err error) {
+var opaqueRefPattern = regexp.MustCompile(`OpaqueRef:[^<\s]+`)
+
+// TaskResultRef extracts the object reference from a task result. xapi
+// reports the result of an import XML-RPC encoded, as in
+// <value><array><data><value>OpaqueRef:...</value></data></array></value>.
+func TaskResultRef(result string) string {
+	return opaqueRefPattern.FindString(result)
+}
+
+func HTTPUpload(ctx context.Context, import_url string, fh *os.File, state multistep.StateBag) (result string, err error) {
 	ui := state.Get("ui").(packer.Ui)
 	c := state.Get("client").(*Connection)
 
-	task, err := c.client.Task.Create(c.session, "packer-task", "Packer task")
+	task, err := c.CreateTask(ctx, "packer-task", "Packer task")
 	if err != nil {
 		err = fmt.Errorf("Unable to create task: %s", err.Error())
 		return
 	}
-	defer c.client.Task.Destroy(c.session, task)
+	defer c.DestroyTask(ctx, task)
 
 	import_task_url, err := appendQuery(import_url, "task_id", string(task))
 	if err != nil {
@@ -49,21 +59,16 @@ func HTTPUpload(import_url string, fh *os.File, state multistep.StateBag) (resul
 	}
 	fileLength := fstat.Size()
 
-	// Define a new transport which allows self-signed certs
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	// Create request and upload file
+	request, err := http.NewRequestWithContext(ctx, "PUT", import_task_url, fh)
+	if err != nil {
+		return
 	}
-
-	// Create a client
-	httpClient := &http.Client{Transport: tr}
-
-	// Create request and download file
-	request, err := http.NewRequest("PUT", import_task_url, fh)
 	request.ContentLength = fileLength
 
 	ui.Say(fmt.Sprintf("PUT '%s'", import_task_url))
 
-	resp, err := httpClient.Do(request) // Do closes fh for us, according to docs
+	resp, err := c.HTTPClient().Do(request) // Do closes fh for us, according to docs
 	if err != nil {
 		return
 	}
@@ -73,41 +78,31 @@ func HTTPUpload(import_url string, fh *os.File, state multistep.StateBag) (resul
 		return
 	}
 
-	logIteration := 0
-	err = InterruptibleWait{
-		Predicate: func() (bool, error) {
-			status, err := c.client.Task.GetStatus(c.session, task)
-			if err != nil {
-				return false, fmt.Errorf("Failed to get task status: %s", err.Error())
+	waitCtx, cancel := context.WithTimeout(ctx, 24*time.Hour)
+	defer cancel()
+	// Log every 10% of progress
+	logged := -10
+	status, err := c.WaitForTask(waitCtx, task, func(progress float64) {
+		if percent := int(progress * 100); percent >= logged+10 {
+			logged = percent
+			log.Printf("Upload %d%% complete", percent)
+		}
+	})
+	if err == nil {
+		switch status {
+		case xsclient.TaskStatusTypeSuccess:
+		case xsclient.TaskStatusTypeFailure:
+			errorInfo, infoErr := c.GetTaskErrorInfo(ctx, task)
+			if infoErr != nil {
+				errorInfo = []string{fmt.Sprintf("furthermore, failed to get error info: %s", infoErr.Error())}
 			}
-			switch status {
-			case xsclient.TaskStatusTypePending:
-				progress, err := c.client.Task.GetProgress(c.session, task)
-				if err != nil {
-					return false, fmt.Errorf("Failed to get progress: %s", err.Error())
-				}
-				logIteration = logIteration + 1
-				if logIteration%5 == 0 {
-					log.Printf("Upload %.0f%% complete", progress*100)
-				}
-				return false, nil
-			case xsclient.TaskStatusTypeSuccess:
-				return true, nil
-			case xsclient.TaskStatusTypeFailure:
-				errorInfo, err := c.client.Task.GetErrorInfo(c.session, task)
-				if err != nil {
-					errorInfo = []string{fmt.Sprintf("furthermore, failed to get error info: %s", err.Error())}
-				}
-				return false, fmt.Errorf("Task failed: %s", errorInfo)
-			case xsclient.TaskStatusTypeCancelling, xsclient.TaskStatusTypeCancelled:
-				return false, fmt.Errorf("Task cancelled")
-			default:
-				return false, fmt.Errorf("Unknown task status %v", status)
-			}
-		},
-		PredicateInterval: 1 * time.Second,
-		Timeout:           24 * time.Hour,
-	}.Wait(state)
+			err = fmt.Errorf("Task failed: %s", errorInfo)
+		case xsclient.TaskStatusTypeCancelling, xsclient.TaskStatusTypeCancelled:
+			err = fmt.Errorf("Task cancelled")
+		default:
+			err = fmt.Errorf("Unknown task status %v", status)
+		}
+	}
 
 	resp.Body.Close()
 
@@ -116,7 +111,7 @@ func HTTPUpload(import_url string, fh *os.File, state multistep.StateBag) (resul
 		return
 	}
 
-	result, err = c.client.Task.GetResult(c.session, task)
+	result, err = c.GetTaskResult(ctx, task)
 	if err != nil {
 		err = fmt.Errorf("Error getting result: %s", err.Error())
 		return
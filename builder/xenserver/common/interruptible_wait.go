@@ -1,8 +1,10 @@
 package common
 
 import (
-	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"log"
 	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
 )
 
 type InterruptibleWait struct {
@@ -35,6 +37,7 @@ type PredicateResult struct {
    If the command is interrupted by the user, then an InterruptedError is returned.
    If Predicate is not nil, a timeout leads to TimeoutError being returned, and a successful Predicate run leads to nil being returned.
    If Predicate is nil, a timeout is not an error, and nil is returned.
+   Transient XAPI errors returned by Predicate, such as the pool master going away, do not end the wait; Predicate is simply run again.
 */
 func (wait InterruptibleWait) Wait(state multistep.StateBag) error {
 	predicateResult := make(chan PredicateResult, 1)
@@ -44,7 +47,10 @@ func (wait InterruptibleWait) Wait(state multistep.StateBag) error {
 	if wait.Predicate != nil {
 		go func() {
 			for {
-				if complete, err := wait.Predicate(); err != nil || complete {
+				complete, err := wait.Predicate()
+				if err != nil && isTransient(err) {
+					log.Printf("Unable to check wait condition, will try again: %s", err.Error())
+				} else if err != nil || complete {
 					predicateResult <- PredicateResult{complete, err}
 					return
 				}
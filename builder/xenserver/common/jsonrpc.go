@@ -0,0 +1,78 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// jsonrpcCaller speaks JSON-RPC 2.0 to the /jsonrpc handler of xapi. The
+// method names and parameters are the same as over XML-RPC; failures come
+// back as an error object with the XAPI error code as its message and the
+// error parameters as its data.
+//
+// Unlike the XML-RPC client, it may be used from several goroutines at once.
+type jsonrpcCaller struct {
+	url    string
+	client *http.Client
+	id     atomic.Uint64
+}
+
+type jsonrpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      uint64        `json:"id"`
+}
+
+type jsonrpcResponse struct {
+	Result interface{} `json:"result"`
+	Error  *struct {
+		Code    int           `json:"code"`
+		Message string        `json:"message"`
+		Data    []interface{} `json:"data"`
+	} `json:"error"`
+	ID uint64 `json:"id"`
+}
+
+func (j *jsonrpcCaller) call(method string, params []interface{}) (interface{}, error) {
+	request := jsonrpcRequest{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+		ID:      j.id.Add(1),
+	}
+	if request.Params == nil {
+		request.Params = []interface{}{}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := j.client.Post(j.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("JSON-RPC call %s failed: %s %s", method, resp.Status, bytes.TrimSpace(message))
+	}
+
+	var response jsonrpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.ID != request.ID {
+		return nil, fmt.Errorf("JSON-RPC call %s answered with id %d, expected %d", method, response.ID, request.ID)
+	}
+	if response.Error != nil {
+		return nil, newAPIError(append([]interface{}{response.Error.Message}, response.Error.Data...))
+	}
+	return response.Result, nil
+}
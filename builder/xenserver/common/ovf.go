@@ -0,0 +1,393 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	xenapi "github.com/terra-farm/go-xen-api-client"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskformat"
+)
+
+// ovfDiskFormats are the URIs OVF descriptors identify the formats of disks
+// by.
+var ovfDiskFormats = map[diskformat.Format]string{
+	diskformat.VMDK: "http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized",
+	diskformat.VHD:  "http://technet.microsoft.com/en-us/virtualserver/bb676673.aspx",
+}
+
+// ovfSystemTypes are the virtual system types given for VMs with disks of
+// each format: VMware hardware for VMDKs, and Xen for VHDs, which is what
+// XenServer puts in the OVFs it exports.
+var ovfSystemTypes = map[diskformat.Format]string{
+	diskformat.VMDK: "vmx-07",
+	diskformat.VHD:  "xen-3.0-unknown",
+}
+
+// ovfVM is what an OVF descriptor describes of a VM.
+type ovfVM struct {
+	Name        string
+	Description string
+	VCPUs       int
+	MemoryMiB   int
+	UEFI        bool
+	SystemType  string
+	DiskFormat  string
+	Disks       []ovfDisk
+	NICs        []ovfNIC
+}
+
+// ovfDisk is a disk of the VM, and the file it was exported to.
+type ovfDisk struct {
+	File     string
+	Size     int64
+	Capacity int64
+	// Address is the unit of the disk on the SCSI controller.
+	Address int
+}
+
+// ovfNIC is a network interface of the VM.
+type ovfNIC struct {
+	Network string
+	MAC     string
+}
+
+// Networks returns the networks the NICs are connected to, each once.
+func (vm ovfVM) Networks() []string {
+	var networks []string
+	for _, nic := range vm.NICs {
+		if !slices.Contains(networks, nic.Network) {
+			networks = append(networks, nic.Network)
+		}
+	}
+	return networks
+}
+
+// ovfDescriptor is the template of the OVF 1.0 descriptor of an ovfVM. The
+// VMware firmware setting is optional, so other consumers ignore it.
+var ovfDescriptor = template.Must(template.New("ovf").Funcs(template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(s))
+		return buf.String(), err
+	},
+	"add": func(a, b int) int { return a + b },
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+{{- range $i, $disk := .Disks}}
+    <File ovf:id="file{{add $i 1}}" ovf:href="{{xml $disk.File}}" ovf:size="{{$disk.Size}}"/>
+{{- end}}
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+{{- range $i, $disk := .Disks}}
+    <Disk ovf:diskId="vmdisk{{add $i 1}}" ovf:fileRef="file{{add $i 1}}" ovf:capacity="{{$disk.Capacity}}" ovf:capacityAllocationUnits="byte" ovf:format="{{$.DiskFormat}}"/>
+{{- end}}
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+{{- range .Networks}}
+    <Network ovf:name="{{xml .}}">
+      <Description>The {{xml .}} network</Description>
+    </Network>
+{{- end}}
+  </NetworkSection>
+  <VirtualSystem ovf:id="{{xml .Name}}">
+    <Info>A virtual machine</Info>
+    <Name>{{xml .Name}}</Name>
+{{- if .Description}}
+    <AnnotationSection>
+      <Info>A human-readable annotation</Info>
+      <Annotation>{{xml .Description}}</Annotation>
+    </AnnotationSection>
+{{- end}}
+    <OperatingSystemSection ovf:id="1">
+      <Info>The kind of installed guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{xml .Name}}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>{{.SystemType}}</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>{{.VCPUs}} virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.VCPUs}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>{{.MemoryMiB}}MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.MemoryMiB}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>SCSI Controller</rasd:Description>
+        <rasd:ElementName>SCSI Controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>lsilogic</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+{{- range $i, $disk := .Disks}}
+      <Item>
+        <rasd:AddressOnParent>{{$disk.Address}}</rasd:AddressOnParent>
+        <rasd:ElementName>Hard Disk {{add $i 1}}</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk{{add $i 1}}</rasd:HostResource>
+        <rasd:InstanceID>{{add $i 4}}</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+{{- end}}
+{{- range $i, $nic := .NICs}}
+      <Item>
+{{- if $nic.MAC}}
+        <rasd:Address>{{xml $nic.MAC}}</rasd:Address>
+{{- end}}
+        <rasd:AddressOnParent>{{$i}}</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>{{xml $nic.Network}}</rasd:Connection>
+        <rasd:ElementName>Network adapter {{add $i 1}}</rasd:ElementName>
+        <rasd:InstanceID>{{add $i (add 4 (len $.Disks))}}</rasd:InstanceID>
+        <rasd:ResourceSubType>E1000</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+{{- end}}
+{{- if .UEFI}}
+      <vmw:Config ovf:required="false" vmw:key="firmware" vmw:value="efi"/>
+{{- end}}
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`))
+
+// descriptor returns the OVF descriptor of the VM.
+func (vm ovfVM) descriptor() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := ovfDescriptor.Execute(&buf, vm); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// getOVFVM reads what the OVF descriptor describes from the VM record, its
+// VIFs and the disks exported as images of the given format.
+func getOVFVM(ctx context.Context, c Client, instance xenapi.VMRef, disks []exportedDisk, format diskformat.Format) (vm ovfVM, err error) {
+	vm.SystemType = ovfSystemTypes[format]
+	vm.DiskFormat = ovfDiskFormats[format]
+
+	if vm.Name, err = c.GetVMNameLabel(ctx, instance); err != nil {
+		return vm, err
+	}
+	if vm.Description, err = c.GetVMNameDescription(ctx, instance); err != nil {
+		return vm, err
+	}
+	if vm.VCPUs, err = c.GetVMVCPUsMax(ctx, instance); err != nil {
+		return vm, err
+	}
+	memory, err := c.GetVMMemoryStaticMax(ctx, instance)
+	if err != nil {
+		return vm, err
+	}
+	vm.MemoryMiB = memory / 1024 / 1024
+	bootParams, err := c.GetVMHVMBootParams(ctx, instance)
+	if err != nil {
+		return vm, err
+	}
+	vm.UEFI = bootParams["firmware"] == "uefi"
+
+	for i, disk := range disks {
+		fstat, err := os.Stat(disk.file)
+		if err != nil {
+			return vm, err
+		}
+		// Unit 7 is the SCSI controller's own
+		address := i
+		if address >= 7 {
+			address++
+		}
+		vm.Disks = append(vm.Disks, ovfDisk{
+			File:     filepath.Base(disk.file),
+			Size:     fstat.Size(),
+			Capacity: disk.size,
+			Address:  address,
+		})
+	}
+
+	vifs, err := c.GetVMVIFs(ctx, instance)
+	if err != nil {
+		return vm, err
+	}
+	devices := make(map[xenapi.VIFRef]string)
+	for _, vif := range vifs {
+		if devices[vif], err = c.GetVIFDevice(ctx, vif); err != nil {
+			return vm, err
+		}
+	}
+	sort.SliceStable(vifs, func(i, j int) bool {
+		a, _ := strconv.Atoi(devices[vifs[i]])
+		b, _ := strconv.Atoi(devices[vifs[j]])
+		return a < b
+	})
+	for _, vif := range vifs {
+		var nic ovfNIC
+		network, err := c.GetVIFNetwork(ctx, vif)
+		if err != nil {
+			return vm, err
+		}
+		if nic.Network, err = c.GetNetworkNameLabel(ctx, network); err != nil {
+			return vm, err
+		}
+		if nic.MAC, err = c.GetVIFMAC(ctx, vif); err != nil {
+			return vm, err
+		}
+		vm.NICs = append(vm.NICs, nic)
+	}
+
+	return vm, nil
+}
+
+// exportOVF exports the VM as an OVF descriptor, a manifest and the disks
+// it refers to, into output_directory, or packed into an OVA there if ova is
+// set.
+func exportOVF(ctx context.Context, c *Connection, config CommonConfig, instance xenapi.VMRef, ova bool, ui packer.Ui) error {
+	format := diskformat.Format(config.OVFDiskFormat)
+
+	dir := config.OutputDir
+	if ova {
+		// The files are only kept until they are packed into the OVA
+		var err error
+		dir, err = os.MkdirTemp(config.OutputDir, "ova")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	disks, err := exportDisks(ctx, c, config, instance, format, dir, ui)
+	if err != nil {
+		return err
+	}
+
+	vm, err := getOVFVM(ctx, c, instance, disks, format)
+	if err != nil {
+		return fmt.Errorf("Could not read the VM record: %s", err.Error())
+	}
+	descriptor, err := vm.descriptor()
+	if err != nil {
+		return err
+	}
+
+	base := unsafeFilenameChars.ReplaceAllString(config.VMName, "_")
+	descriptorFile := filepath.Join(dir, base+".ovf")
+	if err := os.WriteFile(descriptorFile, descriptor, 0644); err != nil {
+		return err
+	}
+
+	// The manifest lists the SHA-256 of every other file
+	descriptorSum := sha256.Sum256(descriptor)
+	manifest := fmt.Sprintf("SHA256(%s)= %s\n", filepath.Base(descriptorFile), hex.EncodeToString(descriptorSum[:]))
+	files := []string{descriptorFile}
+	for _, disk := range disks {
+		sum, err := readChecksum(disk.file)
+		if err != nil {
+			return err
+		}
+		manifest += fmt.Sprintf("SHA256(%s)= %s\n", filepath.Base(disk.file), sum)
+		files = append(files, disk.file)
+	}
+	manifestFile := filepath.Join(dir, base+".mf")
+	if err := os.WriteFile(manifestFile, []byte(manifest), 0644); err != nil {
+		return err
+	}
+
+	if !ova {
+		return nil
+	}
+
+	// The descriptor comes first in an OVA, then the manifest, then the
+	// files in the order they are referenced in
+	files = append([]string{descriptorFile, manifestFile}, files[1:]...)
+	ovaFile := filepath.Join(config.OutputDir, base+".ova")
+	ui.Say("Packing " + filepath.Base(ovaFile))
+	if err := writeOVA(ovaFile, files); err != nil {
+		return err
+	}
+	return checksumFile(ovaFile)
+}
+
+// writeOVA writes files to filename as a tar archive, which OVAs are.
+func writeOVA(filename string, files []string) (err error) {
+	fh, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := fh.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
+
+	tw := tar.NewWriter(fh)
+	for _, file := range files {
+		if err := addToTar(tw, file); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addToTar(tw *tar.Writer, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fstat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	// OVAs have to be USTAR archives
+	name := filepath.Base(file)
+	if len(name) > 100 {
+		return fmt.Errorf("'%s' is too long a name for an OVA", name)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    fstat.Size(),
+		ModTime: time.Now().Truncate(time.Second),
+		Format:  tar.FormatUSTAR,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(tw, in, make([]byte, downloadBufferSize))
+	return err
+}
@@ -0,0 +1,130 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// redacted replaces every secret in the output of a build.
+const redacted = "<sensitive>"
+
+// secretPatterns catch credentials by their context, so that they are
+// hidden even if they were never registered: the session_id parameter and
+// cookie of the HTTP handlers, the user info of a URL and the password
+// argument of xe.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(session_id=)[^&;\s'"]+`),
+	regexp.MustCompile(`(://[^/:@\s]*:)[^/@\s]+(@)`),
+	regexp.MustCompile(`(-pw\s+)\S+`),
+}
+
+var secrets = struct {
+	sync.RWMutex
+	values map[string]struct{}
+}{values: make(map[string]struct{})}
+
+var redactLogOnce sync.Once
+
+// AddSecrets registers values, such as the XAPI password or a session
+// reference, to be hidden from all output. They are also hidden in their
+// URL encoded form.
+func AddSecrets(values ...string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		secrets.values[value] = struct{}{}
+		secrets.values[url.QueryEscape(value)] = struct{}{}
+	}
+}
+
+// Redact returns s with the registered secrets and anything looking like
+// a credential replaced.
+func Redact(s string) string {
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+redacted+"${2}")
+	}
+
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for value := range secrets.values {
+		s = strings.ReplaceAll(s, value, redacted)
+	}
+	return s
+}
+
+// SetupRedaction registers the given secrets, routes the standard logger
+// through Redact and returns ui wrapped so that everything it displays is
+// redacted as well. Builders call it before anything is said or logged.
+func SetupRedaction(ui packer.Ui, values ...string) packer.Ui {
+	AddSecrets(values...)
+	redactLogOnce.Do(func() {
+		log.SetOutput(&redactingWriter{w: log.Writer()})
+	})
+	if _, ok := ui.(*redactingUi); ok {
+		return ui
+	}
+	return &redactingUi{Ui: ui}
+}
+
+// redactingWriter redacts whole log lines; the standard logger hands each
+// one over in a single Write.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type redactingUi struct {
+	packer.Ui
+}
+
+func (u *redactingUi) Ask(query string) (string, error) {
+	return u.Ui.Ask(Redact(query))
+}
+
+func (u *redactingUi) Askf(query string, args ...any) (string, error) {
+	return u.Ask(fmt.Sprintf(query, args...))
+}
+
+func (u *redactingUi) Say(message string) {
+	u.Ui.Say(Redact(message))
+}
+
+func (u *redactingUi) Sayf(message string, args ...any) {
+	u.Say(fmt.Sprintf(message, args...))
+}
+
+func (u *redactingUi) Message(message string) {
+	u.Ui.Message(Redact(message))
+}
+
+func (u *redactingUi) Error(message string) {
+	u.Ui.Error(Redact(message))
+}
+
+func (u *redactingUi) Errorf(message string, args ...any) {
+	u.Error(fmt.Sprintf(message, args...))
+}
+
+func (u *redactingUi) Machine(t string, args ...string) {
+	redactedArgs := make([]string, len(args))
+	for i, arg := range args {
+		redactedArgs[i] = Redact(arg)
+	}
+	u.Ui.Machine(t, redactedArgs...)
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	xenapi "github.com/terra-farm/go-xen-api-client"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// resolve looks an object of class up by UUID or by name label. Names are
+// not unique in XAPI, so a name matching several objects is an error and
+// the UUID has to be given instead.
+func resolve[Ref ~string](
+	ctx context.Context,
+	class, nameOrUUID string,
+	byUUID func(context.Context, string) (Ref, error),
+	byName func(context.Context, string) ([]Ref, error),
+) (Ref, error) {
+	if uuidPattern.MatchString(nameOrUUID) {
+		ref, err := byUUID(ctx, nameOrUUID)
+		if err == nil || xapiErrorCode(err) != xenapi.ERR_UUID_INVALID {
+			return ref, err
+		}
+		// Not the UUID of such an object after all, so it may still be a
+		// name label
+	}
+
+	refs, err := byName(ctx, nameOrUUID)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case len(refs) == 0:
+		return "", fmt.Errorf("Couldn't find a %s with the name-label or UUID '%s'", class, nameOrUUID)
+	case len(refs) > 1:
+		return "", fmt.Errorf("Found %d %ss with the name '%s'. Use the UUID of one of them instead", len(refs), class, nameOrUUID)
+	}
+
+	return refs[0], nil
+}
+
+// findSR looks an SR up by UUID or by name label. The default SR of the pool
+// is returned if nameOrUUID is empty.
+func findSR(ctx context.Context, c SRClient, nameOrUUID string) (xenapi.SRRef, error) {
+	if nameOrUUID == "" {
+		sr, err := c.GetDefaultSR(ctx)
+		if err == nil && (sr == "" || sr == "OpaqueRef:NULL") {
+			return "", errors.New("The pool has no default SR, one has to be named instead")
+		}
+		return sr, err
+	}
+	return resolve(ctx, "SR", nameOrUUID, c.GetSRByUUID, c.GetSRByNameLabel)
+}
+
+// findVDI looks a VDI up by UUID or by name label.
+func findVDI(ctx context.Context, c VDIClient, nameOrUUID string) (xenapi.VDIRef, error) {
+	return resolve(ctx, "VDI", nameOrUUID, c.GetVDIByUUID, c.GetVDIByNameLabel)
+}
+
+// findTemplate looks the template, VM or snapshot to clone up by UUID or by
+// name label.
+func findTemplate(ctx context.Context, c VMClient, nameOrUUID string) (xenapi.VMRef, error) {
+	return resolve(ctx, "template", nameOrUUID, c.GetVMByUUID, c.GetVMByNameLabel)
+}
+
+// findNetwork looks a network up by UUID or by name label.
+func findNetwork(ctx context.Context, c NetworkClient, nameOrUUID string) (xenapi.NetworkRef, error) {
+	return resolve(ctx, "network", nameOrUUID, c.GetNetworkByUUID, c.GetNetworkByNameLabel)
+}
@@ -0,0 +1,250 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	xmlrpc "github.com/amfranz/go-xmlrpc-client"
+)
+
+// The wire protocols XAPI can be spoken over, as set by remote_api_protocol.
+const (
+	ProtocolXMLRPC  = "xmlrpc"
+	ProtocolJSONRPC = "jsonrpc"
+)
+
+// caller sends a single XAPI call and returns its value, decoded the same
+// way whatever the protocol: strings, booleans, float64s, []interface{}
+// and map[string]interface{}. Integers are strings over XML-RPC and numbers
+// over JSON-RPC, so the decode helpers below accept both.
+type caller interface {
+	call(method string, params []interface{}) (interface{}, error)
+}
+
+func newCaller(protocol, host string, transport *http.Transport) (caller, error) {
+	switch protocol {
+	case ProtocolXMLRPC, "":
+		client, err := xmlrpc.NewClient("https://"+host, transport)
+		if err != nil {
+			return nil, err
+		}
+		return &xmlrpcCaller{client: client}, nil
+	case ProtocolJSONRPC:
+		return &jsonrpcCaller{
+			url:    "https://" + host + "/jsonrpc",
+			client: &http.Client{Transport: transport},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown XAPI protocol '%s'", protocol)
+}
+
+// APIError is a failure reported by XAPI: an error code, such as
+// SESSION_INVALID, followed by its parameters.
+type APIError struct {
+	Code   string
+	Params []string
+}
+
+func (e *APIError) Error() string {
+	return strings.TrimSpace(fmt.Sprintf("API Error: %s %s", e.Code, strings.Join(e.Params, " ")))
+}
+
+func newAPIError(description []interface{}) *APIError {
+	if len(description) == 0 {
+		return &APIError{Code: "INTERNAL_ERROR"}
+	}
+	e := &APIError{Code: fmt.Sprint(description[0])}
+	for _, param := range description[1:] {
+		e.Params = append(e.Params, fmt.Sprint(param))
+	}
+	return e
+}
+
+type xmlrpcCaller struct {
+	client *xmlrpc.Client
+}
+
+func (x *xmlrpcCaller) call(method string, params []interface{}) (interface{}, error) {
+	encoded := make([]interface{}, len(params))
+	for i, param := range params {
+		encoded[i] = xmlrpcValue(reflect.ValueOf(param))
+	}
+
+	response := xmlrpc.Struct{}
+	if err := x.client.Call(method, xmlrpc.Params{Params: encoded}, &response); err != nil {
+		return nil, err
+	}
+
+	status, ok := response["Status"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected response to %s: no Status", method)
+	}
+	if status != "Success" {
+		description, _ := response["ErrorDescription"].([]interface{})
+		return nil, newAPIError(description)
+	}
+	return plainValue(response["Value"]), nil
+}
+
+// xmlrpcValue converts a parameter to the types the XML-RPC client knows
+// how to encode. Integers are sent as strings, as XAPI expects.
+func xmlrpcValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return ""
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return ""
+		}
+		return xmlrpcValue(v.Elem())
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Map:
+		s := make(xmlrpc.Struct, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			s[iter.Key().String()] = xmlrpcValue(iter.Value())
+		}
+		return s
+	case reflect.Slice, reflect.Array:
+		a := make([]interface{}, v.Len())
+		for i := range a {
+			a[i] = xmlrpcValue(v.Index(i))
+		}
+		return a
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// plainValue replaces the xmlrpc.Struct values of an XML-RPC response with
+// plain maps, as decoded from JSON.
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case xmlrpc.Struct:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = plainValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = plainValue(item)
+		}
+		return v
+	}
+	return value
+}
+
+// The decode helpers take the result of Connection.Call as is, so that a
+// call and the decoding of its value fit on one line.
+
+func decodeString(value interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("Unexpected XAPI value %v: expected a string", value)
+}
+
+func decodeRef[T ~string](value interface{}, err error) (T, error) {
+	s, err := decodeString(value, err)
+	return T(s), err
+}
+
+func decodeBool(value interface{}, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("Unexpected XAPI value %v: expected a boolean", value)
+	}
+	return b, nil
+}
+
+func decodeInt(value interface{}, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case string:
+		return strconv.Atoi(v)
+	case float64:
+		return int(v), nil
+	}
+	return 0, fmt.Errorf("Unexpected XAPI value %v: expected an integer", value)
+}
+
+func decodeFloat(value interface{}, err error) (float64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("Unexpected XAPI value %v: expected a number", value)
+}
+
+func decodeRefs[T ~string](value interface{}, err error) ([]T, error) {
+	if err != nil {
+		return nil, err
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected XAPI value %v: expected a set", value)
+	}
+	refs := make([]T, len(items))
+	for i, item := range items {
+		if refs[i], err = decodeRef[T](item, nil); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+func decodeStrings(value interface{}, err error) ([]string, error) {
+	return decodeRefs[string](value, err)
+}
+
+func decodeStringMap(value interface{}, err error) (map[string]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := toStruct(value)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected XAPI value %v: expected a map", value)
+	}
+	m := make(map[string]string, len(fields))
+	for key, item := range fields {
+		m[key] = fmt.Sprint(item)
+	}
+	return m, nil
+}
+
+func toStruct(value interface{}) (map[string]interface{}, bool) {
+	m, ok := value.(map[string]interface{})
+	return m, ok
+}
@@ -88,8 +88,21 @@ func doExecuteSSHCmd(cmd, target string, config *gossh.ClientConfig) (stdout str
 	return strings.Trim(b.String(), "\n"), nil
 }
 
+// hostSSHCredentials checks that the credentials needed to SSH to the host
+// are known; a build authenticating to XAPI with remote_session_id alone has
+// none.
+func (c CommonConfig) hostSSHCredentials() error {
+	if c.Username == "" || c.Password == "" {
+		return fmt.Errorf("SSH to the host needs a username and password: set remote_username and remote_password, remote_credentials_file or %s and %s", EnvUsername, EnvPassword)
+	}
+	return nil
+}
+
 func ExecuteHostSSHCmd(state multistep.StateBag, cmd string) (stdout string, err error) {
 	config := state.Get("commonconfig").(CommonConfig)
+	if err := config.hostSSHCredentials(); err != nil {
+		return "", err
+	}
 	sshAddress, _ := SSHAddress(state)
 	// Setup connection config
 	sshConfig := &gossh.ClientConfig{
@@ -185,8 +198,6 @@ func ssh_port_forward(local_listener net.Listener, remote_port int, host string,
 		// Forward to a remote port
 		go forward(local_connection, config, host, host_ssh_port, remote_dest, uint(remote_port))
 	}
-
-	return nil
 }
 
 // FileSigner returns an gossh.Signer for a key file.
@@ -0,0 +1,133 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	xenapi "github.com/terra-farm/go-xen-api-client"
+)
+
+// existingDisk is a VDI attached by StepAttachExistingDisks, shared with
+// StepDetachExistingDisks through the "existing_disks" state key.
+type existingDisk struct {
+	config ExistingDiskConfig
+	vdi    xenapi.VDIRef
+
+	// attached is false once the VBD is gone, clone while the VDI is a
+	// clone that has not been destroyed yet
+	attached bool
+	clone    bool
+}
+
+// StepAttachExistingDisks attaches the existing_disks to the VM, cloning
+// them first if asked to.
+type StepAttachExistingDisks struct {
+	disks []*existingDisk
+}
+
+func (self *StepAttachExistingDisks) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("commonconfig").(CommonConfig)
+	ui := state.Get("ui").(packer.Ui)
+	c := state.Get("client").(Client)
+
+	if len(config.ExistingDisks) == 0 {
+		return multistep.ActionContinue
+	}
+
+	uuid := state.Get("instance_uuid").(string)
+	instance, err := c.GetVMByUUID(ctx, uuid)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to get VM from UUID '%s': %s", uuid, err.Error()))
+		return multistep.ActionHalt
+	}
+
+	self.disks = nil
+	defer func() {
+		state.Put("existing_disks", self.disks)
+	}()
+
+	for i, diskConfig := range config.ExistingDisks {
+		vdi, err := findVDI(ctx, c, diskConfig.VDI)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Unable to find existing disk %d: %s", i, err.Error()))
+			return multistep.ActionHalt
+		}
+
+		disk := &existingDisk{config: diskConfig, vdi: vdi}
+
+		if diskConfig.Clone {
+			ui.Say(fmt.Sprintf("Cloning existing disk '%s'", diskConfig.VDI))
+			name, err := c.GetVDINameLabel(ctx, vdi)
+			if err != nil {
+				ui.Error(fmt.Sprintf("Unable to get name of VDI '%s': %s", diskConfig.VDI, err.Error()))
+				return multistep.ActionHalt
+			}
+			disk.vdi, err = c.CloneVDI(ctx, vdi)
+			if err != nil {
+				ui.Error(fmt.Sprintf("Unable to clone VDI '%s': %s", diskConfig.VDI, err.Error()))
+				return multistep.ActionHalt
+			}
+			disk.clone = true
+			self.disks = append(self.disks, disk)
+
+			// The clone would otherwise share the name of its source and
+			// make later lookups of it by name ambiguous
+			err = c.SetVDINameLabel(ctx, disk.vdi, fmt.Sprintf("%s (%s)", name, config.VMName))
+			if err != nil {
+				ui.Error(fmt.Sprintf("Unable to name the clone of VDI '%s': %s", diskConfig.VDI, err.Error()))
+				return multistep.ActionHalt
+			}
+		} else {
+			self.disks = append(self.disks, disk)
+		}
+
+		ui.Say(fmt.Sprintf("Attaching existing disk '%s'", diskConfig.VDI))
+		err = ConnectVdi(ctx, c, instance, disk.vdi, xenapi.VbdTypeDisk)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error attaching existing disk '%s': %s", diskConfig.VDI, err.Error()))
+			return multistep.ActionHalt
+		}
+		disk.attached = true
+	}
+
+	return multistep.ActionContinue
+}
+
+func (self *StepAttachExistingDisks) Cleanup(state multistep.StateBag) {
+	config := state.Get("commonconfig").(CommonConfig)
+	c := state.Get("client").(Client)
+	if config.ShouldKeepVM(state) {
+		return
+	}
+
+	ctx := context.Background()
+
+	var instance xenapi.VMRef
+	if uuid, ok := state.GetOk("instance_uuid"); ok {
+		var err error
+		if instance, err = c.GetVMByUUID(ctx, uuid.(string)); err != nil {
+			log.Printf("Unable to get VM from UUID '%s': %s", uuid, err.Error())
+		}
+	}
+
+	for _, disk := range self.disks {
+		if disk.attached && instance != "" {
+			if err := DisconnectVdi(ctx, c, instance, disk.vdi); err != nil {
+				log.Printf("Unable to detach existing disk '%s': %s", disk.config.VDI, err.Error())
+			} else {
+				disk.attached = false
+			}
+		}
+		if disk.clone && !disk.attached {
+			if err := c.DestroyVDI(ctx, disk.vdi); err != nil {
+				log.Printf("Unable to destroy the clone of '%s': %s", disk.config.VDI, err.Error())
+				continue
+			}
+			disk.clone = false
+			log.Printf("Destroyed the clone of '%s'", disk.config.VDI)
+		}
+	}
+}
@@ -19,7 +19,7 @@ type StepAttachVdi struct {
 
 func (self *StepAttachVdi) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 
 	log.Printf("Running attach vdi for key %s\n", self.VdiUuidKey)
 	var vdiUuid string
@@ -31,20 +31,20 @@ func (self *StepAttachVdi) Run(ctx context.Context, state multistep.StateBag) mu
 	}
 
 	var err error
-	self.vdi, err = c.client.VDI.GetByUUID(c.session, vdiUuid)
+	self.vdi, err = c.GetVDIByUUID(ctx, vdiUuid)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VDI from UUID '%s': %s", vdiUuid, err.Error()))
 		return multistep.ActionHalt
 	}
 
 	uuid := state.Get("instance_uuid").(string)
-	instance, err := c.client.VM.GetByUUID(c.session, uuid)
+	instance, err := c.GetVMByUUID(ctx, uuid)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM from UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
 	}
 
-	err = ConnectVdi(c, instance, self.vdi, self.VdiType)
+	err = ConnectVdi(ctx, c, instance, self.vdi, self.VdiType)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error attaching VDI '%s': '%s'", vdiUuid, err.Error()))
 		return multistep.ActionHalt
@@ -57,7 +57,7 @@ func (self *StepAttachVdi) Run(ctx context.Context, state multistep.StateBag) mu
 
 func (self *StepAttachVdi) Cleanup(state multistep.StateBag) {
 	config := state.Get("commonconfig").(CommonConfig)
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 	if config.ShouldKeepVM(state) {
 		return
 	}
@@ -66,8 +66,10 @@ func (self *StepAttachVdi) Cleanup(state multistep.StateBag) {
 		return
 	}
 
+	ctx := context.Background()
+
 	uuid := state.Get("instance_uuid").(string)
-	vmRef, err := c.client.VM.GetByUUID(c.session, uuid)
+	vmRef, err := c.GetVMByUUID(ctx, uuid)
 	if err != nil {
 		log.Printf("Unable to get VM from UUID '%s': %s", uuid, err.Error())
 		return
@@ -75,7 +77,7 @@ func (self *StepAttachVdi) Cleanup(state multistep.StateBag) {
 
 	vdiUuid := state.Get(self.VdiUuidKey).(string)
 
-	err = DisconnectVdi(c, vmRef, self.vdi)
+	err = DisconnectVdi(ctx, c, vmRef, self.vdi)
 	if err != nil {
 		log.Printf("Unable to disconnect VDI '%s': %s", vdiUuid, err.Error())
 		return
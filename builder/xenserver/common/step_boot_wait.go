@@ -11,13 +11,18 @@ import (
 type StepBootWait struct{}
 
 func (self *StepBootWait) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
 
-	instance, _ := c.client.VM.GetByUUID(c.session, state.Get("instance_uuid").(string))
+	uuid := state.Get("instance_uuid").(string)
+	instance, err := c.GetVMByUUID(ctx, uuid)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to get VM from UUID '%s': %s", uuid, err.Error()))
+		return multistep.ActionHalt
+	}
 	ui.Say("Unpausing VM " + state.Get("instance_uuid").(string))
-	Unpause(c, instance)
+	c.UnpauseVM(ctx, instance)
 
 	if int64(config.BootWait) > 0 {
 		ui.Say(fmt.Sprintf("Waiting %s for boot...", config.BootWait))
@@ -0,0 +1,224 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	xenapi "github.com/terra-farm/go-xen-api-client"
+)
+
+// Upload is a file the build uploads as a VDI, on the ISO SR unless SR is
+// set.
+type Upload struct {
+	Path string
+	// VdiName is set if an existing VDI of that name is used instead of
+	// uploading the file, as StepFindOrUploadVdi does.
+	VdiName string
+	// SR returns the SR the file is uploaded to.
+	SR func(ctx context.Context, c SRClient) (xenapi.SRRef, error)
+	// Size is set if the VDI ends up larger than the file, as a resized
+	// boot disk does.
+	Size int64
+}
+
+// StepCheckFreeSpace makes sure that every SR the build is about to use
+// has room for the disks created and the files uploaded on it, so that a
+// full SR fails the build before anything is created rather than halfway
+// through.
+type StepCheckFreeSpace struct {
+	// CreateDisks is set if the build creates the disks of the config; the
+	// XVA builder imports them instead.
+	CreateDisks bool
+
+	// Uploads returns the files to be uploaded.
+	Uploads func() []Upload
+
+	// ImportPath is the XVA to be imported, to ImportSR.
+	ImportPath string
+	ImportSR   func(ctx context.Context, c SRClient) (xenapi.SRRef, error)
+
+	// CopyTemplate is the template to be copied with its disks, to CopySR.
+	CopyTemplate string
+	CopySR       func(ctx context.Context, c SRClient) (xenapi.SRRef, error)
+}
+
+// srDemand is the space needed on an SR, and what for.
+type srDemand struct {
+	bytes int64
+	uses  []string
+}
+
+func (self *StepCheckFreeSpace) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("commonconfig").(CommonConfig)
+	ui := state.Get("ui").(packer.Ui)
+	c := state.Get("client").(Client)
+
+	ui.Say("Step: Check free space on SRs")
+
+	demands := make(map[xenapi.SRRef]*srDemand)
+	need := func(sr xenapi.SRRef, bytes int64, use string) {
+		if demands[sr] == nil {
+			demands[sr] = &srDemand{}
+		}
+		demands[sr].bytes += bytes
+		demands[sr].uses = append(demands[sr].uses, fmt.Sprintf("%s %s", use, formatBytes(bytes)))
+	}
+	fail := func(err error) multistep.StepAction {
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	if self.CreateDisks {
+		for i, disk := range config.Disks {
+			sr, err := config.GetDiskSR(ctx, c, disk)
+			if err != nil {
+				return fail(fmt.Errorf("Unable to get SR for disk %d: %s", i, err.Error()))
+			}
+			need(sr, int64(disk.Size)*1024*1024, fmt.Sprintf("disk '%s'", disk.Name))
+		}
+	}
+
+	var uploads []Upload
+	if self.Uploads != nil {
+		uploads = self.Uploads()
+	}
+	for _, upload := range uploads {
+		if upload.Path == "" {
+			continue
+		}
+		if upload.VdiName != "" {
+			vdis, err := c.GetVDIByNameLabel(ctx, upload.VdiName)
+			if err != nil {
+				return fail(fmt.Errorf("Failed to find VDI '%s' by name label: %s", upload.VdiName, err.Error()))
+			}
+			if len(vdis) > 0 {
+				continue
+			}
+		}
+		size, err := fileSize(upload.Path)
+		if err != nil {
+			return fail(err)
+		}
+		if upload.Size > size {
+			size = upload.Size
+		}
+		var sr xenapi.SRRef
+		if upload.SR != nil {
+			sr, err = upload.SR(ctx, c)
+		} else {
+			sr, err = config.GetISOSR(ctx, c)
+		}
+		if err != nil {
+			return fail(fmt.Errorf("Unable to get SR: %s", err.Error()))
+		}
+		need(sr, size, fmt.Sprintf("upload '%s'", upload.Path))
+	}
+
+	if self.ImportPath != "" && self.ImportSR != nil {
+		size, err := fileSize(self.ImportPath)
+		if err != nil {
+			return fail(err)
+		}
+		sr, err := self.ImportSR(ctx, c)
+		if err != nil {
+			return fail(fmt.Errorf("Unable to get SR: %s", err.Error()))
+		}
+		need(sr, size, fmt.Sprintf("import '%s'", self.ImportPath))
+	}
+
+	if self.CopyTemplate != "" && self.CopySR != nil {
+		template, err := findTemplate(ctx, c, self.CopyTemplate)
+		if err != nil {
+			return fail(fmt.Errorf("Error looking up template: %s", err.Error()))
+		}
+		vdis, err := GetDisks(ctx, c, template)
+		if err != nil {
+			return fail(fmt.Errorf("Unable to get the disks of template '%s': %s", self.CopyTemplate, err.Error()))
+		}
+		var size int64
+		for _, vdi := range vdis {
+			vdiSize, err := c.GetVDIVirtualSize(ctx, vdi)
+			if err != nil {
+				return fail(fmt.Errorf("Unable to get size of VDI '%s': %s", vdi, err.Error()))
+			}
+			size += int64(vdiSize)
+		}
+		sr, err := self.CopySR(ctx, c)
+		if err != nil {
+			return fail(fmt.Errorf("Unable to get SR: %s", err.Error()))
+		}
+		need(sr, size, fmt.Sprintf("copy of '%s'", self.CopyTemplate))
+	}
+
+	var report, shortfalls []string
+	for sr, demand := range demands {
+		name, err := c.GetSRNameLabel(ctx, sr)
+		if err != nil {
+			return fail(fmt.Errorf("Unable to get name of SR '%s': %s", sr, err.Error()))
+		}
+		size, err := c.GetSRPhysicalSize(ctx, sr)
+		if err != nil {
+			return fail(fmt.Errorf("Unable to get size of SR '%s': %s", name, err.Error()))
+		}
+		used, err := c.GetSRPhysicalUtilisation(ctx, sr)
+		if err != nil {
+			return fail(fmt.Errorf("Unable to get utilisation of SR '%s': %s", name, err.Error()))
+		}
+
+		// Some SRs, such as ISO libraries, do not report a size
+		if size <= 0 {
+			log.Printf("SR '%s' does not report its size, not checking its free space", name)
+			continue
+		}
+
+		free := int64(size - used)
+		line := fmt.Sprintf("SR '%s': %s needed (%s), %s free", name, formatBytes(demand.bytes), strings.Join(demand.uses, ", "), formatBytes(free))
+		report = append(report, line)
+		if demand.bytes > free {
+			shortfalls = append(shortfalls, line)
+		}
+	}
+	sort.Strings(report)
+	sort.Strings(shortfalls)
+
+	if len(shortfalls) > 0 {
+		return fail(fmt.Errorf("Not enough free space on %d SR(s):\n  %s", len(shortfalls), strings.Join(shortfalls, "\n  ")))
+	}
+	for _, line := range report {
+		ui.Message(line)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (self *StepCheckFreeSpace) Cleanup(state multistep.StateBag) {}
+
+func fileSize(path string) (int64, error) {
+	fstat, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to stat '%s': %s", path, err.Error())
+	}
+	return fstat.Size(), nil
+}
+
+// formatBytes renders a size in the largest binary unit it has at least one
+// of, e.g. "1.5 GiB".
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit && exp < 4; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTP"[exp])
+}
@@ -2,12 +2,12 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
-	xenapi "github.com/terra-farm/go-xen-api-client"
 	xsclient "github.com/terra-farm/go-xen-api-client"
 )
 
@@ -22,7 +22,7 @@ type StepCreateInstance struct {
 
 func (self *StepCreateInstance) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 	config := state.Get("config").(Config)
 	ui := state.Get("ui").(packer.Ui)
 
@@ -30,103 +30,70 @@ func (self *StepCreateInstance) Run(ctx context.Context, state multistep.StateBa
 
 	// Get the template to clone from
 
-	vms, err := c.GetClient().VM.GetByNameLabel(c.GetSessionRef(), config.CloneTemplate)
-
-	switch {
-	case len(vms) == 0:
-		ui.Error(fmt.Sprintf("Couldn't find a template with the name-label '%s'. Aborting.", config.CloneTemplate))
-		return multistep.ActionHalt
-	case len(vms) > 1:
-		ui.Error(fmt.Sprintf("Found more than one template with the name '%s'. The name must be unique. Aborting.", config.CloneTemplate))
+	template, err := findTemplate(ctx, c, config.CloneTemplate)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error looking up template: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	template := vms[0]
-
-	// Clone that VM template
-	instance, err := c.GetClient().VM.Clone(c.GetSessionRef(), template, config.VMName)
-	if err != nil {
-		ui.Error(fmt.Sprintf("Error cloning VM: %s", err.Error()))
-		return multistep.ActionHalt
+	// Clone that VM template, or copy it with its disks
+	var instance xsclient.VMRef
+	if config.FullCopy {
+		var sr xsclient.SRRef
+		if config.SrName != "" {
+			sr, err = config.GetSR(ctx, c)
+			if err != nil {
+				ui.Error(fmt.Sprintf("Unable to get SR: %s", err.Error()))
+				return multistep.ActionHalt
+			}
+		}
+		ui.Say("Copying the template with its disks, this may take a while")
+		instance, err = c.CopyVM(ctx, template, config.VMName, sr)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error copying VM: %s", err.Error()))
+			return multistep.ActionHalt
+		}
+	} else {
+		instance, err = c.CloneVM(ctx, template, config.VMName)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error cloning VM: %s", err.Error()))
+			return multistep.ActionHalt
+		}
 	}
 	self.instance = &instance
 
-	err = c.GetClient().VM.SetIsATemplate(c.GetSessionRef(), instance, false)
+	err = c.SetVMIsATemplate(ctx, instance, false)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error setting is_a_template=false: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	err = c.GetClient().VM.SetVCPUsMax(c.GetSessionRef(), instance, int(config.VCPUsMax))
+	// The disks of the template are cloned along with it
+	vdis, err := GetDisks(ctx, c, instance)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Error setting VM VCPUs Max=%d: %s", config.VCPUsMax, err.Error()))
+		ui.Error(fmt.Sprintf("Unable to get the disks of the VM: %s", err.Error()))
 		return multistep.ActionHalt
 	}
-
-	err = c.GetClient().VM.SetVCPUsAtStartup(c.GetSessionRef(), instance, int(config.VCPUsAtStartup))
-	if err != nil {
-		ui.Error(fmt.Sprintf("Error setting VM VCPUs At Startup=%d: %s", config.VCPUsAtStartup, err.Error()))
-		return multistep.ActionHalt
+	self.vdis = nil
+	for i := range vdis {
+		self.vdis = append(self.vdis, &vdis[i])
 	}
 
-	memory := int(config.VMMemory * 1024 * 1024)
-	err = c.GetClient().VM.SetMemoryLimits(c.GetSessionRef(), instance, memory, memory, memory, memory)
-	if err != nil {
-		ui.Error(fmt.Sprintf("Error setting VM memory=%d: %s", memory, err.Error()))
+	if err := ConfigureInstance(ctx, c, ui, instance, config); err != nil {
+		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	// If user didn't set platform args, use existing ones from the template
-	platformArgs := config.PlatformArgs
-	if len(platformArgs) == 0 {
-		platformArgs, err = c.GetClient().VM.GetPlatform(c.GetSessionRef(), instance)
-		if err != nil {
-			ui.Error(fmt.Sprintf("Error getting VM platform: %s", err.Error()))
-			return multistep.ActionHalt
-		}
-		ui.Say(fmt.Sprintf("Using existing platform args: %v", platformArgs))
-	}
-	// Always call SetPlatform to ensure the cloned VM's platform is explicitly configured
-	err = c.GetClient().VM.SetPlatform(c.GetSessionRef(), instance, platformArgs)
-	if err != nil {
-		ui.Error(fmt.Sprintf("Error setting VM platform: %s", err.Error()))
-		return multistep.ActionHalt
-	}
-
-	err = c.GetClient().VM.SetNameDescription(c.GetSessionRef(), instance, config.VMDescription)
-	if err != nil {
-		ui.Error(fmt.Sprintf("Error setting VM description: %s", err.Error()))
-		return multistep.ActionHalt
-	}
-
-	if len(config.VMOtherConfig) != 0 {
-		vm_other_config, err := c.GetClient().VM.GetOtherConfig(c.GetSessionRef(), instance)
-		if err != nil {
-			ui.Error(fmt.Sprintf("Error getting VM other-config: %s", err.Error()))
-			return multistep.ActionHalt
-		}
-		for key, value := range config.VMOtherConfig {
-			vm_other_config[key] = value
-		}
-		err = c.GetClient().VM.SetOtherConfig(c.GetSessionRef(), instance, vm_other_config)
-		if err != nil {
-			ui.Error(fmt.Sprintf("Error setting VM other-config: %s", err.Error()))
-			return multistep.ActionHalt
-		}
-	}
-
 	if !self.AssumePreInstalledOS {
-		err = c.GetClient().VM.RemoveFromOtherConfig(c.GetSessionRef(), instance, "disks")
+		err = c.RemoveFromVMOtherConfig(ctx, instance, "disks")
 		if err != nil {
 			ui.Error(fmt.Sprintf("Error removing disks from VM other-config: %s", err.Error()))
 			return multistep.ActionHalt
 		}
 
 		// Create VDIs for each disk configuration
-		self.vdis = make([]*xsclient.VDIRef, 0)
-		
 		for diskIdx, disk := range config.Disks {
-			sr, err := config.GetSR(c)
+			sr, err := config.GetDiskSR(ctx, c, disk)
 			if err != nil {
 				ui.Error(fmt.Sprintf("Unable to get SR for disk %d: %s", diskIdx, err.Error()))
 				return multistep.ActionHalt
@@ -134,95 +101,173 @@ func (self *StepCreateInstance) Run(ctx context.Context, state multistep.StateBa
 
 			ui.Say(fmt.Sprintf("Creating disk %d (%s) with size %d MB using SR: %s", diskIdx, disk.Name, disk.Size, sr))
 
-			vdi, err := c.GetClient().VDI.Create(c.GetSessionRef(), xenapi.VDIRecord{
-				NameLabel:   disk.Name,
-				VirtualSize: int(disk.Size * 1024 * 1024),
-				Type:        "user",
-				Sharable:    false,
-				ReadOnly:    false,
-				SR:          sr,
-				OtherConfig: map[string]string{
-					"temp": "temp",
-				},
-			})
+			vdi, err := c.CreateVDI(ctx, disk.VDIRecord(sr))
 			if err != nil {
 				ui.Error(fmt.Sprintf("Unable to create disk %d VDI: %s", diskIdx, err.Error()))
 				return multistep.ActionHalt
 			}
 			self.vdis = append(self.vdis, &vdi)
 
-			err = ConnectVdi(c, instance, vdi, xsclient.VbdTypeDisk)
+			vbd, err := c.CreateVBD(ctx, disk.VBDRecord(instance, vdi))
 			if err != nil {
 				ui.Error(fmt.Sprintf("Unable to connect disk %d VDI: %s", diskIdx, err.Error()))
 				return multistep.ActionHalt
 			}
+			log.Printf("Created VBD '%s'", vbd)
 		}
 	}
 
-	// Connect Network
+	instanceId, err := c.GetVMUUID(ctx, instance)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to get VM UUID: %s", err.Error()))
+		return multistep.ActionHalt
+	}
 
-	var network xsclient.NetworkRef
+	state.Put("instance_uuid", instanceId)
+	ui.Say(fmt.Sprintf("Created instance '%s'", instanceId))
 
-	if len(config.NetworkNames) == 0 {
-		// No network has be specified. Use the management interface
-		log.Println("No network name given, attempting to use management interface")
-		pifs, err := c.GetClient().PIF.GetAll(c.GetSessionRef())
+	return multistep.ActionContinue
+}
+
+func (self *StepCreateInstance) Cleanup(state multistep.StateBag) {
+	config := state.Get("config").(Config)
+	if config.ShouldKeepVM(state) {
+		return
+	}
 
+	ui := state.Get("ui").(packer.Ui)
+	c := state.Get("client").(Client)
+
+	ctx := context.Background()
+
+	if self.instance != nil {
+		ui.Say("Destroying VM")
+		_ = c.HardShutdownVM(ctx, *self.instance) // redundant, just in case
+		err := c.DestroyVM(ctx, *self.instance)
 		if err != nil {
-			ui.Error(fmt.Sprintf("Error getting PIFs: %s", err.Error()))
-			return multistep.ActionHalt
+			ui.Error(err.Error())
 		}
+	}
 
-		for _, pif := range pifs {
-			pif_rec, err := c.GetClient().PIF.GetRecord(c.GetSessionRef(), pif)
-
-			if err != nil {
-				ui.Error(fmt.Sprintf("Error getting PIF record: %s", err.Error()))
-				return multistep.ActionHalt
+	// Destroy all created VDIs
+	if len(self.vdis) > 0 {
+		for i, vdi := range self.vdis {
+			if vdi != nil {
+				ui.Say(fmt.Sprintf("Destroying VDI %d", i))
+				err := c.DestroyVDI(ctx, *vdi)
+				if err != nil {
+					ui.Error(err.Error())
+				}
 			}
+		}
+	}
+}
 
-			if pif_rec.Management {
-				network = pif_rec.Network
-			}
+// ConfigureInstance applies the VM settings of the config to a VM that has
+// been cloned from a template or imported: vCPUs, memory, platform,
+// description, other-config, networks and tags.
+func ConfigureInstance(ctx context.Context, c Client, ui packer.Ui, instance xsclient.VMRef, config Config) error {
+	var err error
 
+	// vCPUs and memory left at zero are kept as they are
+	if config.VCPUsMax != 0 || config.VCPUsAtStartup != 0 {
+		if err := configureVCPUs(ctx, c, instance, int(config.VCPUsMax), int(config.VCPUsAtStartup)); err != nil {
+			return err
 		}
+	}
 
-		if string(network) == "" {
-			ui.Error("Error: couldn't find management network. Aborting.")
-			return multistep.ActionHalt
+	if config.VMMemory != 0 {
+		memory := int(config.VMMemory * 1024 * 1024)
+		err = c.SetVMMemoryLimits(ctx, instance, memory, memory, memory, memory)
+		if err != nil {
+			return fmt.Errorf("Error setting VM memory=%d: %s", memory, err.Error())
 		}
+	}
 
-		log.Printf("Creating VIF on network '%s' on VM '%s'\n", network, instance)
-		_, err = ConnectNetwork(c, network, instance, "0")
+	// If user didn't set platform args, use existing ones from the template
+	platformArgs := config.PlatformArgs
+	if len(platformArgs) == 0 {
+		platformArgs, err = c.GetVMPlatform(ctx, instance)
+		if err != nil {
+			return fmt.Errorf("Error getting VM platform: %s", err.Error())
+		}
+		ui.Say(fmt.Sprintf("Using existing platform args: %v", platformArgs))
+	}
+	// Always call SetPlatform to ensure the cloned VM's platform is explicitly configured
+	err = c.SetVMPlatform(ctx, instance, platformArgs)
+	if err != nil {
+		return fmt.Errorf("Error setting VM platform: %s", err.Error())
+	}
+
+	err = c.SetVMNameDescription(ctx, instance, config.VMDescription)
+	if err != nil {
+		return fmt.Errorf("Error setting VM description: %s", err.Error())
+	}
 
+	if len(config.VMOtherConfig) != 0 {
+		vm_other_config, err := c.GetVMOtherConfig(ctx, instance)
 		if err != nil {
-			ui.Error(fmt.Sprintf("Failed to create VIF with error: %v", err))
-			return multistep.ActionHalt
+			return fmt.Errorf("Error getting VM other-config: %s", err.Error())
+		}
+		for key, value := range config.VMOtherConfig {
+			vm_other_config[key] = value
+		}
+		err = c.SetVMOtherConfig(ctx, instance, vm_other_config)
+		if err != nil {
+			return fmt.Errorf("Error setting VM other-config: %s", err.Error())
+		}
+	}
+
+	// Connect Network
+
+	vifs, err := c.GetVMVIFs(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("Error getting VM VIFs: %s", err.Error())
+	}
+
+	if len(config.NetworkNames) == 0 {
+		// Keep the networks an imported VM or a template came with
+		if len(vifs) > 0 {
+			log.Printf("No network name given, keeping the %d VIF(s) of VM '%s'", len(vifs), instance)
+		} else {
+			// No network has be specified. Use the management interface
+			log.Println("No network name given, attempting to use management interface")
+			network, err := c.GetManagementNetwork(ctx)
+			if err != nil {
+				return fmt.Errorf("Error getting the management network: %s", err.Error())
+			}
+
+			if string(network) == "" {
+				return errors.New("Error: couldn't find management network. Aborting.")
+			}
+
+			log.Printf("Creating VIF on network '%s' on VM '%s'\n", network, instance)
+			_, err = ConnectNetwork(ctx, c, network, instance, "0")
+
+			if err != nil {
+				return fmt.Errorf("Failed to create VIF with error: %v", err)
+			}
 		}
 
 	} else {
+		// The given networks replace any the VM came with
+		for _, vif := range vifs {
+			if err := c.DestroyVIF(ctx, vif); err != nil {
+				return fmt.Errorf("Destroy vif fail: '%s': %s", vif, err.Error())
+			}
+		}
+
 		log.Printf("Using provided network names: %v\n", config.NetworkNames)
 		// Look up each network by it's name label
 		for i, networkNameLabel := range config.NetworkNames {
-			networks, err := c.GetClient().Network.GetByNameLabel(c.GetSessionRef(), networkNameLabel)
-
+			network, err := findNetwork(ctx, c, networkNameLabel)
 			if err != nil {
-				ui.Error(fmt.Sprintf("Error occured getting Network by name-label: %s", err.Error()))
-				return multistep.ActionHalt
-			}
-
-			switch {
-			case len(networks) == 0:
-				ui.Error(fmt.Sprintf("Couldn't find a network with the specified name-label '%s'. Aborting.", networkNameLabel))
-				return multistep.ActionHalt
-			case len(networks) > 1:
-				ui.Error(fmt.Sprintf("Found more than one network with the name '%s'. The name must be unique. Aborting.", networkNameLabel))
-				return multistep.ActionHalt
+				return fmt.Errorf("Error looking up network: %s", err.Error())
 			}
 
 			//we need the VIF index string
 			vifIndexString := fmt.Sprintf("%d", i)
-			_, err = ConnectNetwork(c, networks[0], instance, vifIndexString)
+			_, err = ConnectNetwork(ctx, c, network, instance, vifIndexString)
 
 			if err != nil {
 				ui.Say(fmt.Sprintf("Failed to connect VIF with error: %v", err.Error()))
@@ -230,52 +275,62 @@ func (self *StepCreateInstance) Run(ctx context.Context, state multistep.StateBa
 		}
 	}
 
-	err = AddVMTags(c, instance, config.VMTags)
+	err = AddVMTags(ctx, c, instance, config.VMTags)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Failed to add tags: %s", err.Error()))
-		return multistep.ActionHalt
-	}
-
-	instanceId, err := c.GetClient().VM.GetUUID(c.GetSessionRef(), instance)
-	if err != nil {
-		ui.Error(fmt.Sprintf("Unable to get VM UUID: %s", err.Error()))
-		return multistep.ActionHalt
+		return fmt.Errorf("Failed to add tags: %s", err.Error())
 	}
 
-	state.Put("instance_uuid", instanceId)
-	ui.Say(fmt.Sprintf("Created instance '%s'", instanceId))
-
-	return multistep.ActionContinue
+	return nil
 }
 
-func (self *StepCreateInstance) Cleanup(state multistep.StateBag) {
-	config := state.Get("config").(Config)
-	if config.ShouldKeepVM(state) {
-		return
+// configureVCPUs sets the maximum and startup vCPUs of the VM, keeping its
+// own where they are zero. XAPI never lets the vCPUs at startup exceed the
+// maximum, so the one left unset follows the other where it has to, and the
+// startup vCPUs are lowered before the maximum is and raised after it is.
+func configureVCPUs(ctx context.Context, c Client, instance xsclient.VMRef, vcpusMax, vcpusAtStartup int) error {
+	currentMax, err := c.GetVMVCPUsMax(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("Error getting VM VCPUs Max: %s", err.Error())
+	}
+	currentAtStartup, err := c.GetVMVCPUsAtStartup(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("Error getting VM VCPUs At Startup: %s", err.Error())
 	}
 
-	ui := state.Get("ui").(packer.Ui)
-	c := state.Get("client").(*Connection)
+	switch {
+	case vcpusMax == 0:
+		vcpusMax = max(currentMax, vcpusAtStartup)
+	case vcpusAtStartup == 0:
+		vcpusAtStartup = min(currentAtStartup, vcpusMax)
+	}
 
-	if self.instance != nil {
-		ui.Say("Destroying VM")
-		_ = c.GetClient().VM.HardShutdown(c.GetSessionRef(), *self.instance) // redundant, just in case
-		err := c.GetClient().VM.Destroy(c.GetSessionRef(), *self.instance)
-		if err != nil {
-			ui.Error(err.Error())
+	setMax := func() error {
+		if vcpusMax == currentMax {
+			return nil
+		}
+		if err := c.SetVMVCPUsMax(ctx, instance, vcpusMax); err != nil {
+			return fmt.Errorf("Error setting VM VCPUs Max=%d: %s", vcpusMax, err.Error())
+		}
+		return nil
+	}
+	setAtStartup := func() error {
+		if vcpusAtStartup == currentAtStartup {
+			return nil
 		}
+		if err := c.SetVMVCPUsAtStartup(ctx, instance, vcpusAtStartup); err != nil {
+			return fmt.Errorf("Error setting VM VCPUs At Startup=%d: %s", vcpusAtStartup, err.Error())
+		}
+		return nil
 	}
 
-	// Destroy all created VDIs
-	if len(self.vdis) > 0 {
-		for i, vdi := range self.vdis {
-			if vdi != nil {
-				ui.Say(fmt.Sprintf("Destroying VDI %d", i))
-				err := c.GetClient().VDI.Destroy(c.GetSessionRef(), *vdi)
-				if err != nil {
-					ui.Error(err.Error())
-				}
-			}
+	if vcpusAtStartup < currentAtStartup {
+		if err := setAtStartup(); err != nil {
+			return err
 		}
+		return setMax()
+	}
+	if err := setMax(); err != nil {
+		return err
 	}
+	return setAtStartup()
 }
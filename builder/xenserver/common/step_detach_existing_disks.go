@@ -0,0 +1,57 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// StepDetachExistingDisks detaches the existing_disks that are not to be
+// kept in the final template, destroying those that were cloned.
+type StepDetachExistingDisks struct{}
+
+func (self *StepDetachExistingDisks) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	c := state.Get("client").(Client)
+
+	disks, ok := state.GetOk("existing_disks")
+	if !ok {
+		return multistep.ActionContinue
+	}
+
+	uuid := state.Get("instance_uuid").(string)
+	instance, err := c.GetVMByUUID(ctx, uuid)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to get VM from UUID '%s': %s", uuid, err.Error()))
+		return multistep.ActionHalt
+	}
+
+	for _, disk := range disks.([]*existingDisk) {
+		if disk.config.Keep || !disk.attached {
+			continue
+		}
+
+		err := DisconnectVdi(ctx, c, instance, disk.vdi)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Unable to detach existing disk '%s': %s", disk.config.VDI, err.Error()))
+			continue
+		}
+		disk.attached = false
+		log.Printf("Detached existing disk '%s'", disk.config.VDI)
+
+		if disk.clone {
+			if err := c.DestroyVDI(ctx, disk.vdi); err != nil {
+				ui.Error(fmt.Sprintf("Unable to destroy the clone of '%s': %s", disk.config.VDI, err.Error()))
+				continue
+			}
+			disk.clone = false
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (self *StepDetachExistingDisks) Cleanup(state multistep.StateBag) {}
@@ -2,132 +2,61 @@ package common
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	xenapi "github.com/terra-farm/go-xen-api-client"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskformat"
 )
 
 type StepExport struct{}
 
-func downloadFile(url, filename string, ui packer.Ui) (err error) {
-
-	// Create the file
-	fh, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer fh.Close()
-
-	// Define a new transport which allows self-signed certs
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	// Create a client
-	client := &http.Client{Transport: tr}
-
-	// Create request and download file
-
-	resp, err := client.Get(url)
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	var progress uint
-	var total uint
-	var percentage uint
-	var marker_len uint
-
-	progress = uint(0)
-	total = uint(resp.ContentLength)
-	percentage = uint(0)
-	marker_len = uint(5)
-
-	var buffer [4096]byte
-	for {
-		n, err := resp.Body.Read(buffer[:])
-		if err != nil && err != io.EOF {
-			return err
-		}
-
-		progress += uint(n)
-
-		if _, write_err := fh.Write(buffer[:n]); write_err != nil {
-			return write_err
-		}
-
-		if err == io.EOF {
-			break
-		}
-
-		// Increment percentage in multiples of marker_len
-		cur_percentage := ((progress * 100 / total) / marker_len) * marker_len
-		if cur_percentage > percentage {
-			percentage = cur_percentage
-			ui.Message(fmt.Sprintf("Downloading... %d%%", percentage))
-		}
-
-	}
-
-	return nil
-}
-
 func (StepExport) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
 	c := state.Get("client").(*Connection)
 	instance_uuid := state.Get("instance_uuid").(string)
-	suffix := ".vhd"
-	extrauri := "&format=vhd"
 
-	instance, err := c.client.VM.GetByUUID(c.session, instance_uuid)
+	instance, err := c.GetVMByUUID(ctx, instance_uuid)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Could not get VM with UUID '%s': %s", instance_uuid, err.Error()))
 		return multistep.ActionHalt
 	}
 
 	if len(config.ExportNetworkNames) > 0 {
-		vifs, err := c.client.VM.GetVIFs(c.session, instance)
+		vifs, err := c.GetVMVIFs(ctx, instance)
 		if err != nil {
 			ui.Error(fmt.Sprintf("Error occured getting VIFs: %s", err.Error()))
 			return multistep.ActionHalt
 		}
 
 		for _, vif := range vifs {
-			err := c.client.VIF.Destroy(c.session, vif)
+			err := c.DestroyVIF(ctx, vif)
 			if err != nil {
 				ui.Error(fmt.Sprintf("Destroy vif fail: '%s': %s", vif, err.Error()))
 				return multistep.ActionHalt
 			}
 		}
 		for i, networkNameLabel := range config.ExportNetworkNames {
-			networks, err := c.client.Network.GetByNameLabel(c.session, networkNameLabel)
-
+			network, err := findNetwork(ctx, c, networkNameLabel)
 			if err != nil {
-				ui.Error(fmt.Sprintf("Error occured getting Network by name-label: %s", err.Error()))
-				return multistep.ActionHalt
-			}
-
-			switch {
-			case len(networks) == 0:
-				ui.Error(fmt.Sprintf("Couldn't find a network with the specified name-label '%s'. Aborting.", networkNameLabel))
-				return multistep.ActionHalt
-			case len(networks) > 1:
-				ui.Error(fmt.Sprintf("Found more than one network with the name '%s'. The name must be unique. Aborting.", networkNameLabel))
+				ui.Error(fmt.Sprintf("Error looking up network: %s", err.Error()))
 				return multistep.ActionHalt
 			}
 
 			//we need the VIF index string
 			vifIndexString := fmt.Sprintf("%d", i)
-			_, err = ConnectNetwork(c, networks[0], instance, vifIndexString)
+			_, err = ConnectNetwork(ctx, c, network, instance, vifIndexString)
 
 			if err != nil {
 				ui.Say(err.Error())
@@ -137,13 +66,36 @@ func (StepExport) Run(ctx context.Context, state multistep.StateBag) multistep.S
 
 	ui.Say("Step: export artifact")
 
+	if len(config.Formats) == 1 && config.Formats[0] == "none" {
+		ui.Say("Skipping export")
+		return multistep.ActionContinue
+	}
+
+	// Every format is exported from the same halted VM, one after the other
+	for _, format := range config.Formats {
+		if len(config.Formats) > 1 {
+			ui.Say("Exporting " + format)
+		}
+		if err := export(ctx, c, config, instance, instance_uuid, format, ui); err != nil {
+			ui.Error(err.Error())
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+	}
+
+	ui.Say("Download completed: " + config.OutputDir)
+
+	return multistep.ActionContinue
+}
+
+// export exports the VM in the given format to output_directory.
+func export(ctx context.Context, c *Connection, config CommonConfig, instance xenapi.VMRef, instance_uuid, format string, ui packer.Ui) error {
 	compress_option_xe := "compress=false"
 	compress_option_url := ""
 
-	switch config.Format {
+	switch format {
 	case "none":
-		ui.Say("Skipping export")
-		return multistep.ActionContinue
+		return nil
 
 	case "xva_compressed":
 		compress_option_xe = "compress=true"
@@ -154,11 +106,12 @@ func (StepExport) Run(ctx context.Context, state multistep.StateBag) multistep.S
 
 		export_filename := fmt.Sprintf("%s/%s.xva", config.OutputDir, config.VMName)
 
+		var err error
 		use_xe := os.Getenv("USE_XE") == "1"
-		if xe, e := exec.LookPath("xe"); e == nil && use_xe {
+		if xe, e := exec.LookPath("xe"); e == nil && use_xe && c.Password != "" {
 			cmd := exec.Command(
 				xe,
-				"-s", c.Host,
+				"-s", c.GetHost(),
 				"-p", "443",
 				"-u", c.Username,
 				"-pw", c.Password,
@@ -171,108 +124,236 @@ func (StepExport) Run(ctx context.Context, state multistep.StateBag) multistep.S
 			ui.Say(fmt.Sprintf("Getting XVA %+v %+v", cmd.Path, cmd.Args))
 
 			err = cmd.Run()
+			if err == nil {
+				err = checksumFile(export_filename)
+			}
 		} else {
 			export_url := fmt.Sprintf("https://%s/export?%suuid=%s&session_id=%s",
-				c.Host,
+				c.GetHost(),
 				compress_option_url,
 				instance_uuid,
 				c.GetSession(),
 			)
 
 			ui.Say("Getting XVA " + export_url)
-			err = downloadFile(export_url, export_filename, ui)
+			err = downloadFile(ctx, c.HTTPClient(), export_url, export_filename, 0, newDownloadProgress(ui))
 		}
 
 		if err != nil {
-			ui.Error(fmt.Sprintf("Could not download XVA: %s", err.Error()))
-			return multistep.ActionHalt
+			return fmt.Errorf("Could not download XVA: %s", err.Error())
 		}
 
-	case "vdi_raw":
-		suffix = ".raw"
-		extrauri = ""
-		fallthrough
-	case "vdi_vhd":
-		// export the disks
+	case "vdi_raw", "vdi_vhd", "vdi_qcow2", "vdi_vmdk":
+		diskFormat := diskformat.Format(strings.TrimPrefix(format, "vdi_"))
+		if _, err := exportDisks(ctx, c, config, instance, diskFormat, config.OutputDir, ui); err != nil {
+			return fmt.Errorf("Could not download VDI: %s", err.Error())
+		}
 
-		disks, err := GetDisks(c, instance)
-		if err != nil {
-			ui.Error(fmt.Sprintf("Could not get VM disks: %s", err.Error()))
-			return multistep.ActionHalt
+	case "ova", "ovf":
+		if err := exportOVF(ctx, c, config, instance, format == "ova", ui); err != nil {
+			return fmt.Errorf("Could not export %s: %s", strings.ToUpper(format), err.Error())
 		}
-		for _, disk := range disks {
-			disk_uuid, err := c.client.VDI.GetUUID(c.session, disk)
-			if err != nil {
-				ui.Error(fmt.Sprintf("Could not get disk with UUID '%s': %s", disk_uuid, err.Error()))
-				return multistep.ActionHalt
-			}
 
-			// Work out XenServer version
-			hosts, err := c.client.Host.GetAll(c.session)
+	default:
+		panic(fmt.Sprintf("Unknown export format '%s'", format))
+	}
 
-			if err != nil {
-				ui.Error(fmt.Sprintf("Could not retrieve hosts in the pool: %s", err.Error()))
-				return multistep.ActionHalt
-			}
-			host := hosts[0]
-			host_software_versions, err := c.client.Host.GetSoftwareVersion(c.session, host)
-			xs_version := host_software_versions["product_version"]
+	return nil
+}
 
-			if err != nil {
-				ui.Error(fmt.Sprintf("Could not get the software version: %s", err.Error()))
-				return multistep.ActionHalt
-			}
+func (StepExport) Cleanup(state multistep.StateBag) {}
 
-			var disk_export_url string
+// exportedDisk is a disk of the VM to export.
+type exportedDisk struct {
+	vdi        xenapi.VDIRef
+	uuid       string
+	userdevice string
+	nameLabel  string
+	size       int64
 
-			// @todo: check for 6.5 SP1
-			if xs_version <= "6.5.0" && config.Format == "vdi_vhd" {
-				// Export the VHD using a Transfer VM
+	// file is the file the disk is exported to.
+	file string
+}
 
-				disk_export_url, err = Expose(c, disk, "vhd")
+// unsafeFilenameChars are the characters of name-labels replaced in the
+// names of exported disks.
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// filename returns the name of the file the disk is exported to, such as
+// "centos-0-Packer-disk.vhd": the VM name, the position of the disk and its
+// name-label, so that the files are named the same from one build to the
+// next and sort in the order of the disks.
+func (d exportedDisk) filename(vmName, suffix string) string {
+	name := unsafeFilenameChars.ReplaceAllString(vmName, "_") + "-" + d.userdevice
+	if label := unsafeFilenameChars.ReplaceAllString(d.nameLabel, "_"); label != "" {
+		name += "-" + label
+	}
+	return name + suffix
+}
 
-				if err != nil {
-					ui.Error(fmt.Sprintf("Failed to expose disk %s: %s", disk_uuid, err.Error()))
-					return multistep.ActionHalt
-				}
+// getExportDisks returns the disks of a VM, leaving out CD drives, ordered
+// by their userdevice.
+func getExportDisks(ctx context.Context, c Client, vmRef xenapi.VMRef) ([]exportedDisk, error) {
+	vbds, err := c.GetVMVBDs(ctx, vmRef)
+	if err != nil {
+		return nil, err
+	}
 
-			} else {
+	disks := make([]exportedDisk, 0)
+	for _, vbd := range vbds {
+		vbdType, err := c.GetVBDType(ctx, vbd)
+		if err != nil {
+			return nil, err
+		}
+		if vbdType != xenapi.VbdTypeDisk {
+			continue
+		}
 
-				// Use the preferred direct export from XAPI
-				// Basic auth in URL request is required as session token is not
-				// accepted for some reason.
-				// @todo: raise with XAPI team.
-				disk_export_url = fmt.Sprintf("https://%s:%s@%s/export_raw_vdi?vdi=%s%s",
-					c.Username,
-					c.Password,
-					c.Host,
-					disk_uuid,
-					extrauri)
+		var disk exportedDisk
+		if disk.vdi, err = c.GetVBDVDI(ctx, vbd); err != nil {
+			return nil, err
+		}
+		if disk.userdevice, err = c.GetVBDUserdevice(ctx, vbd); err != nil {
+			return nil, err
+		}
+		if disk.uuid, err = c.GetVDIUUID(ctx, disk.vdi); err != nil {
+			return nil, err
+		}
+		if disk.nameLabel, err = c.GetVDINameLabel(ctx, disk.vdi); err != nil {
+			return nil, err
+		}
+		size, err := c.GetVDIVirtualSize(ctx, disk.vdi)
+		if err != nil {
+			return nil, err
+		}
+		disk.size = int64(size)
+		disks = append(disks, disk)
+	}
 
-			}
+	sort.SliceStable(disks, func(i, j int) bool {
+		a, errA := strconv.Atoi(disks[i].userdevice)
+		b, errB := strconv.Atoi(disks[j].userdevice)
+		if errA != nil || errB != nil {
+			return disks[i].userdevice < disks[j].userdevice
+		}
+		return a < b
+	})
+	return disks, nil
+}
 
-			disk_export_filename := fmt.Sprintf("%s/%s%s", config.OutputDir, disk_uuid, suffix)
+// exportDisks downloads the disks of a VM to dir, as images of the given
+// format, export_parallelism of them at a time. It returns the disks with
+// the files they were downloaded to.
+func exportDisks(ctx context.Context, c *Connection, config CommonConfig, instance xenapi.VMRef, format diskformat.Format, dir string, ui packer.Ui) ([]exportedDisk, error) {
+	disks, err := getExportDisks(ctx, c, instance)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get VM disks: %s", err.Error())
+	}
 
-			ui.Say("Getting VDI " + disk_export_url)
-			err = downloadFile(disk_export_url, disk_export_filename, ui)
-			if err != nil {
-				ui.Error(fmt.Sprintf("Could not download VDI: %s", err.Error()))
-				return multistep.ActionHalt
-			}
+	// Work out XenServer version
+	hosts, err := c.GetAllHosts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve hosts in the pool: %s", err.Error())
+	}
+	host_software_versions, err := c.GetHostSoftwareVersion(ctx, hosts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Could not get the software version: %s", err.Error())
+	}
+	xs_version := host_software_versions["product_version"]
+
+	// @todo: check for 6.5 SP1
+	use_tvm := xs_version <= "6.5.0" && format == diskformat.VHD
 
-			// Call unexpose in case a TVM was used. The call is harmless
-			// if that is not the case.
-			Unexpose(c, disk)
+	extrauri := ""
+	if format == diskformat.VHD {
+		extrauri = "&format=vhd"
+	}
+	// export_raw_vdi only exports raw and VHD disks, so the others are
+	// converted from raw as they are downloaded
+	var convert diskformat.Format
+	if !format.Importable() {
+		convert = format
+	}
 
+	exportCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := newDownloadProgress(ui)
+	sem := make(chan struct{}, max(config.ExportParallelism, 1))
+	errs := make([]error, len(disks))
+	var wg sync.WaitGroup
+	for i := range disks {
+		// Start the downloads in the order of the disks
+		sem <- struct{}{}
+		if exportCtx.Err() != nil {
+			break
 		}
+		disks[i].file = filepath.Join(dir, disks[i].filename(config.VMName, "."+string(format)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			errs[i] = exportDisk(exportCtx, c, disks[i], use_tvm, extrauri, convert, ui, progress)
+			if errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
 
-	default:
-		panic(fmt.Sprintf("Unknown export format '%s'", config.Format))
+	for _, err := range errs {
+		// Downloads cancelled because another failed are not the cause
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return disks, nil
+}
 
-	ui.Say("Download completed: " + config.OutputDir)
+// exportDisk downloads a disk to its file, through a Transfer VM if use_tvm
+// is set and with export_raw_vdi otherwise. The disk is converted to
+// convert unless it is empty.
+func exportDisk(ctx context.Context, c *Connection, disk exportedDisk, use_tvm bool, extrauri string, convert diskformat.Format, ui packer.Ui, progress *downloadProgress) error {
+	var disk_export_url string
 
-	return multistep.ActionContinue
-}
+	if use_tvm {
+		// Export the VHD using a Transfer VM
+		var err error
+		disk_export_url, err = Expose(ctx, c, disk.vdi, "vhd")
+		if err != nil {
+			return fmt.Errorf("Failed to expose disk %s: %s", disk.uuid, err.Error())
+		}
 
-func (StepExport) Cleanup(state multistep.StateBag) {}
+		// Call unexpose in case a TVM was used.
+		defer Unexpose(context.Background(), c, disk.vdi)
+	} else if c.Password != "" {
+		// Use the preferred direct export from XAPI
+		// Basic auth in URL request is required as session token is not
+		// accepted for some reason.
+		// @todo: raise with XAPI team.
+		disk_export_url = fmt.Sprintf("https://%s:%s@%s/export_raw_vdi?vdi=%s%s",
+			c.Username,
+			c.Password,
+			c.GetHost(),
+			disk.uuid,
+			extrauri)
+	} else {
+		// Without a password, as when building with remote_session_id,
+		// the session is all there is to try.
+		disk_export_url = fmt.Sprintf("https://%s/export_raw_vdi?session_id=%s&vdi=%s%s",
+			c.GetHost(),
+			c.GetSession(),
+			disk.uuid,
+			extrauri)
+	}
+
+	ui.Say(fmt.Sprintf("Getting VDI %s as %s", disk.uuid, filepath.Base(disk.file)))
+	if convert != "" {
+		return downloadDisk(ctx, c.HTTPClient(), disk_export_url, disk.file, convert, disk.size, progress)
+	}
+	return downloadFile(ctx, c.HTTPClient(), disk_export_url, disk.file, disk.size, progress)
+}
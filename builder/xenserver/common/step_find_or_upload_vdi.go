@@ -6,6 +6,7 @@ import (
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	xenapi "github.com/terra-farm/go-xen-api-client"
 )
 
 type StepFindOrUploadVdi struct {
@@ -14,31 +15,47 @@ type StepFindOrUploadVdi struct {
 
 func (self *StepFindOrUploadVdi) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 	vdiName := self.VdiNameFunc()
 
 	ui.Say(fmt.Sprintf("Attemping to find VDI '%s'", vdiName))
 
-	vdis, err := c.client.VDI.GetByNameLabel(c.session, vdiName)
+	if uuidPattern.MatchString(vdiName) {
+		vdi, err := c.GetVDIByUUID(ctx, vdiName)
+		switch {
+		case err == nil:
+			return self.useVdi(ctx, state, vdi, vdiName)
+		case xapiErrorCode(err) != xenapi.ERR_UUID_INVALID:
+			ui.Error(fmt.Sprintf("Failed to find VDI '%s' by UUID: %s", vdiName, err.Error()))
+			return multistep.ActionHalt
+		}
+	}
+
+	vdis, err := c.GetVDIByNameLabel(ctx, vdiName)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Failed to find VDI '%s' by name label: %s", vdiName, err.Error()))
 		return multistep.ActionHalt
 	}
 
 	if len(vdis) > 1 {
-		ui.Error(fmt.Sprintf("Found more than one VDI with name '%s'. Name must be unique", vdiName))
+		ui.Error(fmt.Sprintf("Found %d VDIs with the name '%s'. Use the UUID of one of them instead", len(vdis), vdiName))
 		return multistep.ActionHalt
 	} else if len(vdis) == 1 {
+		return self.useVdi(ctx, state, vdis[0], vdiName)
+	}
+	return self.uploadVdi(ctx, state)
+}
 
-		vdi := vdis[0]
+// useVdi records the existing VDI found in place of an upload.
+func (self *StepFindOrUploadVdi) useVdi(ctx context.Context, state multistep.StateBag, vdi xenapi.VDIRef, vdiName string) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	c := state.Get("client").(Client)
 
-		vdiUuid, err := c.client.VDI.GetUUID(c.session, vdi)
-		if err != nil {
-			ui.Error(fmt.Sprintf("Unable to get UUID of VDI '%s': %s", vdiName, err.Error()))
-			return multistep.ActionHalt
-		}
-		state.Put(self.VdiUuidKey, vdiUuid)
-		return multistep.ActionContinue
+	vdiUuid, err := c.GetVDIUUID(ctx, vdi)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to get UUID of VDI '%s': %s", vdiName, err.Error()))
+		return multistep.ActionHalt
 	}
-	return self.uploadVdi(ctx, state)
+	state.Put(self.VdiUuidKey, vdiUuid)
+	return multistep.ActionContinue
 }
@@ -16,27 +16,20 @@ type StepFindVdi struct {
 
 func (self *StepFindVdi) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 
 	// Ignore if VdiName is not specified
 	if self.VdiName == "" {
 		return multistep.ActionContinue
 	}
 
-	vdis, err := c.client.VDI.GetByNameLabel(c.session, self.VdiName)
-
-	switch {
-	case len(vdis) == 0:
-		ui.Error(fmt.Sprintf("Couldn't find a VDI named '%s'", self.VdiName))
-		return multistep.ActionHalt
-	case len(vdis) > 1:
-		ui.Error(fmt.Sprintf("Found more than one VDI with name '%s'. Name must be unique", self.VdiName))
+	vdi, err := findVDI(ctx, c, self.VdiName)
+	if err != nil {
+		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	vdi := vdis[0]
-
-	vdiUuid, err := c.client.VDI.GetUUID(c.session, vdi)
+	vdiUuid, err := c.GetVDIUUID(ctx, vdi)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get UUID of VDI '%s': %s", self.VdiName, err.Error()))
 		return multistep.ActionHalt
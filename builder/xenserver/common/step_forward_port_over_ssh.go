@@ -23,6 +23,16 @@ func (self *StepForwardPortOverSSH) Run(ctx context.Context, state multistep.Sta
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
 
+	if err := config.hostSSHCredentials(); err != nil {
+		if config.Comm.Type == "none" {
+			ui.Say(fmt.Sprintf("Skipping the local port forward over SSH: %s", err.Error()))
+			return multistep.ActionContinue
+		}
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
 	// Find a free local port:
 
 	l, sshHostPort := FindPort(self.HostPortMin, self.HostPortMax)
@@ -28,9 +28,9 @@ func (self *StepGetVmTemplate) Run(ctx context.Context, state multistep.StateBag
 	}
 
 	ui := state.Get("ui").(packer.Ui)
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 	config := state.Get("config").(Config)
-	vmRefs, err := c.client.VM.GetByNameLabel(c.session, config.VMName)
+	vmRefs, err := c.GetVMByNameLabel(ctx, config.VMName)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Failed to get VMs with name '%s': %v", config.VMName, err.Error()))
 		return multistep.ActionHalt
@@ -42,7 +42,7 @@ func (self *StepGetVmTemplate) Run(ctx context.Context, state multistep.StateBag
 
 	// Figure out which VMs with the same name as the current build are templates.
 	for _, vm := range vmRefs {
-		isTemplate, err := c.client.VM.GetIsATemplate(c.session, vm)
+		isTemplate, err := c.GetVMIsATemplate(ctx, vm)
 
 		if err != nil {
 			ui.Error(fmt.Sprintf("Failed to check if existing VM '%s' is a template with error: %v", vm, err.Error()))
@@ -84,7 +84,7 @@ type StepCleanUpTemplate struct {
 
 func (self *StepCleanUpTemplate) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 
 	existing_templates := state.Get("existing_templates")
 
@@ -96,7 +96,8 @@ func (self *StepCleanUpTemplate) Run(ctx context.Context, state multistep.StateB
 		if self.Force {
 			ui.Message(fmt.Sprintf("Deleting %d templates since -force was specified!", len(templates)))
 			for _, template := range templates {
-				if err := c.client.VM.Destroy(c.session, template); err != nil {
+				err := c.DestroyVM(ctx, template)
+				if err != nil {
 					ui.Error(fmt.Sprintf("Failed to destroy template '%s': %v", template, err))
 					return multistep.ActionHalt
 				}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// StepPreflight looks up every XAPI object the config refers to by name, the
+// same way the steps using them do, so that a misspelt or ambiguous name
+// fails the build in seconds rather than after a long ISO download. All the
+// problems found are reported at once.
+type StepPreflight struct{}
+
+func (self *StepPreflight) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(Config)
+	ui := state.Get("ui").(packer.Ui)
+	c := state.Get("client").(Client)
+
+	ui.Say("Step: Preflight checks")
+
+	var problems []string
+	check := func(key string, ref interface{}, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", key, err.Error()))
+			return
+		}
+		log.Printf("Preflight: %s is '%s'", key, ref)
+	}
+
+	if config.CloneTemplate != "" {
+		ref, err := findTemplate(ctx, c, config.CloneTemplate)
+		check("clone_template", ref, err)
+	}
+	for i, name := range config.NetworkNames {
+		ref, err := findNetwork(ctx, c, name)
+		check(fmt.Sprintf("network_names[%d]", i), ref, err)
+	}
+	for i, name := range config.ExportNetworkNames {
+		ref, err := findNetwork(ctx, c, name)
+		check(fmt.Sprintf("export_network_names[%d]", i), ref, err)
+	}
+	if config.ToolsIsoName != "" {
+		ref, err := findVDI(ctx, c, config.ToolsIsoName)
+		check("tools_iso_name", ref, err)
+	}
+	if config.ISOName != "" {
+		ref, err := findVDI(ctx, c, config.ISOName)
+		check("iso_name", ref, err)
+	}
+	if config.SrName != "" {
+		ref, err := config.GetSR(ctx, c)
+		check("sr_name", ref, err)
+	}
+	if config.SrISOName != "" {
+		ref, err := config.GetISOSR(ctx, c)
+		check("sr_iso_name", ref, err)
+	}
+	for i, disk := range config.Disks {
+		if disk.SRName != "" {
+			ref, err := findSR(ctx, c, disk.SRName)
+			check(fmt.Sprintf("disks[%d].sr_name", i), ref, err)
+		}
+	}
+	for i, disk := range config.ExistingDisks {
+		ref, err := findVDI(ctx, c, disk.VDI)
+		check(fmt.Sprintf("existing_disks[%d].vdi", i), ref, err)
+	}
+
+	if len(problems) > 0 {
+		err := fmt.Errorf("Preflight checks found %d problem(s):\n  %s", len(problems), strings.Join(problems, "\n  "))
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (self *StepPreflight) Cleanup(state multistep.StateBag) {}
@@ -12,25 +12,25 @@ type StepSetVmHostSshAddress struct{}
 
 func (self *StepSetVmHostSshAddress) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 	config := state.Get("config").(Config)
 	ui := state.Get("ui").(packer.Ui)
 
 	ui.Say("Step: Set SSH address to VM host IP")
 
 	uuid := state.Get("instance_uuid").(string)
-	instance, err := c.client.VM.GetByUUID(c.session, uuid)
+	instance, err := c.GetVMByUUID(ctx, uuid)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM from UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
 	}
 
-	host, err := c.client.VM.GetResidentOn(c.session, instance)
+	host, err := c.GetVMResidentOn(ctx, instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM Host for VM '%s': %s", uuid, err.Error()))
 	}
 
-	address, err := c.client.Host.GetAddress(c.session, host)
+	address, err := c.GetHostAddress(ctx, host)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get address from VM Host: %s", err.Error()))
 	}
@@ -15,10 +15,10 @@ type StepShutdown struct{}
 func (StepShutdown) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 	instance_uuid := state.Get("instance_uuid").(string)
 
-	instance, err := c.client.VM.GetByUUID(c.session, instance_uuid)
+	instance, err := c.GetVMByUUID(ctx, instance_uuid)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Could not get VM with UUID '%s': %s", instance_uuid, err.Error()))
 		return multistep.ActionHalt
@@ -39,14 +39,9 @@ func (StepShutdown) Run(ctx context.Context, state multistep.StateBag) multistep
 
 			ui.Message("Waiting for VM to enter Halted state...")
 
-			err = InterruptibleWait{
-				Predicate: func() (bool, error) {
-					power_state, err := c.client.VM.GetPowerState(c.session, instance)
-					return power_state == xenapi.VMPowerStateHalted, err
-				},
-				PredicateInterval: 5 * time.Second,
-				Timeout:           300 * time.Second,
-			}.Wait(state)
+			haltCtx, cancel := context.WithTimeout(ctx, 300*time.Second)
+			defer cancel()
+			err = c.WaitForVMPowerState(haltCtx, instance, xenapi.VMPowerStateHalted)
 
 			if err != nil {
 				ui.Error(fmt.Sprintf("Error waiting for VM to halt: %s", err.Error()))
@@ -56,7 +51,7 @@ func (StepShutdown) Run(ctx context.Context, state multistep.StateBag) multistep
 		} else {
 			ui.Message("Attempting to cleanly shutdown the VM...")
 
-			err = c.client.VM.CleanShutdown(c.session, instance)
+			err = c.CleanShutdownVM(ctx, instance)
 			if err != nil {
 				ui.Error(fmt.Sprintf("Could not shut down VM: %s", err.Error()))
 				return false
@@ -68,7 +63,7 @@ func (StepShutdown) Run(ctx context.Context, state multistep.StateBag) multistep
 
 	if !success {
 		ui.Say("WARNING: Forcing hard shutdown of the VM...")
-		err = c.client.VM.HardShutdown(c.session, instance)
+		err = c.HardShutdownVM(ctx, instance)
 		if err != nil {
 			ui.Error(fmt.Sprintf("Could not hard shut down VM -- giving up: %s", err.Error()))
 			return multistep.ActionHalt
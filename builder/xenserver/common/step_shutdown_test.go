@@ -0,0 +1,73 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	xenapi "github.com/terra-farm/go-xen-api-client"
+)
+
+// fakeShutdownClient implements the parts of Client used by StepShutdown;
+// any other call panics on the nil embedded interface.
+type fakeShutdownClient struct {
+	Client
+
+	cleanErr error
+	calls    []string
+}
+
+func (f *fakeShutdownClient) GetVMByUUID(ctx context.Context, uuid string) (xenapi.VMRef, error) {
+	return xenapi.VMRef("OpaqueRef:" + uuid), nil
+}
+
+func (f *fakeShutdownClient) CleanShutdownVM(ctx context.Context, vm xenapi.VMRef) error {
+	f.calls = append(f.calls, "clean_shutdown")
+	return f.cleanErr
+}
+
+func (f *fakeShutdownClient) HardShutdownVM(ctx context.Context, vm xenapi.VMRef) error {
+	f.calls = append(f.calls, "hard_shutdown")
+	return nil
+}
+
+func testShutdownState(c Client) multistep.StateBag {
+	state := new(multistep.BasicStateBag)
+	state.Put("client", c)
+	state.Put("commonconfig", CommonConfig{})
+	state.Put("instance_uuid", "vm-uuid")
+	state.Put("ui", &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      io.Discard,
+		ErrorWriter: io.Discard,
+	})
+	return state
+}
+
+func TestStepShutdown_Clean(t *testing.T) {
+	c := &fakeShutdownClient{}
+
+	action := StepShutdown{}.Run(context.Background(), testShutdownState(c))
+	if action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(c.calls) != 1 || c.calls[0] != "clean_shutdown" {
+		t.Fatalf("bad calls: %v", c.calls)
+	}
+}
+
+func TestStepShutdown_FallsBackToHardShutdown(t *testing.T) {
+	c := &fakeShutdownClient{cleanErr: errors.New("VM_MISSING_PV_DRIVERS")}
+
+	action := StepShutdown{}.Run(context.Background(), testShutdownState(c))
+	if action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if len(c.calls) != 2 || c.calls[1] != "hard_shutdown" {
+		t.Fatalf("bad calls: %v", c.calls)
+	}
+}
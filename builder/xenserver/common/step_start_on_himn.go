@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -20,7 +21,7 @@ type StepStartOnHIMN struct{}
  *
  */
 
-func (self *StepStartOnHIMN) Run(state multistep.StateBag) multistep.StepAction {
+func (self *StepStartOnHIMN) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 
 	ui := state.Get("ui").(packer.Ui)
 	c := state.Get("client").(*Connection)
@@ -28,14 +29,14 @@ func (self *StepStartOnHIMN) Run(state multistep.StateBag) multistep.StepAction
 	ui.Say("Step: Start VM on the Host Internal Mangement Network")
 
 	uuid := state.Get("instance_uuid").(string)
-	instance, err := c.client.VM.GetByUUID(c.session, uuid)
+	instance, err := c.GetVMByUUID(ctx, uuid)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM from UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
 	}
 
 	// Find the HIMN Ref
-	networks, err := c.client.Network.GetByNameLabel(c.session, "Host internal management network")
+	networks, err := c.GetNetworkByNameLabel(ctx, "Host internal management network")
 	if err != nil || len(networks) == 0 {
 		ui.Error("Unable to find a host internal management network")
 		ui.Error(err.Error())
@@ -45,7 +46,7 @@ func (self *StepStartOnHIMN) Run(state multistep.StateBag) multistep.StepAction
 	himn := networks[0]
 
 	// Create a VIF for the HIMN
-	himn_vif, err := ConnectNetwork(c, himn, instance, "0")
+	himn_vif, err := ConnectNetwork(ctx, c, himn, instance, "0")
 	if err != nil {
 		ui.Error("Error creating VIF")
 		ui.Error(err.Error())
@@ -53,33 +54,30 @@ func (self *StepStartOnHIMN) Run(state multistep.StateBag) multistep.StepAction
 	}
 
 	// Start the VM
-	c.client.VM.Start(c.session, instance, false, false)
+	c.StartVM(ctx, instance, false, false)
 
 	var himn_iface_ip string = ""
 
 	// Obtain the allocated IP
-	err = InterruptibleWait{
-		Predicate: func() (found bool, err error) {
-			ips, err := c.client.Network.GetAssignedIps(c.session, himn)
-			if err != nil {
-				return false, fmt.Errorf("Can't get assigned IPs: %s", err.Error())
-			}
-			log.Printf("IPs: %s", ips)
-			log.Printf("Ref: %s", instance)
-
-			//Check for instance.Ref in map
-			if vm_ip, ok := ips[*himn_vif]; ok && vm_ip != "" {
-				ui.Say("Found the VM's IP: " + vm_ip)
-				himn_iface_ip = vm_ip
-				return true, nil
-			}
-
-			ui.Say("Wait for IP address...")
-			return false, nil
-		},
-		PredicateInterval: 10 * time.Second,
-		Timeout:           100 * time.Second,
-	}.Wait(state)
+	ui.Say("Wait for IP address...")
+	ipCtx, cancel := context.WithTimeout(ctx, 100*time.Second)
+	defer cancel()
+	err = c.WatchEvents(ipCtx, []string{"network/" + string(himn)}, func(event Event) (bool, error) {
+		if event.Operation == "del" {
+			return false, fmt.Errorf("The host internal management network was destroyed")
+		}
+		ips, _ := toStruct(event.Snapshot["assigned_ips"])
+		log.Printf("IPs: %s", ips)
+		log.Printf("Ref: %s", instance)
+
+		//Check for instance.Ref in map
+		if vm_ip, ok := ips[string(*himn_vif)].(string); ok && vm_ip != "" {
+			ui.Say("Found the VM's IP: " + vm_ip)
+			himn_iface_ip = vm_ip
+			return true, nil
+		}
+		return false, nil
+	})
 
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to find an IP on the Host-internal management interface: %s", err.Error()))
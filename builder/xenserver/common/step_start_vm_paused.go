@@ -14,40 +14,55 @@ type StepStartVmPaused struct {
 
 func (self *StepStartVmPaused) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 	ui := state.Get("ui").(packer.Ui)
 	config := state.Get("config").(Config)
 
 	ui.Say("Step: Start VM Paused")
 
 	uuid := state.Get("instance_uuid").(string)
-	instance, err := c.client.VM.GetByUUID(c.session, uuid)
+	instance, err := c.GetVMByUUID(ctx, uuid)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM from UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
 	}
 
 	// note that here "cd" means boot from hard drive ('c') first, then CDROM ('d')
-	err = c.client.VM.SetHVMBootPolicy(c.session, instance, "BIOS order")
+	err = c.SetVMHVMBootPolicy(ctx, instance, "BIOS order")
 
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to set HVM boot params: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	err = c.client.VM.SetHVMBootParams(c.session, instance, map[string]string{"order": "cd", "firmware": config.Firmware})
+	bootParams := map[string]string{"order": "cd", "firmware": config.Firmware}
+	if config.Firmware == "" {
+		// Keep the firmware an imported or cloned VM was installed with
+		current, err := c.GetVMHVMBootParams(ctx, instance)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Unable to get HVM boot params: %s", err.Error()))
+			return multistep.ActionHalt
+		}
+		if firmware, ok := current["firmware"]; ok {
+			bootParams["firmware"] = firmware
+		} else {
+			delete(bootParams, "firmware")
+		}
+	}
+
+	err = c.SetVMHVMBootParams(ctx, instance, bootParams)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to set HVM boot params: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	err = c.client.VM.Start(c.session, instance, true, false)
+	err = c.StartVM(ctx, instance, true, false)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to start VM with UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
 	}
 
-	domid, err := c.client.VM.GetDomid(c.session, instance)
+	domid, err := c.GetVMDomid(ctx, instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get domid of VM with UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
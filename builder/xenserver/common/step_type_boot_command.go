@@ -48,7 +48,7 @@ func (step *StepTypeBootCommand) Run(ctx context.Context, state multistep.StateB
 	rawUUID := state.Get("instance_uuid")
 	instanceUUID, ok := rawUUID.(string)
 	if ok && instanceUUID != "" {
-		vmByID, err := c.client.VM.GetByUUID(c.session, instanceUUID)
+		vmByID, err := c.GetVMByUUID(ctx, instanceUUID)
 		if err != nil {
 			ui.Say("Failed to get VM by UUID. Falling back to name based lookup...")
 		} else {
@@ -57,7 +57,7 @@ func (step *StepTypeBootCommand) Run(ctx context.Context, state multistep.StateB
 	}
 
 	if vmRef == "" {
-		vmByName, err := c.client.VM.GetByNameLabel(c.session, config.VMName)
+		vmByName, err := c.GetVMByNameLabel(ctx, config.VMName)
 		if err != nil {
 			ui.Error(err.Error())
 			state.Put("error", err)
@@ -70,7 +70,7 @@ func (step *StepTypeBootCommand) Run(ctx context.Context, state multistep.StateB
 		vmRef = vmByName[0]
 	}
 
-	consoles, err := c.client.VM.GetConsoles(c.session, vmRef)
+	consoles, err := c.GetVMConsoles(ctx, vmRef)
 	if err != nil {
 		state.Put("error", err)
 		ui.Error(err.Error())
@@ -82,7 +82,7 @@ func (step *StepTypeBootCommand) Run(ctx context.Context, state multistep.StateB
 		return multistep.ActionHalt
 	}
 
-	location, err := c.client.Console.GetLocation(c.session, consoles[0])
+	location, err := c.GetConsoleLocation(ctx, consoles[0])
 	if err != nil {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
@@ -91,7 +91,8 @@ func (step *StepTypeBootCommand) Run(ctx context.Context, state multistep.StateB
 	consoleHost := strings.TrimSuffix(locationPieces[2], "/")
 	ui.Say("Connecting to VNC over XAPI...")
 	log.Printf("Connecting to host: %s", consoleHost)
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:443", consoleHost))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:443", consoleHost))
 
 	if err != nil {
 		err := fmt.Errorf("Error connecting to VNC: %s", err)
@@ -102,14 +103,11 @@ func (step *StepTypeBootCommand) Run(ctx context.Context, state multistep.StateB
 
 	defer conn.Close()
 
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn := tls.Client(conn, c.TLSConfig(consoleHost))
 
 	consoleLocation := strings.TrimSpace(fmt.Sprintf("/%s", locationPieces[len(locationPieces)-1]))
-	httpReq := fmt.Sprintf("CONNECT %s HTTP/1.0\r\nHost: %s\r\nCookie: session_id=%s\r\n\r\n", consoleLocation, consoleHost, c.session)
-	fmt.Printf("Sending the follow http req: %v", httpReq)
+	httpReq := fmt.Sprintf("CONNECT %s HTTP/1.0\r\nHost: %s\r\nCookie: session_id=%s\r\n\r\n", consoleLocation, consoleHost, c.GetSession())
+	log.Printf("Sending the follow http req: %v", httpReq)
 
 	ui.Message(fmt.Sprintf("Making HTTP request to initiate VNC connection: %s", httpReq))
 	_, err = io.WriteString(tlsConn, httpReq)
@@ -10,6 +10,7 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 	xenapi "github.com/terra-farm/go-xen-api-client"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskformat"
 )
 
 type StepUploadVdi struct {
@@ -17,6 +18,12 @@ type StepUploadVdi struct {
 	ImagePathFunc func() string
 	VdiUuidKey    string
 	PreserveVdi   bool
+
+	// SR returns the SR to upload to, the ISO SR if nil.
+	SR func(ctx context.Context, c SRClient) (xenapi.SRRef, error)
+	// FormatFunc returns the format of the image, raw if nil. It must be
+	// one that import_raw_vdi accepts.
+	FormatFunc func() diskformat.Format
 }
 
 func (self *StepUploadVdi) uploadVdi(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -34,7 +41,13 @@ func (self *StepUploadVdi) uploadVdi(ctx context.Context, state multistep.StateB
 	ui.Say(fmt.Sprintf("Step: Upload VDI '%s'", vdiName))
 
 	// Create VDI for the image
-	sr, err := config.GetISOSR(c)
+	var sr xenapi.SRRef
+	var err error
+	if self.SR != nil {
+		sr, err = self.SR(ctx, c)
+	} else {
+		sr, err = config.GetISOSR(ctx, c)
+	}
 	ui.Say(fmt.Sprintf("Step: Found SR for upload '%v'", sr))
 
 	if err != nil {
@@ -57,11 +70,25 @@ func (self *StepUploadVdi) uploadVdi(ctx context.Context, state multistep.StateB
 	}
 	fileLength := fstat.Size()
 
+	// The disk of a VHD is not the size of the file
+	format := diskformat.Raw
+	if self.FormatFunc != nil {
+		format = self.FormatFunc()
+	}
+	virtualSize := fileLength
+	if format != diskformat.Raw {
+		virtualSize, err = diskformat.VirtualSize(imagePath, format)
+		if err != nil {
+			fh.Close()
+			ui.Error(fmt.Sprintf("Unable to get size of disk image '%s': %s", imagePath, err.Error()))
+			return multistep.ActionHalt
+		}
+	}
+
 	// Create the VDI
-	// vdi, err := sr.CreateVdi(vdiName, fileLength)
-	vdi, err := c.client.VDI.Create(c.session, xenapi.VDIRecord{
+	vdi, err := c.CreateVDI(ctx, xenapi.VDIRecord{
 		NameLabel:   vdiName,
-		VirtualSize: int(fileLength),
+		VirtualSize: int(virtualSize),
 		Type:        "user",
 		Sharable:    false,
 		ReadOnly:    false,
@@ -75,17 +102,18 @@ func (self *StepUploadVdi) uploadVdi(ctx context.Context, state multistep.StateB
 		return multistep.ActionHalt
 	}
 
-	vdiUuid, err := c.client.VDI.GetUUID(c.session, vdi)
+	vdiUuid, err := c.GetVDIUUID(ctx, vdi)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get UUID of VDI '%s': %s", vdiName, err.Error()))
 		return multistep.ActionHalt
 	}
 	state.Put(self.VdiUuidKey, vdiUuid)
 
-	_, err = HTTPUpload(fmt.Sprintf("https://%s/import_raw_vdi?vdi=%s&session_id=%s",
-		c.Host,
+	_, err = HTTPUpload(ctx, fmt.Sprintf("https://%s/import_raw_vdi?vdi=%s&session_id=%s&format=%s",
+		c.GetHost(),
 		vdi,
 		c.GetSession(),
+		format,
 	), fh, state)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to upload VDI: %s", err.Error()))
@@ -122,7 +150,9 @@ func (self *StepUploadVdi) Cleanup(state multistep.StateBag) {
 		return
 	}
 
-	vdi, err := c.client.VDI.GetByUUID(c.session, vdiUuid)
+	ctx := context.Background()
+
+	vdi, err := c.GetVDIByUUID(ctx, vdiUuid)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Can't get VDI '%s': %s", vdiUuid, err.Error()))
 		return
@@ -132,7 +162,7 @@ func (self *StepUploadVdi) Cleanup(state multistep.StateBag) {
 	// so try several times
 	for i := 0; i < 3; i++ {
 		log.Printf("Trying to destroy VDI...")
-		err = c.client.VDI.Destroy(c.session, vdi)
+		err = c.DestroyVDI(ctx, vdi)
 		if err == nil {
 			break
 		}
@@ -3,6 +3,8 @@ package common
 import (
 	"context"
 	"fmt"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
@@ -13,6 +15,8 @@ type StepWaitForIP struct {
 	VmCleanup
 	Chan    <-chan string
 	Timeout time.Duration
+
+	stop context.CancelFunc
 }
 
 func (self *StepWaitForIP) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -23,87 +27,90 @@ func (self *StepWaitForIP) Run(ctx context.Context, state multistep.StateBag) mu
 	ui.Say("Step: Wait for VM's IP to become known to us.")
 
 	uuid := state.Get("instance_uuid").(string)
-	instance, err := c.client.VM.GetByUUID(c.session, uuid)
+	instance, err := c.GetVMByUUID(ctx, uuid)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM from UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
 	}
 
-	go func(c Connection, ui packer.Ui, config CommonConfig) {
-		state.Put("instance_ssh_address", "")
-		var ip string
+	// Keep watching after this step, so that the address is kept up to date
+	// if the VM comes back with another one, e.g. after the installer reboots
+	watchCtx, stop := context.WithCancel(context.Background())
+	self.stop = stop
 
-		for true {
-			time.Sleep(500 * time.Millisecond)
+	state.Put("instance_ssh_address", "")
+	var mu sync.Mutex
+	var ip string
+	found := make(chan struct{})
+	report := func(new_ip, source string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if new_ip == "" || new_ip == ip {
+			return
+		}
+		if ip == "" {
+			close(found)
+		}
+		ip = new_ip
+		ui.Message(fmt.Sprintf("Got IP '%s' from %s", ip, source))
+		state.Put("instance_ssh_address", ip)
+	}
 
-			if config.IPGetter == "auto" || config.IPGetter == "http" {
-				// Snoop IP from HTTP fetch
+	if config.IPGetter == "auto" || config.IPGetter == "http" {
+		// Snoop IP from HTTP fetch
+		go func() {
+			for {
 				select {
 				case new_ip := <-self.Chan:
-					if ip != new_ip {
-						ip = new_ip
-						ui.Message(fmt.Sprintf("Got IP '%s' from HTTP request", ip))
-						state.Put("instance_ssh_address", ip)
-					}
-					continue
-				default:
+					report(new_ip, "HTTP request")
+				case <-watchCtx.Done():
+					return
 				}
 			}
+		}()
+	}
 
-			if config.IPGetter == "auto" || config.IPGetter == "tools" {
-				// Look for PV IP
-				m, err := c.client.VM.GetGuestMetrics(c.session, instance)
-				if err != nil {
-					continue
-				}
-				if m != "" {
-					metrics, err := c.client.VMGuestMetrics.GetRecord(c.session, m)
-					if err != nil {
-						continue
-					}
-					networks := metrics.Networks
-					if new_ip, ok := networks["0/ip"]; ok {
-						if new_ip != "" && ip != new_ip {
-							ip = new_ip
-							ui.Message(fmt.Sprintf("Got IP '%s' from XenServer tools", ip))
-							state.Put("instance_ssh_address", ip)
-						}
-					}
-				}
-
-			}
-		}
-	}(*c, ui, config)
-
-	time.Sleep(config.DhcpWait)
-
-	var ip string
-
-	err = InterruptibleWait{
-		Timeout:           self.Timeout,
-		PredicateInterval: 5 * time.Second,
-		Predicate: func() (result bool, err error) {
-
-			var ok bool
-			if ip, ok = state.Get("instance_ssh_address").(string); ok && ip != "" {
-				return true, nil
+	if config.IPGetter == "auto" || config.IPGetter == "tools" {
+		// Look for PV IP
+		go func() {
+			err := WatchGuestIP(watchCtx, c, instance, func(new_ip string) (bool, error) {
+				report(new_ip, "XenServer tools")
+				return false, nil
+			})
+			if watchCtx.Err() == nil {
+				log.Printf("Stopped watching the guest metrics of VM '%s': %s", uuid, err.Error())
 			}
+		}()
+	}
 
-			return false, nil
-		},
-	}.Wait(state)
-	if err != nil {
-		ui.Error(fmt.Sprintf("Could not get IP address of VM: %s", err.Error()))
+	waitCtx, cancel := context.WithTimeout(ctx, config.DhcpWait+self.Timeout)
+	defer cancel()
+	select {
+	case <-time.After(config.DhcpWait):
+	case <-waitCtx.Done():
+	}
+	select {
+	case <-found:
+	case <-waitCtx.Done():
+		ui.Error(fmt.Sprintf("Could not get IP address of VM: %s", waitError(waitCtx).Error()))
 		// @todo: give advice on what went wrong (no HTTP server? no PV drivers?)
 		return multistep.ActionHalt
 	}
 
+	mu.Lock()
+	defer mu.Unlock()
 	ui.Say(fmt.Sprintf("Got IP address '%s'", ip))
-	state.Put("instance_ssh_address", ip)
 
 	return multistep.ActionContinue
 }
 
+func (self *StepWaitForIP) Cleanup(state multistep.StateBag) {
+	if self.stop != nil {
+		self.stop()
+	}
+	self.VmCleanup.Cleanup(state)
+}
+
 func InstanceSSHIP(state multistep.StateBag) (string, error) {
 	ip := state.Get("instance_ssh_address").(string)
 	return ip, nil
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// errFingerprintMismatch is returned during the TLS handshake when the
+// server certificate matches none of the pinned fingerprints.
+var errFingerprintMismatch = errors.New("server certificate does not match remote_tls_fingerprint or any of remote_tls_fingerprints")
+
+// TLSConfig builds the TLS settings used for every HTTPS connection to the
+// pool: XAPI calls, the import and export handlers and the console tunnel.
+// By default certificates are verified against the system roots.
+//
+// Every host of a pool has a certificate of its own, and a build may talk to
+// several of them: the primary a member redirects to, the one taking over
+// after a failover, and whichever host runs the VM for the console tunnel.
+// Hence any of the pinned fingerprints is accepted on any connection.
+func (c CommonConfig) TLSConfig() (*tls.Config, error) {
+	pins := c.TLSFingerprints
+	if c.TLSFingerprint != "" {
+		pins = append([]string{c.TLSFingerprint}, pins...)
+	}
+
+	if c.InsecureSkipTLSVerify {
+		if c.CAFile != "" || len(pins) > 0 {
+			return nil, errors.New("remote_insecure_skip_tls_verify cannot be combined with remote_ca_file, remote_tls_fingerprint or remote_tls_fingerprints")
+		}
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	config := &tls.Config{}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read remote_ca_file: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("remote_ca_file '%s' does not contain any PEM encoded certificate", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(pins) > 0 {
+		fingerprints := make([][]byte, len(pins))
+		for i, pin := range pins {
+			fingerprint, err := parseFingerprint(pin)
+			if err != nil {
+				return nil, err
+			}
+			fingerprints[i] = fingerprint
+		}
+		// A pinned certificate is trusted on its own, so unless a CA was
+		// given as well the chain is not verified.
+		config.InsecureSkipVerify = c.CAFile == ""
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errFingerprintMismatch
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			for _, fingerprint := range fingerprints {
+				if bytes.Equal(sum[:], fingerprint) {
+					return nil
+				}
+			}
+			return fmt.Errorf("%w: got %s", errFingerprintMismatch, formatFingerprint(sum[:]))
+		}
+	}
+
+	return config, nil
+}
+
+// Transport returns the HTTP transport shared by all HTTPS requests of a
+// build.
+func (c CommonConfig) Transport() (*http.Transport, error) {
+	config, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{TLSClientConfig: config}, nil
+}
+
+// parseFingerprint accepts a SHA-256 fingerprint either as plain hex or in
+// the colon separated form printed by openssl.
+func parseFingerprint(pin string) ([]byte, error) {
+	s := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(pin)), "sha256:")
+	s = strings.NewReplacer(":", "", " ", "").Replace(s)
+
+	fingerprint, err := hex.DecodeString(s)
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("'%s' is not a SHA-256 fingerprint, e.g. as printed by 'openssl x509 -noout -fingerprint -sha256'", pin)
+	}
+	return fingerprint, nil
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// isTLSVerificationError reports whether err is the server's certificate
+// being rejected, which no amount of retrying is going to fix.
+func isTLSVerificationError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.Is(err, errFingerprintMismatch) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
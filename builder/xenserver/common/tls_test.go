@@ -0,0 +1,33 @@
+package common
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestTLSConfig_Fingerprints(t *testing.T) {
+	master := []byte("master certificate")
+	member := []byte("member certificate")
+	fingerprint := func(cert []byte) string {
+		return fmt.Sprintf("%x", sha256.Sum256(cert))
+	}
+
+	config, err := CommonConfig{
+		TLSFingerprint:  fingerprint(master),
+		TLSFingerprints: []string{fingerprint(member)},
+	}.TLSConfig()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, cert := range [][]byte{master, member} {
+		if err := config.VerifyPeerCertificate([][]byte{cert}, nil); err != nil {
+			t.Errorf("%s should have been trusted: %s", cert, err)
+		}
+	}
+	if err := config.VerifyPeerCertificate([][]byte{[]byte("other certificate")}, nil); !errors.Is(err, errFingerprintMismatch) {
+		t.Errorf("bad error: %v", err)
+	}
+}
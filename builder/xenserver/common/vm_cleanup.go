@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -11,20 +12,21 @@ type VmCleanup struct{}
 
 func (self *VmCleanup) Cleanup(state multistep.StateBag) {
 	config := state.Get("commonconfig").(CommonConfig)
-	c := state.Get("client").(*Connection)
+	c := state.Get("client").(Client)
 
 	if config.ShouldKeepVM(state) {
 		return
 	}
 
+	ctx := context.Background()
 	uuid := state.Get("instance_uuid").(string)
-	instance, err := c.client.VM.GetByUUID(c.session, uuid)
+	instance, err := c.GetVMByUUID(ctx, uuid)
 	if err != nil {
 		log.Printf("%s", fmt.Sprintf("Unable to get VM from UUID '%s': %s", uuid, err.Error()))
 		return
 	}
 
-	err = c.client.VM.HardShutdown(c.session, instance)
+	err = c.HardShutdownVM(ctx, instance)
 	if err != nil {
 		log.Printf("%s", fmt.Sprintf("Unable to force shutdown VM '%s': %s", uuid, err.Error()))
 	}
@@ -0,0 +1,288 @@
+// Package diskformat reads the disk image formats that cloud images are
+// published in, so that they can be imported with import_raw_vdi, which only
+// accepts raw and VHD images, and writes them from the raw disks that
+// export_raw_vdi exports. It is pure Go and needs no qemu-img.
+package diskformat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Format is the format of a disk image.
+type Format string
+
+const (
+	Raw   Format = "raw"
+	VHD   Format = "vhd"
+	QCOW2 Format = "qcow2"
+	VMDK  Format = "vmdk"
+)
+
+// Formats are the formats ParseFormat accepts.
+var Formats = []Format{Raw, VHD, QCOW2, VMDK}
+
+// ParseFormat returns the format of the given name.
+func ParseFormat(name string) (Format, error) {
+	for _, format := range Formats {
+		if string(format) == name {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown disk image format '%s', must be one of %v", name, Formats)
+}
+
+// Importable reports whether import_raw_vdi accepts images of the format as
+// they are.
+func (f Format) Importable() bool {
+	return f == Raw || f == VHD
+}
+
+// maxVirtualSize bounds the size of the disks read from image headers, at
+// well above the largest VDI there is, so that a corrupt header fails
+// rather than sizes tables after it.
+const maxVirtualSize = 64 << 40
+
+// image is a sparse disk image opened for reading.
+type image interface {
+	// virtualSize is the size of the disk the image holds, in bytes.
+	virtualSize() int64
+
+	// walk calls fn with the offset and content of the allocated parts of
+	// the disk, in increasing order of offset. The parts it doesn't walk
+	// over read as zeros.
+	walk(fn func(offset int64, data []byte) error) error
+}
+
+// open opens the image of the given format read from r, which holds size
+// bytes. Only the sparse formats are opened.
+func open(r io.ReaderAt, size int64, format Format) (image, error) {
+	switch format {
+	case QCOW2:
+		return openQCOW2(r, size)
+	case VMDK:
+		return openVMDK(r, size)
+	}
+	return nil, fmt.Errorf("%s images cannot be converted", format)
+}
+
+// NewWriter returns a writer converting the raw disk of size bytes written
+// to it, from start to end, to an image of the given format written to w.
+// name is the file name of the image, which VMDKs refer to themselves by.
+// The image is only complete once the writer is closed.
+//
+// Only the parts of the disk that aren't zeros are stored, and the disk is
+// never held in memory as a whole, so that disks can be converted as they
+// are downloaded.
+func NewWriter(w io.WriterAt, format Format, size int64, name string) (io.WriteCloser, error) {
+	switch format {
+	case QCOW2:
+		return newQCOW2Writer(w, size), nil
+	case VMDK:
+		return newVMDKWriter(w, size, name), nil
+	}
+	return nil, fmt.Errorf("%s images cannot be written", format)
+}
+
+// blockWriter splits the raw disk written to it into blocks, and hands
+// those that aren't all zeros to write. The last block is cut short by the
+// end of the disk if the disk isn't a whole number of blocks.
+type blockWriter struct {
+	size  int64
+	write func(offset int64, data []byte) error
+
+	buf    []byte
+	n      int
+	offset int64
+}
+
+func newBlockWriter(size, blockSize int64, write func(offset int64, data []byte) error) blockWriter {
+	return blockWriter{size: size, write: write, buf: make([]byte, blockSize)}
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	if b.offset+int64(b.n)+int64(len(p)) > b.size {
+		return 0, fmt.Errorf("disk is larger than its size of %d bytes", b.size)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(b.buf[b.n:], p)
+		b.n += n
+		p = p[n:]
+		written += n
+		if b.n == len(b.buf) {
+			if err := b.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (b *blockWriter) flush() error {
+	data := b.buf[:b.n]
+	if !isZero(data) {
+		if err := b.write(b.offset, data); err != nil {
+			return err
+		}
+	}
+	b.offset += int64(b.n)
+	b.n = 0
+	return nil
+}
+
+// finish flushes the last block, and checks that the whole disk was
+// written.
+func (b *blockWriter) finish() error {
+	if b.n > 0 {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	if b.offset != b.size {
+		return fmt.Errorf("got %d bytes of a disk of %d bytes", b.offset, b.size)
+	}
+	return nil
+}
+
+// Detect returns the format of the disk image at path from its magic
+// numbers. Images without any are taken to be raw.
+func Detect(path string) (Format, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	fstat, err := fh.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	head := make([]byte, 512)
+	n, err := fh.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("Unable to read '%s': %s", path, err.Error())
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte(qcow2Magic)):
+		return QCOW2, nil
+	case bytes.HasPrefix(head, []byte(vmdkMagic)), bytes.HasPrefix(head, []byte(vmdkDescriptorMagic)):
+		return VMDK, nil
+	case bytes.HasPrefix(head, []byte(vhdCookie)):
+		// The copy of the footer that dynamic VHDs start with
+		return VHD, nil
+	}
+
+	if fstat.Size() >= vhdFooterSize {
+		footer := make([]byte, len(vhdCookie))
+		if _, err := fh.ReadAt(footer, fstat.Size()-vhdFooterSize); err != nil {
+			return "", fmt.Errorf("Unable to read '%s': %s", path, err.Error())
+		}
+		if string(footer) == vhdCookie {
+			return VHD, nil
+		}
+	}
+
+	return Raw, nil
+}
+
+// VirtualSize returns the size of the disk held by the image at path, in
+// bytes.
+func VirtualSize(path string, format Format) (int64, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	fstat, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	switch format {
+	case Raw:
+		return fstat.Size(), nil
+	case VHD:
+		return vhdVirtualSize(fh, fstat.Size())
+	}
+
+	img, err := open(fh, fstat.Size(), format)
+	if err != nil {
+		return 0, err
+	}
+	return img.virtualSize(), nil
+}
+
+// ConvertToRaw writes the disk held by the image at src, of the given
+// format, to a raw image at dst and returns its size. Only the allocated
+// parts of the disk that aren't zeros are written, so dst is sparse on the
+// file systems that support it.
+func ConvertToRaw(dst, src string, format Format) (size int64, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	fstat, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	img, err := open(in, fstat.Size(), format)
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	err = img.walk(func(offset int64, data []byte) error {
+		if isZero(data) {
+			return nil
+		}
+		_, err := out.WriteAt(data, offset)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Unable to convert '%s' to raw: %s", src, err.Error())
+	}
+
+	size = img.virtualSize()
+	return size, out.Truncate(size)
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readFullAt reads len(buf) bytes at offset, failing on a short read.
+func readFullAt(r io.ReaderAt, buf []byte, offset int64) error {
+	n, err := r.ReadAt(buf, offset)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("unable to read %d bytes at offset %d: %s", len(buf), offset, err.Error())
+}
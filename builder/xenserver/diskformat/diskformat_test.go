@@ -0,0 +1,483 @@
+package diskformat
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pattern returns n bytes that are not zeros and differ with seed.
+func pattern(seed byte, n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = seed + byte(i%7)
+	}
+	return data
+}
+
+// testImage is an image file under construction.
+type testImage struct {
+	bytes.Buffer
+}
+
+func (img *testImage) writeAt(data []byte, offset int) {
+	if grow := offset + len(data) - img.Len(); grow > 0 {
+		img.Write(make([]byte, grow))
+	}
+	copy(img.Bytes()[offset:], data)
+}
+
+func (img *testImage) save(t *testing.T, name string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, img.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeQCOW2 writes a version 3 qcow2 image with 512-byte clusters, and
+// returns its path and the raw disk it holds.
+func writeQCOW2(t *testing.T) (string, []byte) {
+	const (
+		clusterBits = 9
+		cluster     = 1 << clusterBits
+		l2Entries   = cluster / 8
+		size        = 70000
+	)
+	expected := make([]byte, size)
+	var img testImage
+
+	be := binary.BigEndian
+	header := make([]byte, 104)
+	copy(header, qcow2Magic)
+	be.PutUint32(header[4:], 3)
+	be.PutUint32(header[20:], clusterBits)
+	be.PutUint64(header[24:], size)
+	be.PutUint32(header[36:], 3)
+	be.PutUint64(header[40:], cluster)
+	be.PutUint64(header[72:], qcow2Dirty)
+	be.PutUint32(header[100:], 104)
+	img.writeAt(header, 0)
+
+	// L1 table in cluster 1, the L2 tables of the first and third 32 KiB
+	// in clusters 2 and 3, data from cluster 4
+	l1 := make([]byte, 24)
+	be.PutUint64(l1[0:], 2*cluster|1<<63)
+	be.PutUint64(l1[16:], 3*cluster|1<<63)
+	img.writeAt(l1, cluster)
+	l2 := [][]byte{make([]byte, cluster), make([]byte, cluster)}
+	next := 4 * cluster
+
+	allocate := func(table []byte, index, diskCluster int) {
+		data := pattern(byte(diskCluster), cluster)
+		be.PutUint64(table[index*8:], uint64(next)|1<<63)
+		img.writeAt(data, next)
+		copy(expected[diskCluster*cluster:], data)
+		next += cluster
+	}
+
+	allocate(l2[0], 0, 0)
+
+	// A compressed cluster, not aligned on a sector
+	var compressed bytes.Buffer
+	zw, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	data := pattern(42, cluster)
+	zw.Write(data)
+	zw.Close()
+	offset := next + 100
+	sectors := (offset%512 + compressed.Len() + 511) / 512
+	offsetBits := 62 - (clusterBits - 8)
+	be.PutUint64(l2[0][1*8:], qcow2Compressed|uint64(sectors-1)<<offsetBits|uint64(offset))
+	img.writeAt(compressed.Bytes(), offset)
+	copy(expected[1*cluster:], data)
+	next += 2 * cluster
+
+	// A zero cluster still pointing at data, which must be ignored
+	be.PutUint64(l2[0][2*8:], uint64(4*cluster)|qcow2Zero)
+
+	allocate(l2[0], 63, 63)
+	allocate(l2[1], 6, 2*l2Entries+6)
+
+	// The last cluster is cut short by the size of the disk
+	last := size / cluster
+	data = pattern(7, cluster)
+	be.PutUint64(l2[1][(last-2*l2Entries)*8:], uint64(next))
+	img.writeAt(data, next)
+	copy(expected[last*cluster:], data[:size-last*cluster])
+
+	img.writeAt(l2[0], 2*cluster)
+	img.writeAt(l2[1], 3*cluster)
+
+	return img.save(t, "disk.qcow2"), expected
+}
+
+// writeVMDK writes a sparse VMDK with 4 KiB grains, whose third and last
+// grain table is only partly used, stream-optimized if compressed, and
+// returns its path and the raw disk it holds.
+func writeVMDK(t *testing.T, compressed bool) (string, []byte) {
+	const (
+		grain       = 4096
+		gtEntries   = vmdkGTEntries
+		tableSize   = gtEntries * 4
+		tableSector = tableSize / vmdkSectorSize
+		capacity    = (2*gtEntries + 2) * grain
+	)
+	expected := make([]byte, capacity)
+	var img testImage
+
+	le := binary.LittleEndian
+	header := vmdkHeader{
+		Version:           1,
+		Flags:             vmdkFlagZeroGrainGTE,
+		Capacity:          capacity / vmdkSectorSize,
+		GrainSize:         grain / vmdkSectorSize,
+		NumGTEsPerGT:      gtEntries,
+		GdOffset:          1,
+		CompressAlgorithm: vmdkCompressionDeflate,
+	}
+	copy(header.Magic[:], vmdkMagic)
+	if compressed {
+		header.Version = 3
+		header.Flags |= vmdkFlagCompressed
+	}
+	writeHeader := func(header vmdkHeader, offset int) {
+		var buf bytes.Buffer
+		binary.Write(&buf, le, header)
+		img.writeAt(buf.Bytes(), offset)
+		img.writeAt(make([]byte, vmdkSectorSize-buf.Len()), offset+buf.Len())
+	}
+
+	tables := make([][]byte, 3)
+	for i := range tables {
+		tables[i] = make([]byte, gtEntries*4)
+	}
+	next := (2 + 3*tableSector) * vmdkSectorSize
+
+	store := func(diskGrain int, data []byte) {
+		le.PutUint32(tables[diskGrain/gtEntries][diskGrain%gtEntries*4:], uint32(next/vmdkSectorSize))
+		copy(expected[diskGrain*grain:], data)
+		if compressed {
+			var buf bytes.Buffer
+			zw := zlib.NewWriter(&buf)
+			zw.Write(data)
+			zw.Close()
+			marker := make([]byte, 12)
+			le.PutUint64(marker, uint64(diskGrain*grain/vmdkSectorSize))
+			le.PutUint32(marker[8:], uint32(buf.Len()))
+			img.writeAt(append(marker, buf.Bytes()...), next)
+			next += (12 + buf.Len() + vmdkSectorSize - 1) / vmdkSectorSize * vmdkSectorSize
+		} else {
+			img.writeAt(data, next)
+			next += grain
+		}
+	}
+
+	store(0, pattern(1, grain))
+	store(3, pattern(2, grain))
+	store(2*gtEntries+1, pattern(3, grain))
+	// A zeroed grain
+	le.PutUint32(tables[1][1*4:], 1)
+
+	if !compressed {
+		writeHeader(header, 0)
+		// Grain directory in sector 1, grain tables from sector 2
+		gd := make([]byte, 12)
+		for i, table := range tables {
+			le.PutUint32(gd[i*4:], uint32(2+i*tableSector))
+			img.writeAt(table, (2+i*tableSector)*vmdkSectorSize)
+		}
+		img.writeAt(gd, vmdkSectorSize)
+		return img.save(t, "disk.vmdk"), expected
+	}
+
+	header.GdOffset = vmdkGDAtEnd
+	writeHeader(header, 0)
+
+	gd := make([]byte, 12)
+	for i, table := range tables {
+		le.PutUint32(gd[i*4:], uint32(next/vmdkSectorSize))
+		img.writeAt(table, next)
+		next += tableSize
+	}
+	header.GdOffset = uint64(next / vmdkSectorSize)
+	img.writeAt(gd, next)
+	next += vmdkSectorSize
+
+	// Footer marker, footer and end-of-stream marker
+	img.writeAt(make([]byte, vmdkSectorSize), next)
+	writeHeader(header, next+vmdkSectorSize)
+	img.writeAt(make([]byte, vmdkSectorSize), next+2*vmdkSectorSize)
+
+	return img.save(t, "disk.vmdk"), expected
+}
+
+// writeVHD writes a fixed VHD of the given disk type.
+func writeVHD(t *testing.T, diskType uint32) (string, []byte) {
+	disk := pattern(5, 8192)
+	footer := make([]byte, vhdFooterSize)
+	copy(footer, vhdCookie)
+	binary.BigEndian.PutUint64(footer[48:], uint64(len(disk)))
+	binary.BigEndian.PutUint32(footer[60:], diskType)
+
+	var img testImage
+	img.Write(disk)
+	img.Write(footer)
+	return img.save(t, "disk.vhd"), disk
+}
+
+func TestDetect(t *testing.T) {
+	qcow2Path, _ := writeQCOW2(t)
+	vmdkPath, _ := writeVMDK(t, false)
+	streamPath, _ := writeVMDK(t, true)
+	vhdPath, _ := writeVHD(t, vhdFixed)
+
+	var raw testImage
+	raw.Write(pattern(9, 4096))
+	rawPath := raw.save(t, "disk.img")
+
+	cases := map[string]Format{
+		qcow2Path:  QCOW2,
+		vmdkPath:   VMDK,
+		streamPath: VMDK,
+		vhdPath:    VHD,
+		rawPath:    Raw,
+	}
+	for path, expected := range cases {
+		format, err := Detect(path)
+		if err != nil {
+			t.Errorf("%s: should not have error: %s", path, err)
+			continue
+		}
+		if format != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, format)
+		}
+	}
+}
+
+func TestConvertToRaw(t *testing.T) {
+	qcow2Path, qcow2Disk := writeQCOW2(t)
+	vmdkPath, vmdkDisk := writeVMDK(t, false)
+	streamPath, streamDisk := writeVMDK(t, true)
+
+	// An L1 table larger than the disk needs, as left by shrinking the
+	// image, whose extra entries fill the rest of its cluster
+	data, err := os.ReadFile(qcow2Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shrunk testImage
+	shrunk.Write(data)
+	binary.BigEndian.PutUint32(shrunk.Bytes()[36:], 64)
+	shrunkPath := shrunk.save(t, "shrunk.qcow2")
+
+	cases := []struct {
+		name   string
+		path   string
+		format Format
+		disk   []byte
+	}{
+		{"qcow2", qcow2Path, QCOW2, qcow2Disk},
+		{"qcow2 with an oversized L1 table", shrunkPath, QCOW2, qcow2Disk},
+		{"monolithic sparse VMDK", vmdkPath, VMDK, vmdkDisk},
+		{"stream-optimized VMDK", streamPath, VMDK, streamDisk},
+	}
+
+	for _, tc := range cases {
+		dst := filepath.Join(t.TempDir(), "disk.raw")
+		size, err := ConvertToRaw(dst, tc.path, tc.format)
+		if err != nil {
+			t.Errorf("%s: should not have error: %s", tc.name, err)
+			continue
+		}
+		if size != int64(len(tc.disk)) {
+			t.Errorf("%s: expected size %d, got %d", tc.name, len(tc.disk), size)
+		}
+
+		raw, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, tc.disk) {
+			t.Errorf("%s: converted disk differs from the original", tc.name)
+		}
+
+		if virtualSize, err := VirtualSize(tc.path, tc.format); err != nil || virtualSize != size {
+			t.Errorf("%s: bad virtual size %d: %v", tc.name, virtualSize, err)
+		}
+	}
+}
+
+func TestConvertToRaw_Unsupported(t *testing.T) {
+	var img testImage
+	header := make([]byte, 104)
+	copy(header, qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:], 3)
+	binary.BigEndian.PutUint64(header[8:], 512)
+	img.writeAt(header, 0)
+	backing := img.save(t, "backed.qcow2")
+
+	var descriptor testImage
+	descriptor.WriteString(vmdkDescriptorMagic + "\nversion=1\n")
+	flat := descriptor.save(t, "flat.vmdk")
+
+	vhdPath, _ := writeVHD(t, vhdFixed)
+
+	cases := []struct {
+		path   string
+		format Format
+		err    string
+	}{
+		{backing, QCOW2, "backing file"},
+		{flat, VMDK, "separate extents"},
+		{vhdPath, VHD, "cannot be converted"},
+	}
+	for _, tc := range cases {
+		_, err := ConvertToRaw(filepath.Join(t.TempDir(), "disk.raw"), tc.path, tc.format)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.path, tc.err, err)
+		}
+	}
+}
+
+func TestConvertToRaw_Malformed(t *testing.T) {
+	qcow2Path, _ := writeQCOW2(t)
+	vmdkPath, _ := writeVMDK(t, false)
+
+	// patch returns a copy of the image at path with value written at
+	// offset, in the byte order of the format
+	patch := func(path string, order binary.ByteOrder, offset int, value interface{}) string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var img testImage
+		img.Write(data)
+		var buf bytes.Buffer
+		binary.Write(&buf, order, value)
+		img.writeAt(buf.Bytes(), offset)
+		return img.save(t, filepath.Base(path))
+	}
+	be, le := binary.BigEndian, binary.LittleEndian
+
+	cases := []struct {
+		name   string
+		path   string
+		format Format
+		err    string
+	}{
+		{"huge qcow2 size", patch(qcow2Path, be, 24, uint64(1<<62)), QCOW2, "invalid qcow2 size"},
+		{"negative qcow2 size", patch(qcow2Path, be, 24, uint64(1<<63)), QCOW2, "invalid qcow2 size"},
+		{"huge qcow2 L1 table", patch(qcow2Path, be, 36, uint32(0xffffffff)), QCOW2, "past the end"},
+		{"short qcow2 L1 table", patch(qcow2Path, be, 36, uint32(2)), QCOW2, "too small"},
+		{"qcow2 L1 table past the end", patch(qcow2Path, be, 40, uint64(1<<40)), QCOW2, "past the end"},
+		{"qcow2 L1 table larger than the file", patch(patch(qcow2Path, be, 24, uint64(1<<40)), be, 36, uint32(1<<25)), QCOW2, "past the end"},
+		{"zero VMDK grain size", patch(vmdkPath, le, 20, uint64(0)), VMDK, "grain size"},
+		{"odd VMDK grain size", patch(vmdkPath, le, 20, uint64(24)), VMDK, "grain size"},
+		{"huge VMDK grain size", patch(vmdkPath, le, 20, uint64(1<<40)), VMDK, "grain size"},
+		{"no VMDK grain table entries", patch(vmdkPath, le, 44, uint32(0)), VMDK, "grain tables"},
+		{"huge VMDK grain tables", patch(vmdkPath, le, 44, uint32(1<<31)), VMDK, "grain tables"},
+		{"huge VMDK capacity", patch(vmdkPath, le, 12, uint64(1<<62)), VMDK, "capacity"},
+		{"VMDK grain directory past the end", patch(vmdkPath, le, 56, uint64(1<<60)), VMDK, "past the end"},
+		{"VMDK grain directory larger than the file", patch(vmdkPath, le, 12, uint64(1<<40/vmdkSectorSize)), VMDK, "past the end"},
+	}
+	for _, tc := range cases {
+		_, err := ConvertToRaw(filepath.Join(t.TempDir(), "disk.raw"), tc.path, tc.format)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	// A disk spanning two VMDK grain tables, which ends on a partial
+	// cluster
+	const size = 33<<20 + 1536
+	disk := make([]byte, size)
+	copy(disk, pattern(1, 4096))
+	copy(disk[5<<20+100:], pattern(2, 200000))
+	copy(disk[size-1000:], pattern(3, 1000))
+
+	for _, format := range []Format{QCOW2, VMDK} {
+		path := filepath.Join(t.TempDir(), "disk."+string(format))
+		fh, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := NewWriter(fh, format, size, filepath.Base(path))
+		if err != nil {
+			t.Fatalf("%s: should not have error: %s", format, err)
+		}
+		// Written in pieces that don't line up with clusters or grains
+		if _, err := io.CopyBuffer(w, bytes.NewReader(disk), make([]byte, 10000)); err != nil {
+			t.Fatalf("%s: should not have error: %s", format, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: should not have error: %s", format, err)
+		}
+		fh.Close()
+
+		if detected, err := Detect(path); err != nil || detected != format {
+			t.Errorf("%s: detected as %s: %v", format, detected, err)
+		}
+		if fstat, err := os.Stat(path); err != nil || fstat.Size() > 1<<20 {
+			t.Errorf("%s: image should only hold the data of the disk: %v", format, err)
+		}
+
+		dst := filepath.Join(t.TempDir(), "disk.raw")
+		if _, err := ConvertToRaw(dst, path, format); err != nil {
+			t.Fatalf("%s: should not have error: %s", format, err)
+		}
+		raw, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, disk) {
+			t.Errorf("%s: image holds a different disk from the one written", format)
+		}
+	}
+}
+
+func TestNewWriter_Size(t *testing.T) {
+	for _, format := range []Format{QCOW2, VMDK} {
+		fh, err := os.Create(filepath.Join(t.TempDir(), "disk"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fh.Close()
+
+		w, _ := NewWriter(fh, format, 4096, "disk")
+		if _, err := w.Write(make([]byte, 8192)); err == nil {
+			t.Errorf("%s: should have refused more than the size of the disk", format)
+		}
+		w.Write(make([]byte, 1024))
+		if err := w.Close(); err == nil {
+			t.Errorf("%s: should have refused less than the size of the disk", format)
+		}
+	}
+
+	if _, err := NewWriter(nil, VHD, 4096, "disk"); err == nil {
+		t.Errorf("should not write VHDs")
+	}
+}
+
+func TestVirtualSize_VHD(t *testing.T) {
+	path, disk := writeVHD(t, vhdFixed)
+	size, err := VirtualSize(path, VHD)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if size != int64(len(disk)) {
+		t.Errorf("expected size %d, got %d", len(disk), size)
+	}
+
+	path, _ = writeVHD(t, vhdDifferencing)
+	if _, err := VirtualSize(path, VHD); err == nil || !strings.Contains(err.Error(), "differencing") {
+		t.Errorf("expected differencing VHD to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+package diskformat
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The qcow2 format is described in docs/interop/qcow2.txt of QEMU.
+
+const (
+	qcow2Magic = "QFI\xfb"
+
+	// qcow2OffsetMask extracts the host offset from L1 and L2 entries.
+	qcow2OffsetMask = 0x00fffffffffffe00
+	// qcow2Compressed flags an L2 entry of a compressed cluster.
+	qcow2Compressed = 1 << 62
+	// qcow2Zero flags an L2 entry of a cluster that reads as zeros.
+	qcow2Zero = 1
+
+	// qcow2Dirty is the only incompatible feature that doesn't change how
+	// the image is read: refcounts may be off, which don't matter here.
+	qcow2Dirty = 1
+)
+
+type qcow2 struct {
+	r           io.ReaderAt
+	clusterBits uint
+	size        int64
+	l1          []uint64
+}
+
+func openQCOW2(r io.ReaderAt, fileSize int64) (*qcow2, error) {
+	header := make([]byte, 104)
+	if err := readFullAt(r, header[:72], 0); err != nil {
+		return nil, fmt.Errorf("unable to read qcow2 header: %s", err.Error())
+	}
+	if string(header[:4]) != qcow2Magic {
+		return nil, errors.New("not a qcow2 image")
+	}
+
+	be := binary.BigEndian
+	version := be.Uint32(header[4:])
+	switch version {
+	case 2:
+	case 3:
+		if err := readFullAt(r, header[72:], 72); err != nil {
+			return nil, fmt.Errorf("unable to read qcow2 header: %s", err.Error())
+		}
+		if incompatible := be.Uint64(header[72:]) &^ qcow2Dirty; incompatible != 0 {
+			return nil, fmt.Errorf("qcow2 image uses unsupported features (incompatible feature bits %#x)", incompatible)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 version %d", version)
+	}
+
+	if be.Uint64(header[8:]) != 0 {
+		return nil, errors.New("qcow2 images with a backing file are not supported")
+	}
+	if be.Uint32(header[32:]) != 0 {
+		return nil, errors.New("encrypted qcow2 images are not supported")
+	}
+
+	q := &qcow2{
+		r:           r,
+		clusterBits: uint(be.Uint32(header[20:])),
+		size:        int64(be.Uint64(header[24:])),
+	}
+	if q.clusterBits < 9 || q.clusterBits > 21 {
+		return nil, fmt.Errorf("invalid qcow2 cluster size 2^%d", q.clusterBits)
+	}
+	if q.size < 0 || q.size > maxVirtualSize {
+		return nil, fmt.Errorf("invalid qcow2 size of %d bytes", uint64(q.size))
+	}
+
+	// Each L1 entry covers the clusters of a whole L2 table, and the table
+	// has to be within the file. It may be larger than the disk needs, as
+	// shrinking an image leaves it be.
+	l1Size := int64(be.Uint32(header[36:]))
+	perL1 := int64(1) << (2*q.clusterBits - 3)
+	if l1Size < (q.size+perL1-1)/perL1 {
+		return nil, fmt.Errorf("qcow2 L1 table of %d entries is too small for %d bytes", l1Size, q.size)
+	}
+	l1Offset := be.Uint64(header[40:])
+	if l1Offset > uint64(fileSize) || int64(l1Offset)+l1Size*8 > fileSize {
+		return nil, fmt.Errorf("qcow2 L1 table of %d entries at offset %d is past the end of the file", l1Size, l1Offset)
+	}
+	l1 := make([]byte, l1Size*8)
+	if err := readFullAt(r, l1, int64(l1Offset)); err != nil {
+		return nil, fmt.Errorf("unable to read qcow2 L1 table: %s", err.Error())
+	}
+	q.l1 = make([]uint64, l1Size)
+	for i := range q.l1 {
+		q.l1[i] = be.Uint64(l1[i*8:])
+	}
+
+	return q, nil
+}
+
+func (q *qcow2) virtualSize() int64 {
+	return q.size
+}
+
+func (q *qcow2) walk(fn func(offset int64, data []byte) error) error {
+	clusterSize := int64(1) << q.clusterBits
+	l2Entries := clusterSize / 8
+
+	table := make([]byte, clusterSize)
+	cluster := make([]byte, clusterSize)
+	for i, l1Entry := range q.l1 {
+		l2Offset := int64(l1Entry & qcow2OffsetMask)
+		if l2Offset == 0 {
+			continue
+		}
+		if err := readFullAt(q.r, table, l2Offset); err != nil {
+			return fmt.Errorf("unable to read qcow2 L2 table: %s", err.Error())
+		}
+
+		for j := int64(0); j < l2Entries; j++ {
+			offset := (int64(i)*l2Entries + j) * clusterSize
+			if offset >= q.size {
+				return nil
+			}
+
+			data, err := q.readCluster(binary.BigEndian.Uint64(table[j*8:]), cluster)
+			if err != nil {
+				return fmt.Errorf("unable to read cluster at offset %d: %s", offset, err.Error())
+			}
+			if data == nil {
+				continue
+			}
+			if rest := q.size - offset; rest < int64(len(data)) {
+				data = data[:rest]
+			}
+			if err := fn(offset, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readCluster reads the cluster of the L2 entry into buf. It returns nil for
+// clusters that read as zeros.
+func (q *qcow2) readCluster(entry uint64, buf []byte) ([]byte, error) {
+	if entry&qcow2Compressed != 0 {
+		// The host offset is followed by the number of additional 512-byte
+		// sectors the compressed data spans
+		offsetBits := 62 - (q.clusterBits - 8)
+		offset := int64(entry & (1<<offsetBits - 1))
+		sectors := int64(entry>>offsetBits&(1<<(q.clusterBits-8)-1)) + 1
+
+		// The last sector may be cut short by the end of the file
+		compressed := make([]byte, sectors*512-offset%512)
+		n, err := q.r.ReadAt(compressed, offset)
+		if n == 0 && err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), buf); err != nil {
+			return nil, fmt.Errorf("unable to decompress: %s", err.Error())
+		}
+		return buf, nil
+	}
+
+	if entry&qcow2Zero != 0 || entry&qcow2OffsetMask == 0 {
+		return nil, nil
+	}
+
+	if err := readFullAt(q.r, buf, int64(entry&qcow2OffsetMask)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+const (
+	// qcow2WriteClusterBits gives the 64 KiB clusters qemu-img defaults to.
+	qcow2WriteClusterBits = 16
+
+	// qcow2Copied flags L1 and L2 entries of clusters used only once.
+	qcow2Copied = 1 << 63
+
+	qcow2HeaderLength = 104
+	// qcow2RefcountOrder gives refcounts of 16 bits, which all versions
+	// of qcow2 support.
+	qcow2RefcountOrder = 4
+)
+
+// qcow2Writer writes a version 3 qcow2 image. The header and the L1 table
+// take up the first clusters, followed by the data clusters as they are
+// written, then by the L2 tables and the refcounts, which are only known
+// once the whole disk has been written.
+type qcow2Writer struct {
+	blockWriter
+	w    io.WriterAt
+	next int64
+	l2   [][]uint64
+}
+
+func newQCOW2Writer(w io.WriterAt, size int64) *qcow2Writer {
+	q := &qcow2Writer{w: w}
+	q.blockWriter = newBlockWriter(size, q.clusterSize(), q.writeCluster)
+
+	perL1 := q.clusterSize() * q.l2Entries()
+	q.l2 = make([][]uint64, (size+perL1-1)/perL1)
+	q.next = (1 + q.clusters(int64(len(q.l2))*8)) * q.clusterSize()
+	return q
+}
+
+func (q *qcow2Writer) clusterSize() int64 {
+	return 1 << qcow2WriteClusterBits
+}
+
+func (q *qcow2Writer) l2Entries() int64 {
+	return q.clusterSize() / 8
+}
+
+// clusters returns how many clusters n bytes take up.
+func (q *qcow2Writer) clusters(n int64) int64 {
+	return (n + q.clusterSize() - 1) / q.clusterSize()
+}
+
+// allocate writes data to a new cluster and returns its offset.
+func (q *qcow2Writer) allocate(data []byte) (int64, error) {
+	offset := q.next
+	if _, err := q.w.WriteAt(data, offset); err != nil {
+		return 0, err
+	}
+	q.next += q.clusters(int64(len(data))) * q.clusterSize()
+	return offset, nil
+}
+
+func (q *qcow2Writer) writeCluster(offset int64, data []byte) error {
+	if int64(len(data)) < q.clusterSize() {
+		// The last cluster still takes up a whole cluster
+		data = append(data[:len(data):len(data)], make([]byte, q.clusterSize()-int64(len(data)))...)
+	}
+	cluster := offset >> qcow2WriteClusterBits
+	table := &q.l2[cluster/q.l2Entries()]
+	if *table == nil {
+		*table = make([]uint64, q.l2Entries())
+	}
+
+	host, err := q.allocate(data)
+	if err != nil {
+		return err
+	}
+	(*table)[cluster%q.l2Entries()] = uint64(host) | qcow2Copied
+	return nil
+}
+
+func (q *qcow2Writer) Close() error {
+	if err := q.finish(); err != nil {
+		return err
+	}
+
+	be := binary.BigEndian
+	l1 := make([]byte, q.clusters(int64(len(q.l2))*8)*q.clusterSize())
+	for i, entries := range q.l2 {
+		if entries == nil {
+			continue
+		}
+		table := make([]byte, q.clusterSize())
+		for j, entry := range entries {
+			be.PutUint64(table[j*8:], entry)
+		}
+		offset, err := q.allocate(table)
+		if err != nil {
+			return err
+		}
+		be.PutUint64(l1[i*8:], uint64(offset)|qcow2Copied)
+	}
+	if _, err := q.w.WriteAt(l1, q.clusterSize()); err != nil {
+		return err
+	}
+
+	// Every cluster is used once, including those of the refcount table
+	// and blocks, which have to be counted in themselves
+	used := q.next / q.clusterSize()
+	perBlock := q.clusterSize() * 8 >> qcow2RefcountOrder
+	var blocks, tableClusters int64
+	for {
+		b := (used + tableClusters + blocks + perBlock - 1) / perBlock
+		t := q.clusters(b * 8)
+		if b == blocks && t == tableClusters {
+			break
+		}
+		blocks, tableClusters = b, t
+	}
+
+	tableOffset := q.next
+	blocksOffset := tableOffset + tableClusters*q.clusterSize()
+	table := make([]byte, tableClusters*q.clusterSize())
+	for i := int64(0); i < blocks; i++ {
+		be.PutUint64(table[i*8:], uint64(blocksOffset+i*q.clusterSize()))
+	}
+	if _, err := q.allocate(table); err != nil {
+		return err
+	}
+
+	total := used + tableClusters + blocks
+	block := make([]byte, q.clusterSize())
+	for i := int64(0); i < blocks; i++ {
+		for j := int64(0); j < perBlock; j++ {
+			var refcount uint16
+			if i*perBlock+j < total {
+				refcount = 1
+			}
+			be.PutUint16(block[j*2:], refcount)
+		}
+		if _, err := q.allocate(block); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, qcow2HeaderLength)
+	copy(header, qcow2Magic)
+	be.PutUint32(header[4:], 3)
+	be.PutUint32(header[20:], qcow2WriteClusterBits)
+	be.PutUint64(header[24:], uint64(q.size))
+	be.PutUint32(header[36:], uint32(len(q.l2)))
+	be.PutUint64(header[40:], uint64(q.clusterSize()))
+	be.PutUint64(header[48:], uint64(tableOffset))
+	be.PutUint32(header[56:], uint32(tableClusters))
+	be.PutUint32(header[96:], qcow2RefcountOrder)
+	be.PutUint32(header[100:], qcow2HeaderLength)
+	// The rest of the first cluster, zeros, ends the header extensions
+	_, err := q.w.WriteAt(header, 0)
+	return err
+}
@@ -0,0 +1,45 @@
+package diskformat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The VHD footer is described in the Virtual Hard Disk Image Format
+// Specification.
+
+const (
+	vhdCookie     = "conectix"
+	vhdFooterSize = 512
+
+	vhdFixed        = 2
+	vhdDynamic      = 3
+	vhdDifferencing = 4
+)
+
+// vhdVirtualSize reads the footer at the end of a VHD holding size bytes
+// and returns the size of its disk.
+func vhdVirtualSize(r io.ReaderAt, size int64) (int64, error) {
+	if size < vhdFooterSize {
+		return 0, errors.New("VHD is missing its footer")
+	}
+	footer := make([]byte, vhdFooterSize)
+	if err := readFullAt(r, footer, size-vhdFooterSize); err != nil {
+		return 0, fmt.Errorf("unable to read VHD footer: %s", err.Error())
+	}
+	if string(footer[:len(vhdCookie)]) != vhdCookie {
+		return 0, errors.New("VHD is missing its footer")
+	}
+
+	switch diskType := binary.BigEndian.Uint32(footer[60:]); diskType {
+	case vhdFixed, vhdDynamic:
+	case vhdDifferencing:
+		return 0, errors.New("differencing VHDs are not supported")
+	default:
+		return 0, fmt.Errorf("unsupported VHD disk type %d", diskType)
+	}
+
+	return int64(binary.BigEndian.Uint64(footer[48:])), nil
+}
@@ -0,0 +1,462 @@
+package diskformat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+)
+
+// Only the hosted sparse extents of the VMware Virtual Disk Format 5.0
+// specification are read: monolithic sparse VMDKs, and the stream-optimized
+// ones found in OVAs, whose grains are compressed.
+
+const (
+	vmdkMagic           = "KDMV"
+	vmdkDescriptorMagic = "# Disk DescriptorFile"
+
+	vmdkSectorSize = 512
+
+	// vmdkGDAtEnd is the grain directory offset of stream-optimized
+	// VMDKs, whose footer holds the actual one.
+	vmdkGDAtEnd = 0xffffffffffffffff
+
+	vmdkFlagValidNewline = 1 << 0
+	vmdkFlagZeroGrainGTE = 1 << 2
+	vmdkFlagCompressed   = 1 << 16
+	vmdkFlagMarkers      = 1 << 17
+
+	vmdkCompressionDeflate = 1
+
+	// vmdkMaxGrainSectors bounds the grain size at 2 MiB, well above the
+	// 64 KiB VMware uses.
+	vmdkMaxGrainSectors = 4096
+	// vmdkGTEntries is the number of entries of a grain table, which the
+	// specification fixes.
+	vmdkGTEntries = 512
+)
+
+type vmdk struct {
+	r          io.ReaderAt
+	capacity   int64
+	grainSize  int64
+	gtEntries  int64
+	gd         []uint32
+	compressed bool
+}
+
+// vmdkHeader is the sparse extent header, also found in the footer of
+// stream-optimized VMDKs.
+type vmdkHeader struct {
+	Magic              [4]byte
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+}
+
+func readVMDKHeader(r io.ReaderAt, offset int64) (*vmdkHeader, error) {
+	buf := make([]byte, vmdkSectorSize)
+	err := readFullAt(r, buf, offset)
+	// Descriptor files can be shorter than a sector
+	if bytes.HasPrefix(buf, []byte(vmdkDescriptorMagic)) {
+		return nil, errors.New("VMDK descriptors referring to separate extents are not supported, only monolithic sparse and stream-optimized VMDKs")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read VMDK header: %s", err.Error())
+	}
+
+	var header vmdkHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Magic[:]) != vmdkMagic {
+		return nil, errors.New("not a sparse VMDK")
+	}
+	return &header, nil
+}
+
+func openVMDK(r io.ReaderAt, size int64) (*vmdk, error) {
+	header, err := readVMDKHeader(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if header.GdOffset == vmdkGDAtEnd {
+		// The footer is followed by the end-of-stream marker
+		if size < 3*vmdkSectorSize {
+			return nil, errors.New("stream-optimized VMDK is missing its footer")
+		}
+		header, err = readVMDKHeader(r, size-2*vmdkSectorSize)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read footer of stream-optimized VMDK: %s", err.Error())
+		}
+	}
+
+	// Checked before multiplying, as they can be anything in a corrupt
+	// header
+	if header.GrainSize < 1 || header.GrainSize > vmdkMaxGrainSectors || header.GrainSize&(header.GrainSize-1) != 0 {
+		return nil, fmt.Errorf("invalid VMDK grain size of %d sectors, must be a power of two up to %d", header.GrainSize, vmdkMaxGrainSectors)
+	}
+	if header.NumGTEsPerGT != vmdkGTEntries {
+		return nil, fmt.Errorf("invalid VMDK grain tables of %d entries, must be %d", header.NumGTEsPerGT, vmdkGTEntries)
+	}
+	if header.Capacity > maxVirtualSize/vmdkSectorSize {
+		return nil, fmt.Errorf("invalid VMDK capacity of %d sectors", header.Capacity)
+	}
+
+	v := &vmdk{
+		r:          r,
+		capacity:   int64(header.Capacity) * vmdkSectorSize,
+		grainSize:  int64(header.GrainSize) * vmdkSectorSize,
+		gtEntries:  int64(header.NumGTEsPerGT),
+		compressed: header.Flags&vmdkFlagCompressed != 0,
+	}
+	if v.compressed && header.CompressAlgorithm != vmdkCompressionDeflate {
+		return nil, fmt.Errorf("unsupported VMDK compression algorithm %d", header.CompressAlgorithm)
+	}
+
+	// The grain directory has to be within the file
+	perGT := v.grainSize * v.gtEntries
+	gdSize := (v.capacity + perGT - 1) / perGT * 4
+	if header.GdOffset > uint64(size/vmdkSectorSize) || int64(header.GdOffset)*vmdkSectorSize+gdSize > size {
+		return nil, fmt.Errorf("VMDK grain directory of %d bytes at sector %d is past the end of the file", gdSize, header.GdOffset)
+	}
+	gd := make([]byte, gdSize)
+	if err := readFullAt(r, gd, int64(header.GdOffset)*vmdkSectorSize); err != nil {
+		return nil, fmt.Errorf("unable to read VMDK grain directory: %s", err.Error())
+	}
+	v.gd = make([]uint32, len(gd)/4)
+	for i := range v.gd {
+		v.gd[i] = binary.LittleEndian.Uint32(gd[i*4:])
+	}
+
+	return v, nil
+}
+
+func (v *vmdk) virtualSize() int64 {
+	return v.capacity
+}
+
+func (v *vmdk) walk(fn func(offset int64, data []byte) error) error {
+	table := make([]byte, v.gtEntries*4)
+	grain := make([]byte, v.grainSize)
+	for i, gtSector := range v.gd {
+		if gtSector == 0 {
+			continue
+		}
+		if err := readFullAt(v.r, table, int64(gtSector)*vmdkSectorSize); err != nil {
+			return fmt.Errorf("unable to read VMDK grain table: %s", err.Error())
+		}
+
+		for j := int64(0); j < v.gtEntries; j++ {
+			offset := (int64(i)*v.gtEntries + j) * v.grainSize
+			if offset >= v.capacity {
+				return nil
+			}
+
+			// Sector 1 stands for a grain of zeros where the
+			// zeroed-grain flag is set; no grain can be stored there
+			// anyway, as the header takes it up.
+			grainSector := int64(binary.LittleEndian.Uint32(table[j*4:]))
+			if grainSector <= 1 {
+				continue
+			}
+
+			data, err := v.readGrain(grainSector*vmdkSectorSize, grain)
+			if err != nil {
+				return fmt.Errorf("unable to read grain at offset %d: %s", offset, err.Error())
+			}
+			if rest := v.capacity - offset; rest < int64(len(data)) {
+				data = data[:rest]
+			}
+			if err := fn(offset, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readGrain reads the grain stored at offset into buf.
+func (v *vmdk) readGrain(offset int64, buf []byte) ([]byte, error) {
+	if !v.compressed {
+		if err := readFullAt(v.r, buf, offset); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	// Compressed grains start with their LBA and compressed size
+	marker := make([]byte, 12)
+	if err := readFullAt(v.r, marker, offset); err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(marker[8:]))
+	if size > 2*v.grainSize {
+		return nil, fmt.Errorf("compressed grain of %d bytes is larger than it can be", size)
+	}
+	compressed := make([]byte, size)
+	if err := readFullAt(v.r, compressed, offset+int64(len(marker))); err != nil {
+		return nil, err
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress: %s", err.Error())
+	}
+	// The last grain of the disk may be cut short
+	n, err := io.ReadFull(zr, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("unable to decompress: %s", err.Error())
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return buf, nil
+}
+
+const (
+	// vmdkWriteGrainSectors and vmdkWriteGTEntries are what VMware uses:
+	// 64 KiB grains and grain tables of 512 entries.
+	vmdkWriteGrainSectors = 128
+	vmdkWriteGTEntries    = 512
+
+	// The types of the metadata markers of stream-optimized VMDKs.
+	vmdkMarkerEOS    = 0
+	vmdkMarkerGT     = 1
+	vmdkMarkerGD     = 2
+	vmdkMarkerFooter = 3
+)
+
+// vmdkDescriptor is the embedded descriptor of a stream-optimized VMDK,
+// given the CID, the capacity in sectors, the file name and the number of
+// cylinders.
+const vmdkDescriptor = `# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.adapterType = "lsilogic"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "255"
+ddb.geometry.sectors = "63"
+`
+
+// vmdkWriter writes a stream-optimized VMDK, the format OVAs hold. The
+// header and the descriptor take up the first sectors, followed by the
+// compressed grains as they are written, each grain table after the grains
+// it covers, and the grain directory and footer at the end.
+type vmdkWriter struct {
+	blockWriter
+	w          io.WriterAt
+	header     vmdkHeader
+	descriptor []byte
+	sector     int64
+
+	gd      []uint32
+	gt      []uint32
+	gtIndex int
+}
+
+func newVMDKWriter(w io.WriterAt, size int64, name string) *vmdkWriter {
+	capacity := (size + vmdkSectorSize - 1) / vmdkSectorSize
+	cylinders := min(capacity/(255*63), 65535)
+	descriptor := fmt.Sprintf(vmdkDescriptor, rand.Uint32(), capacity, name, cylinders)
+	descriptorSectors := sectors(int64(len(descriptor)))
+
+	v := &vmdkWriter{
+		w: w,
+		header: vmdkHeader{
+			Version:            3,
+			Flags:              vmdkFlagValidNewline | vmdkFlagCompressed | vmdkFlagMarkers,
+			Capacity:           uint64(capacity),
+			GrainSize:          vmdkWriteGrainSectors,
+			DescriptorOffset:   1,
+			DescriptorSize:     uint64(descriptorSectors),
+			NumGTEsPerGT:       vmdkWriteGTEntries,
+			OverHead:           uint64(1 + descriptorSectors),
+			SingleEndLineChar:  '\n',
+			NonEndLineChar:     ' ',
+			DoubleEndLineChar1: '\r',
+			DoubleEndLineChar2: '\n',
+			CompressAlgorithm:  vmdkCompressionDeflate,
+		},
+		descriptor: []byte(descriptor),
+		sector:     1 + descriptorSectors,
+		gt:         make([]uint32, vmdkWriteGTEntries),
+	}
+	copy(v.header.Magic[:], vmdkMagic)
+	v.blockWriter = newBlockWriter(size, vmdkWriteGrainSectors*vmdkSectorSize, v.writeGrain)
+
+	perGT := int64(vmdkWriteGrainSectors * vmdkWriteGTEntries)
+	v.gd = make([]uint32, (capacity+perGT-1)/perGT)
+	return v
+}
+
+// sectors returns how many sectors n bytes take up.
+func sectors(n int64) int64 {
+	return (n + vmdkSectorSize - 1) / vmdkSectorSize
+}
+
+// writeSectors writes data at the next sector and returns the sector it
+// starts at. The rest of its last sector is left unwritten, to read as
+// zeros once the sectors after it are written.
+func (v *vmdkWriter) writeSectors(data []byte) (int64, error) {
+	sector := v.sector
+	if _, err := v.w.WriteAt(data, sector*vmdkSectorSize); err != nil {
+		return 0, err
+	}
+	v.sector += sectors(int64(len(data)))
+	return sector, nil
+}
+
+// writeMarker writes a metadata marker of the given type, announcing n
+// sectors of metadata.
+func (v *vmdkWriter) writeMarker(markerType uint32, n int64) error {
+	marker := make([]byte, vmdkSectorSize)
+	binary.LittleEndian.PutUint64(marker, uint64(n))
+	binary.LittleEndian.PutUint32(marker[12:], markerType)
+	_, err := v.writeSectors(marker)
+	return err
+}
+
+func (v *vmdkWriter) writeGrain(offset int64, data []byte) error {
+	grain := offset / (vmdkWriteGrainSectors * vmdkSectorSize)
+	if index := int(grain / vmdkWriteGTEntries); index != v.gtIndex {
+		if err := v.flushGT(); err != nil {
+			return err
+		}
+		v.gtIndex = index
+	}
+
+	// Grains start with their LBA and compressed size
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 12))
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	marker := buf.Bytes()
+	binary.LittleEndian.PutUint64(marker, uint64(offset/vmdkSectorSize))
+	binary.LittleEndian.PutUint32(marker[8:], uint32(buf.Len()-12))
+
+	sector, err := v.writeSectors(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	v.gt[grain%vmdkWriteGTEntries] = uint32(sector)
+	return nil
+}
+
+// flushGT writes the grain table of the grains written last, unless none
+// were.
+func (v *vmdkWriter) flushGT() error {
+	if isZero32(v.gt) {
+		return nil
+	}
+
+	table := make([]byte, len(v.gt)*4)
+	for i, entry := range v.gt {
+		binary.LittleEndian.PutUint32(table[i*4:], entry)
+	}
+	if err := v.writeMarker(vmdkMarkerGT, sectors(int64(len(table)))); err != nil {
+		return err
+	}
+	sector, err := v.writeSectors(table)
+	if err != nil {
+		return err
+	}
+	v.gd[v.gtIndex] = uint32(sector)
+	clear(v.gt)
+	return nil
+}
+
+func isZero32(entries []uint32) bool {
+	for _, entry := range entries {
+		if entry != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *vmdkWriter) Close() error {
+	if err := v.finish(); err != nil {
+		return err
+	}
+	if err := v.flushGT(); err != nil {
+		return err
+	}
+
+	gd := make([]byte, len(v.gd)*4)
+	for i, entry := range v.gd {
+		binary.LittleEndian.PutUint32(gd[i*4:], entry)
+	}
+	if err := v.writeMarker(vmdkMarkerGD, sectors(int64(len(gd)))); err != nil {
+		return err
+	}
+	gdSector, err := v.writeSectors(gd)
+	if err != nil {
+		return err
+	}
+
+	// The header at the start says to look for the grain directory in the
+	// footer, as readers of the stream can't know where it is
+	footer := v.header
+	footer.GdOffset = uint64(gdSector)
+	if err := v.writeMarker(vmdkMarkerFooter, 1); err != nil {
+		return err
+	}
+	if err := v.writeHeader(footer, v.sector); err != nil {
+		return err
+	}
+	v.sector++
+	if err := v.writeMarker(vmdkMarkerEOS, 0); err != nil {
+		return err
+	}
+
+	header := v.header
+	header.GdOffset = vmdkGDAtEnd
+	if err := v.writeHeader(header, 0); err != nil {
+		return err
+	}
+	_, err = v.w.WriteAt(v.descriptor, vmdkSectorSize)
+	return err
+}
+
+// writeHeader writes header, padded to a sector, at the given sector.
+func (v *vmdkWriter) writeHeader(header vmdkHeader, sector int64) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	buf.Write(make([]byte, vmdkSectorSize-buf.Len()))
+	_, err := v.w.WriteAt(buf.Bytes(), sector*vmdkSectorSize)
+	return err
+}
@@ -0,0 +1,305 @@
+package diskimage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	hconfig "github.com/hashicorp/packer-plugin-sdk/template/config"
+	xsclient "github.com/terra-farm/go-xen-api-client"
+	xscommon "github.com/xenserver/packer-builder-xenserver/builder/xenserver/common"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskformat"
+)
+
+// Builder imports a cloud image published as a qcow2, VMDK, VHD or raw disk
+// image as the boot disk of a new VM, and configures it with a cloud-init
+// NoCloud seed rather than installing it from an ISO.
+type Builder struct {
+	config xscommon.Config
+	runner multistep.Runner
+}
+
+func (self *Builder) ConfigSpec() hcldec.ObjectSpec { return self.config.FlatMapstructure().HCL2Spec() }
+
+func (self *Builder) Prepare(raws ...interface{}) (params []string, warns []string, retErr error) {
+
+	var errs *packer.MultiError
+
+	err := hconfig.Decode(&self.config, &hconfig.DecodeOpts{
+		Interpolate: true,
+	}, raws...)
+
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
+	errs = packer.MultiErrorAppend(
+		errs, self.config.CommonConfig.Prepare(self.config.GetInterpContext(), &self.config.PackerConfig)...)
+	errs = packer.MultiErrorAppend(errs, self.config.SSHConfig.Prepare(self.config.GetInterpContext())...)
+
+	// Set default values
+
+	if self.config.VCPUsMax == 0 {
+		self.config.VCPUsMax = 1
+	}
+
+	if self.config.VCPUsAtStartup == 0 {
+		self.config.VCPUsAtStartup = 1
+	}
+
+	if self.config.VCPUsAtStartup > self.config.VCPUsMax {
+		self.config.VCPUsAtStartup = self.config.VCPUsMax
+	}
+
+	if self.config.VMMemory == 0 {
+		self.config.VMMemory = 1024
+	}
+
+	if self.config.CloneTemplate == "" {
+		self.config.CloneTemplate = "Other install media"
+	}
+
+	if self.config.Firmware == "" {
+		self.config.Firmware = "bios"
+	}
+
+	if self.config.DiskName == "" {
+		self.config.DiskName = "Packer-disk"
+	}
+
+	if self.config.RawInstallTimeout == "" {
+		self.config.RawInstallTimeout = "20m"
+	}
+
+	if self.config.CloudInitMetaData == "" {
+		self.config.CloudInitMetaData = fmt.Sprintf("instance-id: %s\n", self.config.VMName)
+	}
+
+	if self.config.CloudInitUserData == "" {
+		self.config.CloudInitUserData = "#cloud-config\n"
+	}
+
+	// Validation
+
+	self.config.InstallTimeout, err = time.ParseDuration(self.config.RawInstallTimeout)
+	if err != nil {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("Failed to parse install_timeout: %s", err))
+	}
+
+	if len(self.config.ImageUrls) == 0 {
+		if self.config.ImageUrl == "" {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("One of image_url or image_urls must be specified."))
+		} else {
+			self.config.ImageUrls = []string{self.config.ImageUrl}
+		}
+	} else if self.config.ImageUrl != "" {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("Only one of image_url or image_urls may be specified."))
+	}
+
+	// The SDK validates the checksum and the URLs of any download
+	image_config := commonsteps.ISOConfig{
+		ISOChecksum: self.config.ImageChecksum,
+		ISOUrls:     self.config.ImageUrls,
+	}
+	_, image_errs := image_config.Prepare(nil)
+	for _, this_err := range image_errs {
+		errs = packer.MultiErrorAppend(errs, this_err)
+	}
+
+	if self.config.ImageFormat != "" {
+		if _, err := diskformat.ParseFormat(self.config.ImageFormat); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Invalid image_format: %s", err))
+		}
+	}
+
+	if len(self.config.BootCommand) > 0 {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("boot_command is not supported, the image is configured by cloud-init"))
+	}
+
+	if self.config.IPGetter == "http" {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("ip_getter 'http' is not supported, there is no HTTP server to fetch from"))
+	}
+
+	if len(errs.Errors) > 0 {
+		retErr = errors.New(errs.Error())
+	}
+
+	return nil, nil, retErr
+
+}
+
+// cloudInitSeed returns the files of the NoCloud seed.
+func (self *Builder) cloudInitSeed() map[string]string {
+	seed := map[string]string{
+		"meta-data": self.config.CloudInitMetaData,
+		"user-data": self.config.CloudInitUserData,
+	}
+	if self.config.CloudInitNetworkConfig != "" {
+		seed["network-config"] = self.config.CloudInitNetworkConfig
+	}
+	return seed
+}
+
+func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
+	state, logout, err := xscommon.NewBuildState(ctx, self.config, ui, hook)
+	if err != nil {
+		return nil, err
+	}
+	defer logout()
+
+	statePath := func(key string) func() string {
+		return func() string {
+			if path, ok := state.GetOk(key); ok {
+				return path.(string)
+			}
+			return ""
+		}
+	}
+	diskFormat := func() diskformat.Format {
+		return state.Get("disk_format").(diskformat.Format)
+	}
+
+	//Build the steps
+	steps := []multistep.Step{
+		new(xscommon.StepPreflight),
+		&commonsteps.StepDownload{
+			Checksum:    self.config.ImageChecksum,
+			Description: "disk image",
+			ResultKey:   "image_path",
+			Url:         self.config.ImageUrls,
+		},
+		&xscommon.StepPrepareOutputDir{
+			Force: self.config.PackerForce,
+			Path:  self.config.OutputDir,
+		},
+		&stepConvertImage{
+			Format: self.config.ImageFormat,
+		},
+		&commonsteps.StepCreateFloppy{
+			Content: self.cloudInitSeed(),
+			Label:   "cidata",
+		},
+		&xscommon.StepCheckFreeSpace{
+			Uploads: func() []xscommon.Upload {
+				diskSize := int64(self.config.DiskSize) * 1024 * 1024
+				return []xscommon.Upload{
+					{Path: statePath("disk_path")(), SR: self.config.GetSR, Size: diskSize},
+					{Path: statePath("floppy_path")(), SR: self.config.GetSR},
+				}
+			},
+		},
+		&xscommon.StepUploadVdi{
+			VdiNameFunc: func() string {
+				return self.config.DiskName
+			},
+			ImagePathFunc: statePath("disk_path"),
+			VdiUuidKey:    "disk_vdi_uuid",
+			SR:            self.config.GetSR,
+			FormatFunc:    diskFormat,
+		},
+		&stepResizeDisk{
+			Size: self.config.DiskSize,
+		},
+		&xscommon.StepUploadVdi{
+			VdiNameFunc: func() string {
+				return "Packer-cloud-init-seed"
+			},
+			ImagePathFunc: statePath("floppy_path"),
+			VdiUuidKey:    "seed_vdi_uuid",
+			SR:            self.config.GetSR,
+		},
+		&xscommon.StepFindVdi{
+			VdiName:    self.config.ToolsIsoName,
+			VdiUuidKey: "tools_vdi_uuid",
+		},
+		&xscommon.StepGetVmTemplate{
+			SkipStep: self.config.SkipSetTemplate,
+		},
+		&xscommon.StepCreateInstance{
+			AssumePreInstalledOS: true,
+		},
+		// The boot disk is attached first, to get userdevice 0
+		&xscommon.StepAttachVdi{
+			VdiUuidKey: "disk_vdi_uuid",
+			VdiType:    xsclient.VbdTypeDisk,
+		},
+		&xscommon.StepAttachVdi{
+			VdiUuidKey: "seed_vdi_uuid",
+			VdiType:    xsclient.VbdTypeDisk,
+		},
+		&xscommon.StepAttachVdi{
+			VdiUuidKey: "tools_vdi_uuid",
+			VdiType:    xsclient.VbdTypeCD,
+		},
+		new(xscommon.StepAttachExistingDisks),
+		new(xscommon.StepStartVmPaused),
+		new(xscommon.StepSetVmHostSshAddress),
+		new(xscommon.StepBootWait),
+		&xscommon.StepWaitForIP{
+			Timeout: self.config.InstallTimeout,
+		},
+		&xscommon.StepForwardPortOverSSH{
+			RemotePort:  xscommon.InstanceSSHPort,
+			RemoteDest:  xscommon.InstanceSSHIP,
+			HostPortMin: self.config.HostPortMin,
+			HostPortMax: self.config.HostPortMax,
+			ResultKey:   "local_ssh_port",
+		},
+		&communicator.StepConnect{
+			Config:    &self.config.SSHConfig.Comm,
+			Host:      xscommon.InstanceSSHIP,
+			SSHConfig: self.config.Comm.SSHConfigFunc(),
+			SSHPort:   xscommon.InstanceSSHPort,
+		},
+		new(commonsteps.StepProvision),
+		new(xscommon.StepShutdown),
+	}
+
+	if !self.config.SkipSetTemplate {
+		steps = append(steps,
+			&xscommon.StepCleanUpTemplate{
+				Force: self.config.PackerForce,
+			},
+			new(xscommon.StepSetVmToTemplate))
+	}
+
+	steps = append(steps,
+		&xscommon.StepDetachVdi{
+			VdiUuidKey: "tools_vdi_uuid",
+		},
+		&xscommon.StepDetachVdi{
+			VdiUuidKey: "seed_vdi_uuid",
+		},
+		new(xscommon.StepDetachExistingDisks),
+		new(xscommon.StepExport))
+
+	self.runner = &multistep.BasicRunner{Steps: steps}
+	self.runner.Run(ctx, state)
+
+	if rawErr, ok := state.GetOk("error"); ok {
+		return nil, rawErr.(error)
+	}
+
+	// If we were interrupted or cancelled, then just exit.
+	if _, ok := state.GetOk(multistep.StateCancelled); ok {
+		return nil, errors.New("Build was cancelled.")
+	}
+	if _, ok := state.GetOk(multistep.StateHalted); ok {
+		return nil, errors.New("Build was halted.")
+	}
+
+	artifact, _ := xscommon.NewArtifact(self.config.OutputDir)
+
+	return artifact, nil
+}
@@ -0,0 +1,319 @@
+package diskimage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/xapitest"
+)
+
+func testConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"remote_host":      "localhost",
+		"remote_username":  "admin",
+		"remote_password":  "admin",
+		"vm_name":          "foo",
+		"image_url":        "https://cloud-images.example.com/noble-server-cloudimg-amd64.img",
+		"image_checksum":   "sha256:81ddc5ec50ae3e6bd4b0c7ee1fd6fa2ef54f3a3d9b9c3e1d6e7b0e1d0d7a1b2c",
+		"shutdown_command": "yes",
+		"ssh_username":     "foo",
+
+		common.BuildNameConfigKey: "foo",
+	}
+}
+
+func TestBuilder_ImplementsBuilder(t *testing.T) {
+	var raw interface{}
+	raw = &Builder{}
+	if _, ok := raw.(packer.Builder); !ok {
+		t.Error("Builder must implement builder.")
+	}
+}
+
+func TestBuilderPrepare_Defaults(t *testing.T) {
+	var b Builder
+	config := testConfig()
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if b.config.CloneTemplate != "Other install media" {
+		t.Errorf("bad clone template: %s", b.config.CloneTemplate)
+	}
+
+	if b.config.DiskName != "Packer-disk" {
+		t.Errorf("bad disk name: %s", b.config.DiskName)
+	}
+
+	if b.config.CloudInitMetaData != "instance-id: foo\n" {
+		t.Errorf("bad meta-data: %q", b.config.CloudInitMetaData)
+	}
+
+	if b.config.Format != "xva" {
+		t.Errorf("bad format: %s", b.config.Format)
+	}
+
+	if b.config.KeepVM != "never" {
+		t.Errorf("bad keep instance: %s", b.config.KeepVM)
+	}
+}
+
+func TestBuilderPrepare_BootCommand(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	config["boot_command"] = []string{"<enter>"}
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_ImageFormat(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	config["image_format"] = "vdi"
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	for _, format := range []string{"qcow2", "vmdk", "vhd", "raw"} {
+		config["image_format"] = format
+		b = Builder{}
+		_, warns, err = b.Prepare(config)
+		if len(warns) > 0 {
+			t.Fatalf("bad: %#v", warns)
+		}
+		if err != nil {
+			t.Fatalf("should not have error: %s", err)
+		}
+	}
+}
+
+func TestBuilderPrepare_ImageUrl(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Test neither set
+	delete(config, "image_url")
+	_, _, err := b.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Test both set
+	config["image_url"] = "https://cloud-images.example.com/disk.img"
+	config["image_urls"] = []string{"https://cloud-images.example.com/disk.img"}
+	b = Builder{}
+	_, _, err = b.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Test just image_urls set
+	delete(config, "image_url")
+	config["image_urls"] = []string{
+		"https://cloud-images.example.com/disk.img",
+		"https://mirror.example.com/disk.img",
+	}
+	b = Builder{}
+	_, _, err = b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if len(b.config.ImageUrls) != 2 {
+		t.Fatalf("bad: %#v", b.config.ImageUrls)
+	}
+}
+
+// writeQCOW2 writes a version 2 qcow2 image of a 2 KiB disk whose second
+// 512-byte cluster holds data, and returns the raw disk.
+func writeQCOW2(t *testing.T, path string) []byte {
+	const cluster = 512
+	image := make([]byte, 4*cluster)
+	be := binary.BigEndian
+	copy(image, "QFI\xfb")
+	be.PutUint32(image[4:], 2)
+	be.PutUint32(image[20:], 9)
+	be.PutUint64(image[24:], 4*cluster)
+	be.PutUint32(image[36:], 1)
+	be.PutUint64(image[40:], cluster)
+	be.PutUint64(image[cluster:], 2*cluster)
+	be.PutUint64(image[2*cluster+8:], 3*cluster)
+
+	data := bytes.Repeat([]byte("root"), cluster/4)
+	copy(image[3*cluster:], data)
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	disk := make([]byte, 4*cluster)
+	copy(disk[cluster:], data)
+	return disk
+}
+
+func testRunConfig(t *testing.T, server *xapitest.Server, image string) (map[string]interface{}, string) {
+	config := testConfig()
+	dir := server.Configure(t, config)
+	config["image_url"] = filepath.Join(dir, image)
+	config["image_checksum"] = "none"
+	return config, dir
+}
+
+// bootDisk returns the VDI attached as the first disk of the VM named foo.
+func bootDisk(t *testing.T, server *xapitest.Server) string {
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	vbds := server.Records("VBD")
+	for _, vbd := range server.Records("VM")[vms[0]]["VBDs"].([]interface{}) {
+		record := vbds[vbd.(string)]
+		if record["type"] == "Disk" && record["userdevice"] == "0" {
+			return record["VDI"].(string)
+		}
+	}
+	t.Fatal("VM should have a boot disk")
+	return ""
+}
+
+func TestBuilderRun(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server, "disk.qcow2")
+	disk := writeQCOW2(t, filepath.Join(dir, "disk.qcow2"))
+	config["cloud_init_user_data"] = "#cloud-config\npassword: packer\n"
+	config["cloud_init_network_config"] = "version: 2\n"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	artifact, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if artifact == nil {
+		t.Fatal("should have an artifact")
+	}
+
+	vdi := bootDisk(t, server)
+	if !bytes.Equal(server.Content(vdi), disk) {
+		t.Errorf("boot disk should hold the qcow2 image converted to raw")
+	}
+	if record := server.Records("VDI")[vdi]; record["name_label"] != "Packer-disk" {
+		t.Errorf("bad boot disk name: %v", record["name_label"])
+	}
+	if n := server.Calls("VDI.resize"); n != 0 {
+		t.Errorf("should not have resized the disk, got %d calls", n)
+	}
+
+	seeds := server.Find("VDI", "Packer-cloud-init-seed")
+	if len(seeds) != 1 {
+		t.Fatalf("bad: expected one cloud-init seed, got %d", len(seeds))
+	}
+	seed := server.Content(seeds[0])
+	for _, content := range []string{"password: packer", "version: 2", "instance-id: foo"} {
+		if !bytes.Contains(seed, []byte(content)) {
+			t.Errorf("cloud-init seed should contain %q", content)
+		}
+	}
+	if len(server.Records("VDI")[seeds[0]]["VBDs"].([]interface{})) != 0 {
+		t.Errorf("cloud-init seed should have been detached")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "output", "foo.xva")); err != nil {
+		t.Errorf("should have exported the VM: %s", err)
+	}
+}
+
+func TestBuilderRun_DiskSize(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server, "disk.raw")
+	disk := bytes.Repeat([]byte("root"), 1024*1024/4)
+	if err := os.WriteFile(filepath.Join(dir, "disk.raw"), disk, 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	config["disk_size"] = 10
+	config["format"] = "none"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	vdi := bootDisk(t, server)
+	if !bytes.Equal(server.Content(vdi), disk) {
+		t.Errorf("boot disk should hold the raw image as it is")
+	}
+	if size := server.Records("VDI")[vdi]["virtual_size"]; size != fmt.Sprint(10<<20) {
+		t.Errorf("boot disk should have been resized to 10 MiB, got %v", size)
+	}
+}
+
+func TestBuilderRun_DiskSizeTooSmall(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server, "disk.raw")
+	if err := os.WriteFile(filepath.Join(dir, "disk.raw"), make([]byte, 2*1024*1024), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	config["disk_size"] = 1
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err == nil || !strings.Contains(err.Error(), "cannot be shrunk") {
+		t.Fatalf("expected disk_size to be refused, got %v", err)
+	}
+	if n := server.Calls("VDI.create"); n != 0 {
+		t.Errorf("should have failed before uploading anything, got %d VDIs created", n)
+	}
+}
@@ -0,0 +1,91 @@
+package diskimage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	xscommon "github.com/xenserver/packer-builder-xenserver/builder/xenserver/common"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskformat"
+)
+
+// stepConvertImage converts the downloaded image to raw, unless it is in a
+// format import_raw_vdi accepts already. It puts the image to upload in
+// disk_path and its format in disk_format.
+type stepConvertImage struct {
+	// Format is the format of the image, detected if empty.
+	Format string
+
+	tempDir string
+}
+
+func (self *stepConvertImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(xscommon.Config)
+	ui := state.Get("ui").(packer.Ui)
+	imagePath := state.Get("image_path").(string)
+
+	fail := func(err error) multistep.StepAction {
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	ui.Say("Step: Convert disk image")
+
+	var format diskformat.Format
+	var err error
+	if self.Format != "" {
+		format, err = diskformat.ParseFormat(self.Format)
+	} else {
+		format, err = diskformat.Detect(imagePath)
+	}
+	if err != nil {
+		return fail(fmt.Errorf("Unable to determine the format of '%s': %s", imagePath, err.Error()))
+	}
+
+	size, err := diskformat.VirtualSize(imagePath, format)
+	if err != nil {
+		return fail(fmt.Errorf("Unable to read %s image '%s': %s", format, imagePath, err.Error()))
+	}
+	ui.Message(fmt.Sprintf("Disk image is a %s image of a %d MiB disk", format, (size+1024*1024-1)/1024/1024))
+
+	// Disks can only grow, so check before anything is converted or
+	// uploaded
+	if diskSize := int64(config.DiskSize) * 1024 * 1024; diskSize != 0 && diskSize < size {
+		return fail(fmt.Errorf("disk_size of %d MiB is smaller than the disk of the image, which cannot be shrunk", config.DiskSize))
+	}
+
+	if format.Importable() {
+		state.Put("disk_path", imagePath)
+		state.Put("disk_format", format)
+		return multistep.ActionContinue
+	}
+
+	self.tempDir, err = os.MkdirTemp("", "packer-disk-image")
+	if err != nil {
+		return fail(fmt.Errorf("Unable to create temporary directory: %s", err.Error()))
+	}
+	rawPath := filepath.Join(self.tempDir, "disk.raw")
+
+	ui.Message(fmt.Sprintf("Converting %s image to raw...", format))
+	if _, err := diskformat.ConvertToRaw(rawPath, imagePath, format); err != nil {
+		return fail(err)
+	}
+
+	state.Put("disk_path", rawPath)
+	state.Put("disk_format", diskformat.Raw)
+	return multistep.ActionContinue
+}
+
+func (self *stepConvertImage) Cleanup(state multistep.StateBag) {
+	if self.tempDir == "" {
+		return
+	}
+	if err := os.RemoveAll(self.tempDir); err != nil {
+		log.Printf("Unable to remove converted disk image: %s", err.Error())
+	}
+}
@@ -0,0 +1,58 @@
+package diskimage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	xscommon "github.com/xenserver/packer-builder-xenserver/builder/xenserver/common"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskformat"
+)
+
+// stepResizeDisk grows the uploaded boot disk to Size MiB. Cloud images
+// come with small disks, which cloud-init grows the root file system of to
+// fill on first boot.
+type stepResizeDisk struct {
+	Size uint
+}
+
+func (self *stepResizeDisk) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	c := state.Get("client").(xscommon.Client)
+
+	if self.Size == 0 {
+		return multistep.ActionContinue
+	}
+
+	fail := func(err error) multistep.StepAction {
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	// stepConvertImage made sure that the disk isn't larger already
+	current, err := diskformat.VirtualSize(state.Get("disk_path").(string), state.Get("disk_format").(diskformat.Format))
+	if err != nil {
+		return fail(fmt.Errorf("Unable to get size of disk image: %s", err.Error()))
+	}
+	size := int64(self.Size) * 1024 * 1024
+	if size == current {
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Step: Resize disk to %d MiB", self.Size))
+
+	vdiUuid := state.Get("disk_vdi_uuid").(string)
+	vdi, err := c.GetVDIByUUID(ctx, vdiUuid)
+	if err != nil {
+		return fail(fmt.Errorf("Unable to get VDI from UUID '%s': %s", vdiUuid, err.Error()))
+	}
+	if err := c.ResizeVDI(ctx, vdi, int(size)); err != nil {
+		return fail(fmt.Errorf("Unable to resize VDI '%s': %s", vdiUuid, err.Error()))
+	}
+
+	return multistep.ActionContinue
+}
+
+func (self *stepResizeDisk) Cleanup(state multistep.StateBag) {}
@@ -172,25 +172,22 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, warns []stri
 }
 
 func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
-	c, err := xscommon.NewXenAPIClient(self.config.HostIp, self.config.Username, self.config.Password)
-
+	state, logout, err := xscommon.NewBuildState(ctx, self.config, ui, hook)
 	if err != nil {
 		return nil, err
 	}
-	ui.Say("XAPI client session established")
-
-	c.GetClient().Host.GetAll(c.GetSessionRef())
-
-	//Share state between the other steps using a statebag
-	state := new(multistep.BasicStateBag)
-	state.Put("client", c)
-	state.Put("config", self.config)
-	state.Put("commonconfig", self.config.CommonConfig)
-	state.Put("hook", hook)
-	state.Put("ui", ui)
+	defer logout()
 
 	httpReqChan := make(chan string, 1)
 
+	// statePath returns the path a step stored under key, if any
+	statePath := func(key string) string {
+		if value, ok := state.GetOk(key); ok {
+			return value.(string)
+		}
+		return ""
+	}
+
 	//Build the steps
 	download_steps := []multistep.Step{
 		&commonsteps.StepDownload{
@@ -216,6 +213,22 @@ func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (p
 		&xscommon.StepHTTPServer{
 			Chan: httpReqChan,
 		},
+		&xscommon.StepCheckFreeSpace{
+			CreateDisks: true,
+			Uploads: func() []xscommon.Upload {
+				uploads := []xscommon.Upload{
+					{Path: statePath("cd_path")},
+					{Path: statePath("floppy_path")},
+				}
+				if self.config.ISOName == "" && len(self.config.ISOUrls) > 0 {
+					uploads = append(uploads, xscommon.Upload{
+						Path:    statePath("iso_path"),
+						VdiName: path.Base(self.config.ISOUrls[0]),
+					})
+				}
+				return uploads
+			},
+		},
 		&xscommon.StepUploadVdi{
 			VdiNameFunc: func() string {
 				return "Packer-CD"
@@ -241,7 +254,7 @@ func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (p
 			VdiUuidKey: "floppy_vdi_uuid",
 		},
 		&xscommon.StepFindOrUploadVdi{
-			xscommon.StepUploadVdi{
+			StepUploadVdi: xscommon.StepUploadVdi{
 				VdiNameFunc: func() string {
 					if self.config.ISOName != "" {
 						return self.config.ISOName
@@ -295,6 +308,7 @@ func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (p
 			VdiUuidKey: "cd_vdi_uuid",
 			VdiType:    xsclient.VbdTypeCD,
 		},
+		new(xscommon.StepAttachExistingDisks),
 		new(xscommon.StepStartVmPaused),
 		new(xscommon.StepSetVmHostSshAddress),
 		// &xscommon.StepForwardPortOverSSH{
@@ -353,12 +367,16 @@ func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (p
 		&xscommon.StepDetachVdi{
 			VdiUuidKey: "floppy_vdi_uuid",
 		},
+		new(xscommon.StepDetachExistingDisks),
 		new(xscommon.StepExport))
 
 	if self.config.ISOName == "" {
 		steps = append(download_steps, steps...)
 	}
 
+	// Check the names in the config before downloading anything
+	steps = append([]multistep.Step{new(xscommon.StepPreflight)}, steps...)
+
 	self.runner = &multistep.BasicRunner{Steps: steps}
 	self.runner.Run(ctx, state)
 
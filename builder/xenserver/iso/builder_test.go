@@ -1,11 +1,21 @@
 package iso
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/xapitest"
 )
 
 func testConfig() map[string]interface{} {
@@ -67,6 +77,174 @@ func TestBuilderPrepare_Defaults(t *testing.T) {
 	}
 }
 
+func TestBuilderPrepare_APIProtocol(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	config["remote_api_protocol"] = "soap"
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["remote_api_protocol"] = "jsonrpc"
+	b = Builder{}
+	_, warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.APIProtocol != "jsonrpc" {
+		t.Errorf("bad protocol: %s", b.config.APIProtocol)
+	}
+}
+
+func TestBuilderPrepare_Credentials(t *testing.T) {
+	t.Setenv("XAPI_USERNAME", "")
+	t.Setenv("XAPI_PASSWORD", "")
+
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	delete(config, "remote_password")
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Bad: the SSH communicator is forwarded through the host, which
+	// needs a password
+	config["remote_session_id"] = "OpaqueRef:session"
+	b = Builder{}
+	_, warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good: an existing session needs no password
+	config["communicator"] = "none"
+	b = Builder{}
+	_, warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// Bad: neither can the boot command be typed
+	config["boot_command"] = []string{"<enter>"}
+	b = Builder{}
+	_, _, err = b.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good: from the environment
+	delete(config, "remote_session_id")
+	delete(config, "communicator")
+	delete(config, "boot_command")
+	delete(config, "remote_username")
+	t.Setenv("XAPI_USERNAME", "envuser")
+	t.Setenv("XAPI_PASSWORD", "envpass")
+	b = Builder{}
+	_, _, err = b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.Username != "envuser" || b.config.Password != "envpass" {
+		t.Errorf("bad credentials: %s/%s", b.config.Username, b.config.Password)
+	}
+
+	// Good: the file takes precedence over the environment, the template
+	// over both
+	path := filepath.Join(t.TempDir(), "credentials")
+	contents := "# XAPI credentials\nXAPI_USERNAME=fileuser\n\nXAPI_PASSWORD=\"file pass\"\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	config["remote_credentials_file"] = path
+	config["remote_username"] = "admin"
+	b = Builder{}
+	_, _, err = b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.Username != "admin" || b.config.Password != "file pass" {
+		t.Errorf("bad credentials: %s/%s", b.config.Username, b.config.Password)
+	}
+
+	// Bad
+	config["remote_credentials_file"] = filepath.Join(t.TempDir(), "missing")
+	b = Builder{}
+	_, _, err = b.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_Disks(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	bad := []map[string]interface{}{
+		{"mode": "rw-once"},
+		{"userdevice": "xvdb"},
+		{"qos_algorithm_type": "cfq"},
+		{"qos_algorithm_params": map[string]string{"class": "idle"}},
+	}
+	for _, disk := range bad {
+		config["disks"] = []map[string]interface{}{disk}
+		b = Builder{}
+		_, _, err := b.Prepare(config)
+		if err == nil {
+			t.Errorf("should have error for %v", disk)
+		}
+	}
+
+	// Bad
+	config["disks"] = []map[string]interface{}{
+		{"disk_name": "os", "userdevice": "0"},
+		{"disk_name": "data", "userdevice": "0"},
+	}
+	b = Builder{}
+	_, _, err := b.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["disks"] = []map[string]interface{}{
+		{"disk_name": "os", "userdevice": "0", "bootable": true},
+		{"disk_name": "data", "mode": "ro", "qos_algorithm_type": "ionice", "qos_algorithm_params": map[string]string{"class": "idle"}},
+	}
+	b = Builder{}
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.Disks[1].Mode != "RO" {
+		t.Errorf("bad mode: %s", b.config.Disks[1].Mode)
+	}
+}
+
 func TestBuilderPrepare_DiskSize(t *testing.T) {
 	var b Builder
 	config := testConfig()
@@ -99,6 +277,32 @@ func TestBuilderPrepare_DiskSize(t *testing.T) {
 	}
 }
 
+func TestBuilderPrepare_ExistingDisks(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	config["existing_disks"] = []map[string]interface{}{{"clone": true}}
+	_, _, err := b.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["existing_disks"] = []map[string]interface{}{{"vdi": "mirror", "clone": true, "keep": true}}
+	b = Builder{}
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if disk := b.config.ExistingDisks[0]; disk.VDI != "mirror" || !disk.Clone || !disk.Keep {
+		t.Errorf("bad existing disk: %#v", disk)
+	}
+}
+
 func TestBuilderPrepare_Format(t *testing.T) {
 	var b Builder
 	config := testConfig()
@@ -301,3 +505,643 @@ func TestBuilderPrepare_KeepVM(t *testing.T) {
 		t.Fatalf("should not have error: %s", err)
 	}
 }
+
+func TestBuilderPrepare_RemoteHosts(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	delete(config, "remote_host")
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["remote_hosts"] = []string{"host1", "host2"}
+	b = Builder{}
+	_, warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.HostIp != "host1" {
+		t.Errorf("bad remote host: %s", b.config.HostIp)
+	}
+
+	// remote_host is tried first
+	config["remote_host"] = "host2"
+	b = Builder{}
+	_, _, err = b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if !reflect.DeepEqual(b.config.HostIps, []string{"host2", "host1"}) {
+		t.Errorf("bad remote hosts: %#v", b.config.HostIps)
+	}
+}
+
+func TestBuilderPrepare_TLS(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	config["remote_tls_fingerprint"] = "foo"
+	_, warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Bad
+	config["remote_tls_fingerprint"] = "3F:0C:5E:8B:4B:7A:2F:9D:1E:66:AD:0C:51:0E:FA:2A:5E:C3:87:BB:93:1D:20:6C:7A:EB:4E:2D:91:C8:0F:13"
+	config["remote_insecure_skip_tls_verify"] = true
+	b = Builder{}
+	_, warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	delete(config, "remote_insecure_skip_tls_verify")
+	b = Builder{}
+	_, warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// Bad
+	config["remote_tls_fingerprints"] = []string{"sha256:" + strings.Repeat("ab", 32), "foo"}
+	b = Builder{}
+	_, _, err = b.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "'foo'") {
+		t.Fatalf("should have error about the bad fingerprint: %v", err)
+	}
+
+	// Good
+	config["remote_tls_fingerprints"] = []string{"sha256:" + strings.Repeat("ab", 32), strings.Repeat("CD", 32)}
+	b = Builder{}
+	_, _, err = b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+// testRunConfig returns a configuration that builds against server from a
+// local ISO, with the output going to the returned directory.
+func testRunConfig(t *testing.T, server *xapitest.Server) (map[string]interface{}, string) {
+	config := testConfig()
+	dir := server.Configure(t, config)
+
+	isoPath := filepath.Join(dir, "install.iso")
+	if err := os.WriteFile(isoPath, []byte("installer"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	config["iso_url"] = isoPath
+	config["iso_checksum"] = "none"
+	return config, dir
+}
+
+func TestBuilderRun(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server)
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	artifact, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if artifact == nil {
+		t.Fatal("should have an artifact")
+	}
+
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	vm := server.Records("VM")[vms[0]]
+	if vm["is_a_template"] != true {
+		t.Errorf("VM should have been turned into a template")
+	}
+	if vm["power_state"] != "Halted" {
+		t.Errorf("bad power state: %s", vm["power_state"])
+	}
+	if server.Calls("event.from") == 0 {
+		t.Errorf("should have waited on events")
+	}
+	if n := server.Calls("task.get_status") + server.Calls("VM.get_guest_metrics"); n != 0 {
+		t.Errorf("should not have polled, got %d calls", n)
+	}
+
+	vdis := server.Find("VDI", "install.iso")
+	if len(vdis) != 1 {
+		t.Fatalf("bad: expected the uploaded ISO to be kept, got %d VDIs", len(vdis))
+	}
+	if content := string(server.Content(vdis[0])); content != "installer" {
+		t.Errorf("bad ISO content: %q", content)
+	}
+
+	fh, err := os.Open(filepath.Join(dir, "output", "foo.xva"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer fh.Close()
+	name, disks, err := xapitest.ReadXVA(fh)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if name != "foo" || len(disks) != 1 {
+		t.Errorf("bad export: %s with %d disks", name, len(disks))
+	}
+}
+
+func TestBuilderRun_DiskSettings(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, _ := testRunConfig(t, server)
+	config["format"] = "none"
+	config["disks"] = []map[string]interface{}{
+		{
+			"disk_name":        "os",
+			"disk_description": "Root filesystem",
+			"userdevice":       "0",
+			"bootable":         true,
+			"sm_config":        map[string]string{"type": "raw"},
+		},
+		{
+			"disk_name":            "data",
+			"userdevice":           "4",
+			"mode":                 "RO",
+			"sharable":             true,
+			"other_config":         map[string]string{"role": "data"},
+			"qos_algorithm_type":   "ionice",
+			"qos_algorithm_params": map[string]string{"class": "idle"},
+		},
+	}
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	disk := func(name string) (vdi, vbd xapitest.Record) {
+		vdis := server.Find("VDI", name)
+		if len(vdis) != 1 {
+			t.Fatalf("bad: expected one VDI named %s, got %d", name, len(vdis))
+		}
+		vdi = server.Records("VDI")[vdis[0]]
+		vbds := vdi["VBDs"].([]interface{})
+		if len(vbds) != 1 {
+			t.Fatalf("bad: expected VDI %s to have one VBD, got %d", name, len(vbds))
+		}
+		return vdi, server.Records("VBD")[vbds[0].(string)]
+	}
+
+	vdi, vbd := disk("os")
+	if vdi["name_description"] != "Root filesystem" {
+		t.Errorf("bad description: %v", vdi["name_description"])
+	}
+	if sm := vdi["sm_config"].(map[string]interface{}); sm["type"] != "raw" {
+		t.Errorf("bad sm_config: %v", sm)
+	}
+	if vbd["userdevice"] != "0" || vbd["bootable"] != true || vbd["mode"] != "RW" {
+		t.Errorf("bad VBD: userdevice %v, bootable %v, mode %v", vbd["userdevice"], vbd["bootable"], vbd["mode"])
+	}
+
+	vdi, vbd = disk("data")
+	if vdi["sharable"] != true {
+		t.Errorf("VDI should be sharable")
+	}
+	if other := vdi["other_config"].(map[string]interface{}); other["role"] != "data" {
+		t.Errorf("bad other_config: %v", other)
+	}
+	if vbd["userdevice"] != "4" || vbd["bootable"] != false || vbd["mode"] != "RO" {
+		t.Errorf("bad VBD: userdevice %v, bootable %v, mode %v", vbd["userdevice"], vbd["bootable"], vbd["mode"])
+	}
+	if params := vbd["qos_algorithm_params"].(map[string]interface{}); vbd["qos_algorithm_type"] != "ionice" || params["class"] != "idle" {
+		t.Errorf("bad QoS: %v %v", vbd["qos_algorithm_type"], params)
+	}
+}
+
+func TestBuilderRun_DiskSRs(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	nfs := server.Create("SR", xapitest.Record{
+		"name_label":   "NFS storage",
+		"type":         "nfs",
+		"content_type": "user",
+	})
+	nfsUUID := server.Records("SR")[nfs]["uuid"].(string)
+
+	config, _ := testRunConfig(t, server)
+	config["format"] = "none"
+	config["disks"] = []map[string]interface{}{
+		{"disk_name": "os", "disk_size": 100},
+		{"disk_name": "data", "disk_size": 200, "sr_name": nfsUUID},
+		{"disk_name": "scratch", "disk_size": 300, "sr_name": "NFS storage"},
+	}
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	local := server.Find("SR", xapitest.DefaultSR)[0]
+	expected := map[string]string{"os": local, "data": nfs, "scratch": nfs}
+	for name, sr := range expected {
+		vdis := server.Find("VDI", name)
+		if len(vdis) != 1 {
+			t.Fatalf("bad: expected one VDI named %s, got %d", name, len(vdis))
+		}
+		if actual := server.Records("VDI")[vdis[0]]["SR"]; actual != sr {
+			t.Errorf("disk %s: expected SR %s, got %s", name, sr, actual)
+		}
+	}
+}
+
+func TestBuilderRun_ExistingDisks(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	local := server.Find("SR", xapitest.DefaultSR)[0]
+	existing := func(name string) string {
+		return server.Create("VDI", xapitest.Record{
+			"name_label":   name,
+			"SR":           local,
+			"virtual_size": "1048576",
+			"type":         "user",
+			"VBDs":         []interface{}{},
+		})
+	}
+	mirror := existing("mirror")
+	licence := existing("licence")
+	seed := existing("seed")
+	server.SetContent(seed, []byte("seed data"))
+
+	config, _ := testRunConfig(t, server)
+	config["format"] = "none"
+	config["existing_disks"] = []map[string]interface{}{
+		{"vdi": "mirror", "clone": true},
+		{"vdi": server.Records("VDI")[licence]["uuid"], "keep": true},
+		{"vdi": "seed", "clone": true, "keep": true},
+	}
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	attached := map[string]bool{}
+	for _, vbd := range server.Records("VM")[vms[0]]["VBDs"].([]interface{}) {
+		attached[server.Records("VBD")[vbd.(string)]["VDI"].(string)] = true
+	}
+
+	vdis := server.Records("VDI")
+	if len(vdis[mirror]["VBDs"].([]interface{})) != 0 || len(vdis[seed]["VBDs"].([]interface{})) != 0 {
+		t.Errorf("cloned disks should have been left alone")
+	}
+	if clones := server.Find("VDI", "mirror (foo)"); len(clones) != 0 {
+		t.Errorf("clone of a disk that is not kept should have been destroyed")
+	}
+	if !attached[licence] {
+		t.Errorf("kept disk should still be attached")
+	}
+	clones := server.Find("VDI", "seed (foo)")
+	if len(clones) != 1 {
+		t.Fatalf("bad: expected one clone of seed, got %d", len(clones))
+	}
+	if !attached[clones[0]] {
+		t.Errorf("kept clone should still be attached")
+	}
+	if content := string(server.Content(clones[0])); content != "seed data" {
+		t.Errorf("bad clone content: %q", content)
+	}
+}
+
+func TestBuilderRun_JSONRPC(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, _ := testRunConfig(t, server)
+	config["remote_api_protocol"] = "jsonrpc"
+	config["format"] = "none"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	if vm := server.Records("VM")[vms[0]]; vm["is_a_template"] != true {
+		t.Errorf("VM should have been turned into a template")
+	}
+	if n := server.ProtocolCalls("xmlrpc"); n != 0 {
+		t.Errorf("should only have used JSON-RPC, got %d XML-RPC calls", n)
+	}
+	if server.ProtocolCalls("jsonrpc") == 0 {
+		t.Errorf("should have used JSON-RPC")
+	}
+}
+
+func TestBuilderRun_NotEnoughSpace(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	server.Create("SR", xapitest.Record{
+		"name_label":           "Tiny storage",
+		"type":                 "ext",
+		"content_type":         "user",
+		"physical_size":        fmt.Sprint(10 << 20),
+		"physical_utilisation": fmt.Sprint(4 << 20),
+	})
+
+	config, _ := testRunConfig(t, server)
+	config["format"] = "none"
+	config["disks"] = []map[string]interface{}{
+		{"disk_name": "os", "disk_size": 100},
+		{"disk_name": "data", "disk_size": 8, "sr_name": "Tiny storage"},
+	}
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if !strings.Contains(err.Error(), "SR 'Tiny storage': 8.0 MiB needed (disk 'data' 8.0 MiB), 6.0 MiB free") {
+		t.Errorf("bad error: %s", err)
+	}
+	if strings.Contains(err.Error(), xapitest.DefaultSR) {
+		t.Errorf("only the full SR should be reported: %s", err)
+	}
+	if n := len(server.Records("VM")); n != 1 {
+		t.Errorf("should not have created a VM, got %d VMs", n)
+	}
+	if n := len(server.Find("VDI", "install.iso")); n != 0 {
+		t.Errorf("should not have uploaded the ISO")
+	}
+}
+
+func TestBuilderRun_Preflight(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	server.Create("network", xapitest.Record{"name_label": "Pool-wide network"})
+	server.Create("network", xapitest.Record{"name_label": "Pool-wide network"})
+
+	var downloads int
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		fmt.Fprint(w, "installer")
+	}))
+	defer mirror.Close()
+
+	config, _ := testRunConfig(t, server)
+	config["iso_url"] = mirror.URL + "/install.iso"
+	config["clone_template"] = "Debian Bookworm 12"
+	config["network_names"] = []string{xapitest.DefaultNetwork, "Pool-wide network"}
+	config["tools_iso_name"] = "guest-tools.iso"
+	config["disks"] = []map[string]interface{}{
+		{"disk_name": "os", "disk_size": 100, "sr_name": "Fast storage"},
+	}
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	for _, expected := range []string{
+		"found 4 problem(s)",
+		"clone_template: Couldn't find a template with the name-label or UUID 'Debian Bookworm 12'",
+		"network_names[1]: Found 2 networks with the name 'Pool-wide network'",
+		"tools_iso_name: Couldn't find a VDI with the name-label or UUID 'guest-tools.iso'",
+		"disks[0].sr_name: Couldn't find a SR with the name-label or UUID 'Fast storage'",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error should contain %q: %s", expected, err)
+		}
+	}
+	if downloads != 0 {
+		t.Errorf("should not have downloaded the ISO")
+	}
+	if n := len(server.Records("VM")); n != 1 {
+		t.Errorf("should not have created a VM, got %d VMs", n)
+	}
+}
+
+func TestBuilderRun_SessionID(t *testing.T) {
+	t.Setenv("XAPI_USERNAME", "")
+	t.Setenv("XAPI_PASSWORD", "")
+
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	session, err := server.Invoke("session.login_with_password", []interface{}{server.Username, server.Password, "1.0", "test"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config, dir := testRunConfig(t, server)
+	delete(config, "remote_username")
+	delete(config, "remote_password")
+	config["remote_session_id"] = session
+	config["format"] = "vdi_raw"
+
+	var b Builder
+	_, _, err = b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var out bytes.Buffer
+	ui := &packer.BasicUi{Reader: new(bytes.Buffer), Writer: &out, ErrorWriter: &out}
+	if _, err := b.Run(ctx, ui, &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s\n%s", err, out.String())
+	}
+	if strings.Contains(out.String(), session.(string)) || strings.Contains(out.String(), url.QueryEscape(session.(string))) {
+		t.Errorf("session should have been redacted:\n%s", out.String())
+	}
+
+	if n := server.Calls("session.login_with_password"); n != 0 {
+		t.Errorf("should not have logged in, got %d logins", n)
+	}
+	if _, ok := server.Records("session")[session.(string)]; !ok {
+		t.Errorf("should not have logged out of the given session")
+	}
+
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "output", "*.raw"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("bad: expected one exported disk, got %d", len(matches))
+	}
+}
+
+func TestBuilderRun_UUIDs(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	// Give every object the build uses a namesake, so that only its UUID
+	// tells them apart
+	template := server.Create("VM", xapitest.Record{
+		"name_label":      xapitest.DefaultTemplate,
+		"is_a_template":   true,
+		"other_config":    map[string]interface{}{"install-methods": "cdrom", "base": "bookworm"},
+		"HVM_boot_policy": "BIOS order",
+	})
+	server.Create("network", xapitest.Record{"name_label": "Pool-wide network"})
+	network := server.Create("network", xapitest.Record{"name_label": "Pool-wide network"})
+	sr := server.Create("SR", xapitest.Record{
+		"name_label":   xapitest.DefaultSR,
+		"type":         "ext",
+		"content_type": "user",
+	})
+	isoSR := server.Find("SR", xapitest.ISOSR)[0]
+	var isos []string
+	for i := 0; i < 2; i++ {
+		isos = append(isos, server.Create("VDI", xapitest.Record{
+			"name_label": "installer.iso",
+			"SR":         isoSR,
+			"type":       "user",
+			"VBDs":       []interface{}{},
+		}))
+	}
+	uuid := func(class, ref string) string {
+		return server.Records(class)[ref]["uuid"].(string)
+	}
+
+	config, _ := testRunConfig(t, server)
+	config["format"] = "none"
+	config["iso_name"] = uuid("VDI", isos[1])
+	config["clone_template"] = uuid("VM", template)
+	config["network_names"] = []string{uuid("network", network)}
+	config["sr_name"] = uuid("SR", sr)
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	vm := server.Records("VM")[vms[0]]
+	if otherConfig := vm["other_config"].(map[string]interface{}); otherConfig["base"] != "bookworm" {
+		t.Errorf("should have cloned the template given by UUID, got other-config %v", otherConfig)
+	}
+
+	vifs := vm["VIFs"].([]interface{})
+	if len(vifs) != 1 || server.Records("VIF")[vifs[0].(string)]["network"] != network {
+		t.Errorf("should have connected the network given by UUID")
+	}
+
+	var disks int
+	for _, vbd := range vm["VBDs"].([]interface{}) {
+		if vdi, ok := server.Records("VDI")[server.Records("VBD")[vbd.(string)]["VDI"].(string)]; ok && vdi["SR"] == sr {
+			disks++
+		}
+	}
+	if disks != 1 {
+		t.Errorf("should have created the disk on the SR given by UUID, got %d disks there", disks)
+	}
+
+	if n := len(server.Find("VDI", "installer.iso")); n != 2 {
+		t.Errorf("should have used the ISO given by UUID, got %d ISOs", n)
+	}
+}
@@ -0,0 +1,28 @@
+package xapitest
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Configure sets the options of a builder configuration that make it run
+// against s: the credentials and certificate of s, no communicator, no waits
+// and the output, as well as the Packer cache, going to a new temporary
+// directory, which it returns.
+func (s *Server) Configure(t testing.TB, config map[string]interface{}) string {
+	dir := t.TempDir()
+	t.Setenv("PACKER_CACHE_DIR", filepath.Join(dir, "cache"))
+
+	delete(config, "shutdown_command")
+	config["remote_host"] = s.Host()
+	config["remote_username"] = s.Username
+	config["remote_password"] = s.Password
+	config["remote_tls_fingerprint"] = s.Fingerprint()
+	config["communicator"] = "none"
+	config["boot_wait"] = "0s"
+	config["dhcp_wait"] = "0s"
+	config["ip_getter"] = "tools"
+	config["keep_vm"] = "on_success"
+	config["output_directory"] = filepath.Join(dir, "output")
+	return dir
+}
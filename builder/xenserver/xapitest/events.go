@@ -0,0 +1,165 @@
+package xapitest
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// change is the last known state of an object, as reported by event.from.
+type change struct {
+	generation int64
+	created    int64
+	class      string
+	ref        string
+
+	// record is nil once the object has been destroyed
+	record Record
+}
+
+// unlock publishes the changes made while the lock was held, so that they
+// are seen by event.from, and releases the lock.
+func (s *Server) unlock() {
+	s.commit()
+	s.mu.Unlock()
+}
+
+// commit compares every object with the state last reported to event.from
+// and gives each one that was added, modified or destroyed since a new
+// generation. It must be called with the lock held.
+func (s *Server) commit() {
+	changed := false
+	for class, objects := range s.objects {
+		for ref, record := range objects {
+			key := class + "/" + ref
+			last, ok := s.changes[key]
+			if ok && last.record != nil && reflect.DeepEqual(last.record, record) {
+				continue
+			}
+			s.generation++
+			if !ok || last.record == nil {
+				last = &change{created: s.generation, class: class, ref: ref}
+				s.changes[key] = last
+			}
+			last.generation = s.generation
+			last.record = copyRecord(record)
+			changed = true
+		}
+	}
+	for _, last := range s.changes {
+		if _, ok := s.objects[last.class][last.ref]; ok || last.record == nil {
+			continue
+		}
+		s.generation++
+		last.generation = s.generation
+		last.record = nil
+		changed = true
+	}
+
+	if changed {
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+}
+
+// eventFrom implements event.from: it returns the objects of the given
+// classes that changed after token, blocking for up to the given number of
+// seconds until there is at least one. An empty token returns every
+// existing object straight away. It takes the lock itself.
+func (s *Server) eventFrom(params []interface{}) (interface{}, error) {
+	if len(params) < 4 {
+		return nil, Failure{"MESSAGE_PARAMETER_COUNT_MISMATCH", "event.from", "4", fmt.Sprint(len(params))}
+	}
+
+	classes, _ := params[1].([]interface{})
+	token := str(params[2])
+	var since int64
+	if token != "" {
+		var err error
+		if since, err = strconv.ParseInt(token, 10, 64); err != nil {
+			return nil, Failure{"EVENT_FROM_TOKEN_PARSE_FAILURE", token}
+		}
+	}
+	timeout, _ := strconv.ParseFloat(str(params[3]), 64)
+	deadline := time.Now().Add(time.Duration(timeout * float64(time.Second)))
+
+	for {
+		s.mu.Lock()
+		if _, ok := s.objects["session"][str(params[0])]; !ok {
+			s.mu.Unlock()
+			return nil, Failure{"SESSION_INVALID", str(params[0])}
+		}
+		s.commit()
+		events := s.eventsSince(since, token == "", classes)
+		generation := s.generation
+		changed := s.changed
+		s.mu.Unlock()
+
+		remaining := time.Until(deadline)
+		if len(events) > 0 || token == "" || remaining <= 0 {
+			return Record{
+				"events":           events,
+				"valid_ref_counts": map[string]interface{}{},
+				"token":            fmt.Sprintf("%020d", generation),
+			}, nil
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(remaining):
+		case <-s.closed:
+			deadline = time.Now()
+		}
+	}
+}
+
+// eventsSince must be called with the lock held.
+func (s *Server) eventsSince(since int64, existing bool, classes []interface{}) []interface{} {
+	var changes []*change
+	for _, last := range s.changes {
+		if last.generation <= since || (existing && last.record == nil) || !subscribed(classes, last.class, last.ref) {
+			continue
+		}
+		changes = append(changes, last)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].generation < changes[j].generation
+	})
+
+	events := []interface{}{}
+	for _, last := range changes {
+		event := map[string]interface{}{
+			"id":        fmt.Sprint(last.generation),
+			"timestamp": time.Now().UTC().Format("20060102T15:04:05Z"),
+			"class":     last.class,
+			"ref":       last.ref,
+		}
+		switch {
+		case last.record == nil:
+			event["operation"] = "del"
+		case last.created > since || existing:
+			event["operation"] = "add"
+			event["snapshot"] = map[string]interface{}(copyRecord(last.record))
+		default:
+			event["operation"] = "mod"
+			event["snapshot"] = map[string]interface{}(copyRecord(last.record))
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// subscribed reports whether an object matches one of the classes passed
+// to event.from, which are either "*", a class name or class/ref.
+func subscribed(classes []interface{}, class, ref string) bool {
+	for _, item := range classes {
+		name, object, _ := strings.Cut(strings.ToLower(str(item)), "/")
+		if name == "*" || (name == class && (object == "" || object == strings.ToLower(ref))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package xapitest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// authorize checks the session_id query parameter, falling back to basic
+// authentication as xapi does, and returns whether the request may go on.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects["session"][r.URL.Query().Get("session_id")]; ok {
+		return true
+	}
+	if username, password, ok := r.BasicAuth(); ok && username == s.Username && password == s.Password {
+		return true
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// dropConnection closes the connection of w without sending a response.
+func dropConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("xapitest: unable to drop the connection: %s", err)
+		return
+	}
+	conn.Close()
+}
+
+// resolve accepts either a reference or a UUID, as the HTTP handlers do. It
+// must be called with the lock held.
+func (s *Server) resolve(class, id string) (string, Record, bool) {
+	if record, err := s.get(class, id); err == nil {
+		return id, record, true
+	}
+	if ref := s.lookup(class, "uuid", id); ref != nullRef {
+		return ref, s.objects[class][ref], true
+	}
+	return "", nil, false
+}
+
+func (s *Server) serveImportRawVdi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+
+	data, readErr := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.unlock()
+
+	task := r.URL.Query().Get("task_id")
+	ref, vdi, ok := s.resolve("vdi", r.URL.Query().Get("vdi"))
+	format := r.URL.Query().Get("format")
+	switch {
+	case format != "" && format != "raw" && format != "vhd":
+		s.finishTask(task, "", Failure{"INTERNAL_ERROR", "unknown format " + format})
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	case !ok:
+		s.finishTask(task, "", Failure{"HANDLE_INVALID", "VDI", r.URL.Query().Get("vdi")})
+		http.Error(w, "no such VDI", http.StatusNotFound)
+		return
+	case readErr != nil:
+		s.finishTask(task, "", Failure{"INTERNAL_ERROR", readErr.Error()})
+		http.Error(w, readErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.contents[ref] = data
+	vdi["physical_utilisation"] = fmt.Sprint(len(data))
+	s.finishTask(task, "", nil)
+}
+
+func (s *Server) serveImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+
+	name, disks, readErr := ReadXVA(r.Body)
+
+	s.mu.Lock()
+	defer s.unlock()
+
+	task := r.URL.Query().Get("task_id")
+
+	sr := r.URL.Query().Get("sr_id")
+	if sr == "" {
+		sr = s.defaultSR()
+	}
+	srRecord, err := s.get("SR", sr)
+	switch {
+	case err != nil:
+		s.finishTask(task, "", err.(Failure))
+		http.Error(w, "no such SR", http.StatusNotFound)
+		return
+	case readErr != nil:
+		s.finishTask(task, "", Failure{"IMPORT_ERROR", readErr.Error()})
+		http.Error(w, readErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vm := s.create("VM", Record{"name_label": name})
+	for i, data := range disks {
+		vdi := s.create("VDI", Record{
+			"name_label":           fmt.Sprintf("%s %d", name, i),
+			"SR":                   sr,
+			"virtual_size":         fmt.Sprint(len(data)),
+			"physical_utilisation": fmt.Sprint(len(data)),
+		})
+		srRecord["VDIs"] = appendUnique(srRecord["VDIs"].([]interface{}), vdi)
+		s.contents[vdi] = data
+		s.vbdCreate([]interface{}{map[string]interface{}{
+			"VM":       vm,
+			"VDI":      vdi,
+			"bootable": i == 0,
+			"type":     "Disk",
+		}})
+	}
+
+	// Like xapi, report the new VM as an XML-RPC encoded set of references
+	s.finishTask(task, fmt.Sprintf("<value><array><data><value>%s</value></data></array></value>", vm), nil)
+}
+
+func (s *Server) serveExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+
+	s.mu.Lock()
+	id := r.URL.Query().Get("uuid")
+	if id == "" {
+		id = r.URL.Query().Get("ref")
+	}
+	_, vm, ok := s.resolve("vm", id)
+	var name string
+	var disks [][]byte
+	if ok {
+		name = str(vm["name_label"])
+		for _, vbd := range vm["VBDs"].([]interface{}) {
+			record := s.objects["vbd"][str(vbd)]
+			if record["type"] == "Disk" && str(record["VDI"]) != nullRef {
+				disks = append(disks, s.contents[str(record["VDI"])])
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "no such VM", http.StatusNotFound)
+		return
+	}
+
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var zw *gzip.Writer
+	if r.URL.Query().Get("use_compression") == "true" {
+		zw = gzip.NewWriter(&buf)
+		out = zw
+	}
+	if err := WriteXVA(out, name, disks...); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// xapi streams the XVA as it exports the VM, so an export cannot be
+	// resumed
+	r.Header.Del("Range")
+	serveBytes(w, r, buf.Bytes())
+}
+
+func (s *Server) serveExportRawVdi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r) {
+		return
+	}
+
+	s.mu.Lock()
+	ref, _, ok := s.resolve("vdi", r.URL.Query().Get("vdi"))
+	data := s.contents[ref]
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "no such VDI", http.StatusNotFound)
+		return
+	}
+
+	// The data is served as is whatever the requested format
+	serveBytes(w, r, data)
+}
+
+func serveBytes(w http.ResponseWriter, r *http.Request, data []byte) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
@@ -0,0 +1,108 @@
+package xapitest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The JSON-RPC flavour of the API, served on /jsonrpc. Integral numbers are
+// turned into strings on the way in, so that the methods see the same
+// values as over XML-RPC; values go out as they are stored.
+
+type jsonrpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+	ID      interface{}       `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int      `json:"code"`
+	Message string   `json:"message"`
+	Data    []string `json:"data"`
+}
+
+func (s *Server) serveJSONRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method, params, id, err := decodeJSONCall(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.protocols["jsonrpc"]++
+	s.mu.Unlock()
+
+	value, err := s.call(method, params)
+	if errors.Is(err, ErrLostResponse) {
+		dropConnection(w)
+		return
+	}
+
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if err != nil {
+		failure, ok := err.(Failure)
+		if !ok {
+			failure = Failure{"INTERNAL_ERROR", err.Error()}
+		}
+		response["error"] = jsonrpcError{Code: 1, Message: failure[0], Data: append([]string{}, failure[1:]...)}
+	} else {
+		if value == nil {
+			value = ""
+		}
+		response["result"] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("xapitest: unable to encode response to %s: %s", method, err)
+	}
+}
+
+func decodeJSONCall(r io.Reader) (method string, params []interface{}, id interface{}, err error) {
+	var request jsonrpcRequest
+	if err = json.NewDecoder(r).Decode(&request); err != nil {
+		return "", nil, nil, err
+	}
+
+	params = make([]interface{}, len(request.Params))
+	for i, raw := range request.Params {
+		decoder := json.NewDecoder(strings.NewReader(string(raw)))
+		decoder.UseNumber()
+		var value interface{}
+		if err = decoder.Decode(&value); err != nil {
+			return "", nil, nil, err
+		}
+		params[i] = fromJSON(value)
+	}
+	return request.Method, params, request.ID, nil
+}
+
+func fromJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return v.String()
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i, item := range v {
+			v[i] = fromJSON(item)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = fromJSON(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,758 @@
+package xapitest
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// builtin are the methods that do more than read or write a field. They
+// are run with the server lock held and get the parameters that follow the
+// session reference.
+var builtin = map[string]func(s *Server, params []interface{}) (interface{}, error){
+	"session.get_this_host": func(s *Server, params []interface{}) (interface{}, error) {
+		return s.field("session", params, "this_host")
+	},
+	"VM.clone":                (*Server).vmClone,
+	"VM.copy":                 (*Server).vmClone,
+	"VM.destroy":              (*Server).vmDestroy,
+	"VM.start":                (*Server).vmStart,
+	"VM.unpause":              (*Server).vmUnpause,
+	"VM.pause":                (*Server).vmPause,
+	"VM.clean_shutdown":       (*Server).vmShutdown,
+	"VM.hard_shutdown":        (*Server).vmShutdown,
+	"VM.set_memory_limits":    (*Server).vmSetMemoryLimits,
+	"VM.set_VCPUs_max":        (*Server).vmSetVCPUsMax,
+	"VM.set_VCPUs_at_startup": (*Server).vmSetVCPUsAtStartup,
+	"VDI.create":              (*Server).vdiCreate,
+	"VDI.clone":               (*Server).vdiClone,
+	"VDI.resize":              (*Server).vdiResize,
+	"VDI.destroy":             (*Server).vdiDestroy,
+	"VBD.create":              (*Server).vbdCreate,
+	"VBD.destroy":             (*Server).vbdDestroy,
+	"VBD.plug":                (*Server).vbdPlug,
+	"VBD.unplug":              (*Server).vbdUnplug,
+	"VIF.create":              (*Server).vifCreate,
+	"VIF.destroy":             (*Server).vifDestroy,
+	"task.create":             (*Server).taskCreate,
+	"host.call_plugin":        (*Server).hostCallPlugin,
+}
+
+func (s *Server) serveXMLRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method, params, err := decodeCall(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.protocols["xmlrpc"]++
+	s.mu.Unlock()
+
+	value, err := s.call(method, params)
+	if errors.Is(err, ErrLostResponse) {
+		dropConnection(w)
+		return
+	}
+
+	response := Record{"Status": "Success", "Value": value}
+	if err != nil {
+		failure, ok := err.(Failure)
+		if !ok {
+			failure = Failure{"INTERNAL_ERROR", err.Error()}
+		}
+		description := make([]interface{}, len(failure))
+		for i, item := range failure {
+			description[i] = item
+		}
+		response = Record{"Status": "Failure", "ErrorDescription": description}
+	}
+	if value == nil && err == nil {
+		response["Value"] = ""
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	if err := encodeResponse(w, response); err != nil {
+		log.Printf("xapitest: unable to encode response to %s: %s", method, err)
+	}
+}
+
+func (s *Server) call(method string, params []interface{}) (interface{}, error) {
+	method = canonicalMethod(method)
+
+	s.mu.Lock()
+	s.calls[method]++
+	override := s.overrides[method]
+	s.mu.Unlock()
+
+	if override != nil {
+		return override(params)
+	}
+	return s.Invoke(method, params)
+}
+
+// invoke must be called with the lock held.
+func (s *Server) invoke(method string, params []interface{}) (interface{}, error) {
+	class, action, ok := strings.Cut(method, ".")
+	if !ok {
+		return nil, Failure{"MESSAGE_METHOD_UNKNOWN", method}
+	}
+
+	switch method {
+	case "session.login_with_password":
+		return s.login(params)
+	case "session.logout":
+		if len(params) > 0 {
+			delete(s.objects["session"], str(params[0]))
+		}
+		return "", nil
+	}
+
+	if len(params) == 0 {
+		return nil, Failure{"MESSAGE_PARAMETER_COUNT_MISMATCH", method, "1", "0"}
+	}
+	if _, ok := s.objects["session"][str(params[0])]; !ok {
+		return nil, Failure{"SESSION_INVALID", str(params[0])}
+	}
+	params = params[1:]
+
+	if fn, ok := builtin[method]; ok {
+		return fn(s, params)
+	}
+	return s.generic(class, action, params)
+}
+
+// generic implements the accessors XAPI provides for every class.
+func (s *Server) generic(class, action string, params []interface{}) (interface{}, error) {
+	key := strings.ToLower(class)
+	if _, ok := s.classes[key]; !ok {
+		s.classes[key] = class
+	}
+
+	switch {
+	case action == "get_all":
+		refs := []interface{}{}
+		for ref := range s.objects[key] {
+			refs = append(refs, ref)
+		}
+		return refs, nil
+
+	case action == "get_all_records":
+		records := map[string]interface{}{}
+		for ref, record := range s.objects[key] {
+			records[ref] = map[string]interface{}(copyRecord(record))
+		}
+		return records, nil
+
+	case action == "get_record":
+		record, err := s.get(class, param(params, 0))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}(copyRecord(record)), nil
+
+	case action == "get_by_uuid":
+		uuid := param(params, 0)
+		if ref := s.lookup(class, "uuid", uuid); ref != nullRef {
+			return ref, nil
+		}
+		return nil, Failure{"UUID_INVALID", s.className(class), uuid}
+
+	case action == "get_by_name_label":
+		return toSet(s.filter(class, "name_label", param(params, 0))), nil
+
+	case action == "create":
+		fields, _ := paramValue(params, 0).(map[string]interface{})
+		return s.create(class, Record(fields)), nil
+
+	case action == "destroy":
+		ref := param(params, 0)
+		if _, err := s.get(class, ref); err != nil {
+			return nil, err
+		}
+		delete(s.objects[key], ref)
+		return "", nil
+
+	case strings.HasPrefix(action, "get_"):
+		return s.field(class, params, strings.TrimPrefix(action, "get_"))
+
+	case strings.HasPrefix(action, "set_"):
+		record, err := s.get(class, param(params, 0))
+		if err != nil {
+			return nil, err
+		}
+		record[strings.TrimPrefix(action, "set_")] = paramValue(params, 1)
+		return "", nil
+
+	case strings.HasPrefix(action, "add_to_"):
+		record, err := s.get(class, param(params, 0))
+		if err != nil {
+			return nil, err
+		}
+		field := strings.TrimPrefix(action, "add_to_")
+		m, _ := record[field].(map[string]interface{})
+		if _, exists := m[param(params, 1)]; exists {
+			return nil, Failure{"MAP_DUPLICATE_KEY", s.className(class), field, param(params, 0), param(params, 1)}
+		}
+		if m == nil {
+			m = map[string]interface{}{}
+		}
+		m[param(params, 1)] = paramValue(params, 2)
+		record[field] = m
+		return "", nil
+
+	case strings.HasPrefix(action, "remove_from_"):
+		record, err := s.get(class, param(params, 0))
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := record[strings.TrimPrefix(action, "remove_from_")].(map[string]interface{}); ok {
+			delete(m, param(params, 1))
+		}
+		return "", nil
+
+	case strings.HasPrefix(action, "add_"):
+		record, err := s.get(class, param(params, 0))
+		if err != nil {
+			return nil, err
+		}
+		field := strings.TrimPrefix(action, "add_")
+		set, _ := record[field].([]interface{})
+		record[field] = appendUnique(set, paramValue(params, 1))
+		return "", nil
+
+	case strings.HasPrefix(action, "remove_"):
+		record, err := s.get(class, param(params, 0))
+		if err != nil {
+			return nil, err
+		}
+		field := strings.TrimPrefix(action, "remove_")
+		set, _ := record[field].([]interface{})
+		record[field] = without(set, paramValue(params, 1))
+		return "", nil
+	}
+
+	return nil, Failure{"MESSAGE_METHOD_UNKNOWN", class + "." + action}
+}
+
+func (s *Server) field(class string, params []interface{}, field string) (interface{}, error) {
+	record, err := s.get(class, param(params, 0))
+	if err != nil {
+		return nil, err
+	}
+	value, ok := record[field]
+	if !ok {
+		return nil, Failure{"MESSAGE_METHOD_UNKNOWN", s.className(class) + ".get_" + field}
+	}
+	return copyValue(value), nil
+}
+
+func (s *Server) login(params []interface{}) (interface{}, error) {
+	if param(params, 0) != s.Username || param(params, 1) != s.Password {
+		return nil, Failure{"SESSION_AUTHENTICATION_FAILED", param(params, 0), "Authentication failure"}
+	}
+	return s.create("session", Record{
+		"this_host":  s.master(),
+		"originator": param(params, 3),
+	}), nil
+}
+
+func (s *Server) vmClone(params []interface{}) (interface{}, error) {
+	source, err := s.get("VM", param(params, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	clone := copyRecord(source)
+	clone["name_label"] = param(params, 1)
+	clone["power_state"] = "Halted"
+	clone["domid"] = "-1"
+	clone["resident_on"] = nullRef
+	clone["guest_metrics"] = nullRef
+	clone["VBDs"] = []interface{}{}
+	clone["VIFs"] = []interface{}{}
+	clone["consoles"] = []interface{}{}
+	ref := s.create("VM", clone)
+
+	for _, vbd := range source["VBDs"].([]interface{}) {
+		record := copyRecord(s.objects["vbd"][str(vbd)])
+		record["VM"] = ref
+		if _, err := s.vbdCreate([]interface{}{map[string]interface{}(record)}); err != nil {
+			return nil, err
+		}
+	}
+	return ref, nil
+}
+
+func (s *Server) vmDestroy(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vm, err := s.get("VM", ref)
+	if err != nil {
+		return nil, err
+	}
+	if vm["power_state"] != "Halted" {
+		return nil, Failure{"VM_BAD_POWER_STATE", ref, "halted", strings.ToLower(str(vm["power_state"]))}
+	}
+	for _, vbd := range vm["VBDs"].([]interface{}) {
+		s.vbdDestroy([]interface{}{vbd})
+	}
+	for _, vif := range vm["VIFs"].([]interface{}) {
+		s.vifDestroy([]interface{}{vif})
+	}
+	for _, console := range vm["consoles"].([]interface{}) {
+		delete(s.objects["console"], str(console))
+	}
+	delete(s.objects["vm"], ref)
+	return "", nil
+}
+
+func (s *Server) vmStart(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vm, err := s.get("VM", ref)
+	if err != nil {
+		return nil, err
+	}
+	if vm["is_a_template"] == true {
+		return nil, Failure{"VM_IS_TEMPLATE", ref, "start"}
+	}
+	if vm["power_state"] != "Halted" {
+		return nil, Failure{"VM_BAD_POWER_STATE", ref, "halted", strings.ToLower(str(vm["power_state"]))}
+	}
+
+	host := s.master()
+	vm["resident_on"] = host
+	vm["domid"] = "1"
+	vm["power_state"] = "Paused"
+
+	console := s.create("console", Record{"VM": ref})
+	s.objects["console"][console]["location"] = fmt.Sprintf("https://%s/console?uuid=%s", s.objects["host"][host]["address"], s.objects["console"][console]["uuid"])
+	vm["consoles"] = []interface{}{console}
+
+	for _, vbd := range vm["VBDs"].([]interface{}) {
+		s.objects["vbd"][str(vbd)]["currently_attached"] = true
+	}
+	for _, vif := range vm["VIFs"].([]interface{}) {
+		s.objects["vif"][str(vif)]["currently_attached"] = true
+	}
+
+	if paused := paramValue(params, 1); paused != true {
+		s.run(ref, vm)
+	}
+	return "", nil
+}
+
+func (s *Server) vmUnpause(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vm, err := s.get("VM", ref)
+	if err != nil {
+		return nil, err
+	}
+	if vm["power_state"] != "Paused" {
+		return nil, Failure{"VM_BAD_POWER_STATE", ref, "paused", strings.ToLower(str(vm["power_state"]))}
+	}
+	s.run(ref, vm)
+	return "", nil
+}
+
+func (s *Server) vmPause(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vm, err := s.get("VM", ref)
+	if err != nil {
+		return nil, err
+	}
+	if vm["power_state"] != "Running" {
+		return nil, Failure{"VM_BAD_POWER_STATE", ref, "running", strings.ToLower(str(vm["power_state"]))}
+	}
+	vm["power_state"] = "Paused"
+	return "", nil
+}
+
+// run moves a VM to Running and has its guest tools report GuestIP.
+func (s *Server) run(ref string, vm Record) {
+	vm["power_state"] = "Running"
+	if vm["guest_metrics"] == nullRef && s.GuestIP != "" {
+		vm["guest_metrics"] = s.create("VM_guest_metrics", Record{
+			"networks": map[string]interface{}{"0/ip": s.GuestIP},
+		})
+	}
+}
+
+func (s *Server) vmShutdown(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vm, err := s.get("VM", ref)
+	if err != nil {
+		return nil, err
+	}
+	if vm["power_state"] == "Halted" {
+		return nil, Failure{"VM_BAD_POWER_STATE", ref, "running", "halted"}
+	}
+
+	vm["power_state"] = "Halted"
+	vm["domid"] = "-1"
+	vm["resident_on"] = nullRef
+	if metrics := str(vm["guest_metrics"]); metrics != nullRef {
+		delete(s.objects["vm_guest_metrics"], metrics)
+		vm["guest_metrics"] = nullRef
+	}
+	for _, console := range vm["consoles"].([]interface{}) {
+		delete(s.objects["console"], str(console))
+	}
+	vm["consoles"] = []interface{}{}
+	for _, vbd := range vm["VBDs"].([]interface{}) {
+		s.objects["vbd"][str(vbd)]["currently_attached"] = false
+	}
+	for _, vif := range vm["VIFs"].([]interface{}) {
+		s.objects["vif"][str(vif)]["currently_attached"] = false
+	}
+	return "", nil
+}
+
+func (s *Server) vmSetMemoryLimits(params []interface{}) (interface{}, error) {
+	vm, err := s.get("VM", param(params, 0))
+	if err != nil {
+		return nil, err
+	}
+	vm["memory_static_min"] = param(params, 1)
+	vm["memory_static_max"] = param(params, 2)
+	vm["memory_dynamic_min"] = param(params, 3)
+	vm["memory_dynamic_max"] = param(params, 4)
+	return "", nil
+}
+
+// vmSetVCPUsMax and vmSetVCPUsAtStartup refuse to start a VM with more
+// vCPUs than its maximum, as XAPI does.
+func (s *Server) vmSetVCPUsMax(params []interface{}) (interface{}, error) {
+	vm, err := s.get("VM", param(params, 0))
+	if err != nil {
+		return nil, err
+	}
+	vcpus := param(params, 1)
+	if atoi(vcpus) < atoi(str(vm["VCPUs_at_startup"])) {
+		return nil, Failure{"VALUE_NOT_SUPPORTED", "VCPU_max", vcpus, "VCPU_max must be greater than or equal to VCPU_at_startup"}
+	}
+	vm["VCPUs_max"] = vcpus
+	return "", nil
+}
+
+func (s *Server) vmSetVCPUsAtStartup(params []interface{}) (interface{}, error) {
+	vm, err := s.get("VM", param(params, 0))
+	if err != nil {
+		return nil, err
+	}
+	vcpus := param(params, 1)
+	if atoi(vcpus) > atoi(str(vm["VCPUs_max"])) {
+		return nil, Failure{"VALUE_NOT_SUPPORTED", "VCPU_at_startup", vcpus, "VCPU_at_startup must be less than or equal to VCPU_max"}
+	}
+	vm["VCPUs_at_startup"] = vcpus
+	return "", nil
+}
+
+func (s *Server) vdiCreate(params []interface{}) (interface{}, error) {
+	fields, _ := paramValue(params, 0).(map[string]interface{})
+	record := Record(fields)
+
+	sr, err := s.get("SR", str(record["SR"]))
+	if err != nil {
+		return nil, err
+	}
+
+	record["VBDs"] = []interface{}{}
+	ref := s.create("VDI", record)
+	sr["VDIs"] = appendUnique(sr["VDIs"].([]interface{}), ref)
+	return ref, nil
+}
+
+func (s *Server) vdiClone(params []interface{}) (interface{}, error) {
+	source, err := s.get("VDI", param(params, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	clone := copyRecord(source)
+	clone["VBDs"] = []interface{}{}
+	ref := s.create("VDI", clone)
+	if data, ok := s.contents[param(params, 0)]; ok {
+		s.contents[ref] = append([]byte(nil), data...)
+	}
+	if sr, ok := s.objects["sr"][str(clone["SR"])]; ok {
+		sr["VDIs"] = appendUnique(sr["VDIs"].([]interface{}), ref)
+	}
+	return ref, nil
+}
+
+func (s *Server) vdiResize(params []interface{}) (interface{}, error) {
+	vdi, err := s.get("VDI", param(params, 0))
+	if err != nil {
+		return nil, err
+	}
+	vdi["virtual_size"] = param(params, 1)
+	return "", nil
+}
+
+func (s *Server) vdiDestroy(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vdi, err := s.get("VDI", ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, vbd := range vdi["VBDs"].([]interface{}) {
+		if s.objects["vbd"][str(vbd)]["currently_attached"] == true {
+			return nil, Failure{"VDI_IN_USE", ref, "destroy"}
+		}
+	}
+
+	if sr, ok := s.objects["sr"][str(vdi["SR"])]; ok {
+		sr["VDIs"] = without(sr["VDIs"].([]interface{}), ref)
+	}
+	for _, vbd := range vdi["VBDs"].([]interface{}) {
+		s.objects["vbd"][str(vbd)]["VDI"] = nullRef
+	}
+	delete(s.objects["vdi"], ref)
+	delete(s.contents, ref)
+	return "", nil
+}
+
+func (s *Server) vbdCreate(params []interface{}) (interface{}, error) {
+	fields, _ := paramValue(params, 0).(map[string]interface{})
+	record := Record(fields)
+
+	vm, err := s.get("VM", str(record["VM"]))
+	if err != nil {
+		return nil, err
+	}
+
+	var vdi Record
+	if str(record["VDI"]) != nullRef && str(record["VDI"]) != "" {
+		if vdi, err = s.get("VDI", str(record["VDI"])); err != nil {
+			return nil, err
+		}
+	} else {
+		record["VDI"] = nullRef
+	}
+
+	if userdevice := str(record["userdevice"]); userdevice == "" || userdevice == "autodetect" {
+		used := map[string]bool{}
+		for _, other := range vm["VBDs"].([]interface{}) {
+			used[str(s.objects["vbd"][str(other)]["userdevice"])] = true
+		}
+		for i := 0; ; i++ {
+			if !used[fmt.Sprint(i)] {
+				record["userdevice"] = fmt.Sprint(i)
+				break
+			}
+		}
+	}
+	record["currently_attached"] = vm["power_state"] != "Halted"
+
+	ref := s.create("VBD", record)
+	vm["VBDs"] = appendUnique(vm["VBDs"].([]interface{}), ref)
+	if vdi != nil {
+		vdi["VBDs"] = appendUnique(vdi["VBDs"].([]interface{}), ref)
+	}
+	return ref, nil
+}
+
+func (s *Server) vbdDestroy(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vbd, err := s.get("VBD", ref)
+	if err != nil {
+		return nil, err
+	}
+	if vbd["currently_attached"] == true {
+		return nil, Failure{"OPERATION_NOT_ALLOWED", "VBD '" + ref + "' still attached to '" + str(vbd["VM"]) + "'"}
+	}
+	if vm, ok := s.objects["vm"][str(vbd["VM"])]; ok {
+		vm["VBDs"] = without(vm["VBDs"].([]interface{}), ref)
+	}
+	if vdi, ok := s.objects["vdi"][str(vbd["VDI"])]; ok {
+		vdi["VBDs"] = without(vdi["VBDs"].([]interface{}), ref)
+	}
+	delete(s.objects["vbd"], ref)
+	return "", nil
+}
+
+func (s *Server) vbdPlug(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vbd, err := s.get("VBD", ref)
+	if err != nil {
+		return nil, err
+	}
+	if vbd["currently_attached"] == true {
+		return nil, Failure{"DEVICE_ALREADY_ATTACHED", ref}
+	}
+	vbd["currently_attached"] = true
+	return "", nil
+}
+
+func (s *Server) vbdUnplug(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vbd, err := s.get("VBD", ref)
+	if err != nil {
+		return nil, err
+	}
+	if vbd["currently_attached"] != true {
+		return nil, Failure{"DEVICE_ALREADY_DETACHED", ref}
+	}
+	vbd["currently_attached"] = false
+	return "", nil
+}
+
+func (s *Server) vifCreate(params []interface{}) (interface{}, error) {
+	fields, _ := paramValue(params, 0).(map[string]interface{})
+	record := Record(fields)
+
+	vm, err := s.get("VM", str(record["VM"]))
+	if err != nil {
+		return nil, err
+	}
+	network, err := s.get("network", str(record["network"]))
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range vm["VIFs"].([]interface{}) {
+		if s.objects["vif"][str(other)]["device"] == record["device"] {
+			return nil, Failure{"DEVICE_ALREADY_EXISTS", str(record["device"])}
+		}
+	}
+
+	ref := s.create("VIF", record)
+	vm["VIFs"] = appendUnique(vm["VIFs"].([]interface{}), ref)
+	network["VIFs"] = appendUnique(network["VIFs"].([]interface{}), ref)
+	return ref, nil
+}
+
+func (s *Server) vifDestroy(params []interface{}) (interface{}, error) {
+	ref := param(params, 0)
+	vif, err := s.get("VIF", ref)
+	if err != nil {
+		return nil, err
+	}
+	if vm, ok := s.objects["vm"][str(vif["VM"])]; ok {
+		vm["VIFs"] = without(vm["VIFs"].([]interface{}), ref)
+	}
+	if network, ok := s.objects["network"][str(vif["network"])]; ok {
+		network["VIFs"] = without(network["VIFs"].([]interface{}), ref)
+	}
+	delete(s.objects["vif"], ref)
+	return "", nil
+}
+
+func (s *Server) taskCreate(params []interface{}) (interface{}, error) {
+	return s.create("task", Record{
+		"name_label":       param(params, 0),
+		"name_description": param(params, 1),
+	}), nil
+}
+
+func (s *Server) hostCallPlugin(params []interface{}) (interface{}, error) {
+	return nil, Failure{"XENAPI_MISSING_PLUGIN", param(params, 1)}
+}
+
+// master returns the reference of the pool master. It must be called with
+// the lock held.
+func (s *Server) master() string {
+	for _, pool := range s.objects["pool"] {
+		return str(pool["master"])
+	}
+	return nullRef
+}
+
+// defaultSR returns the reference of the pool's default SR. It must be
+// called with the lock held.
+func (s *Server) defaultSR() string {
+	for _, pool := range s.objects["pool"] {
+		return str(pool["default_SR"])
+	}
+	return nullRef
+}
+
+// finishTask records the outcome of the HTTP request a task was passed to.
+// It must be called with the lock held.
+func (s *Server) finishTask(ref, result string, failure Failure) {
+	task, ok := s.objects["task"][ref]
+	if !ok {
+		return
+	}
+	task["progress"] = 1.0
+	if failure != nil {
+		task["status"] = "failure"
+		task["error_info"] = toSet(failure)
+		return
+	}
+	task["status"] = "success"
+	task["result"] = result
+}
+
+func canonicalMethod(method string) string {
+	class, action, ok := strings.Cut(method, ".")
+	if !ok {
+		return method
+	}
+	switch strings.ToLower(class) {
+	case "session", "task", "host", "pool", "network", "console", "event":
+		class = strings.ToLower(class)
+	}
+	return class + "." + action
+}
+
+func param(params []interface{}, i int) string {
+	return str(paramValue(params, i))
+}
+
+func paramValue(params []interface{}, i int) interface{} {
+	if i < len(params) {
+		return params[i]
+	}
+	return nil
+}
+
+// atoi returns the integer a field or parameter holds, or 0.
+func atoi(value string) int {
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+func str(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func toSet(items []string) []interface{} {
+	set := make([]interface{}, len(items))
+	for i, item := range items {
+		set[i] = item
+	}
+	return set
+}
+
+func appendUnique(set []interface{}, value interface{}) []interface{} {
+	for _, item := range set {
+		if item == value {
+			return set
+		}
+	}
+	return append(set, value)
+}
+
+func without(set []interface{}, value interface{}) []interface{} {
+	result := []interface{}{}
+	for _, item := range set {
+		if item != value {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,520 @@
+// Package xapitest provides an in-process stand-in for the XenServer /
+// XCP-ng API, so that steps and whole builds can be run in go test.
+//
+// The server speaks XML-RPC and JSON-RPC over HTTPS like xapi does and
+// keeps every object in memory. It implements enough of the VM lifecycle, storage and
+// network classes, event.from, as well as the import and export HTTP
+// handlers, for the builders to run from start to finish against it.
+// Anything it does not know about is answered with MESSAGE_METHOD_UNKNOWN.
+package xapitest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultUsername = "root"
+	DefaultPassword = "password"
+
+	// DefaultGuestIP is the address reported by the guest tools of every VM
+	// once it is running.
+	DefaultGuestIP = "192.0.2.10"
+
+	// DefaultTemplate is the name of the template the pool starts out with.
+	DefaultTemplate = "Other install media"
+
+	// DefaultSR and ISOSR are the names of the SRs the pool starts out with;
+	// DefaultSR is the pool's default SR.
+	DefaultSR = "Local storage"
+	ISOSR     = "ISOs"
+
+	// DefaultNetwork is the name of the management network.
+	DefaultNetwork = "Pool-wide network associated with eth0"
+
+	nullRef = "OpaqueRef:NULL"
+)
+
+// Record holds the fields of a XAPI object, with the values as they travel
+// over XML-RPC: strings (also used for integers, refs and enums), booleans,
+// float64s, []interface{} for sets and map[string]interface{} for maps.
+type Record map[string]interface{}
+
+// Failure is a XAPI error: an error code followed by its parameters.
+type Failure []string
+
+func (f Failure) Error() string {
+	return strings.Join(f, " ")
+}
+
+// ErrLostResponse, when returned by a MethodFunc, makes the server close the
+// connection instead of answering, as if the response had been lost on its
+// way back. Whatever the method did before returning it stands.
+var ErrLostResponse = errors.New("xapitest: lost response")
+
+// MethodFunc implements an API method. params include the session
+// reference for every method apart from session.login_with_password.
+type MethodFunc func(params []interface{}) (interface{}, error)
+
+type Server struct {
+	Username string
+	Password string
+	GuestIP  string
+
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	objects   map[string]map[string]Record
+	classes   map[string]string
+	contents  map[string][]byte
+	overrides map[string]MethodFunc
+	calls     map[string]int
+	protocols map[string]int
+
+	// generation counts the changes reported by event.from, changed is
+	// closed whenever there are new ones
+	generation int64
+	changes    map[string]*change
+	changed    chan struct{}
+
+	// closed releases event.from calls still blocked when the server is
+	// closed
+	closed chan struct{}
+}
+
+// NewServer starts a server with a single host pool, a template, a default
+// SR, an ISO SR and a management network.
+func NewServer() *Server {
+	s := &Server{
+		Username:  DefaultUsername,
+		Password:  DefaultPassword,
+		GuestIP:   DefaultGuestIP,
+		objects:   make(map[string]map[string]Record),
+		classes:   make(map[string]string),
+		contents:  make(map[string][]byte),
+		overrides: make(map[string]MethodFunc),
+		calls:     make(map[string]int),
+		protocols: make(map[string]int),
+		changes:   make(map[string]*change),
+		changed:   make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	s.populate()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveXMLRPC)
+	mux.HandleFunc("/jsonrpc", s.serveJSONRPC)
+	mux.HandleFunc("/import_raw_vdi", s.serveImportRawVdi)
+	mux.HandleFunc("/import", s.serveImport)
+	mux.HandleFunc("/export", s.serveExport)
+	mux.HandleFunc("/export_raw_vdi", s.serveExportRawVdi)
+	s.srv = httptest.NewTLSServer(mux)
+
+	host := s.lookup("host", "name_label", "fake-host")
+	s.objects["host"][host]["address"] = s.Host()
+
+	return s
+}
+
+func (s *Server) Close() {
+	close(s.closed)
+	s.srv.Close()
+}
+
+// Host returns the address of the server in the host:port form expected by
+// remote_host.
+func (s *Server) Host() string {
+	return s.srv.Listener.Addr().String()
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the server certificate,
+// suitable for remote_tls_fingerprint.
+func (s *Server) Fingerprint() string {
+	sum := sha256.Sum256(s.srv.Certificate().Raw)
+	return fmt.Sprintf("%x", sum)
+}
+
+// Handle replaces the implementation of method, e.g. "VM.start", with fn.
+// fn is run without the server lock held, so it may call Invoke to fall
+// back to the built-in behaviour.
+func (s *Server) Handle(method string, fn MethodFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides[canonicalMethod(method)] = fn
+}
+
+// Invoke runs the built-in implementation of method.
+func (s *Server) Invoke(method string, params []interface{}) (interface{}, error) {
+	method = canonicalMethod(method)
+	if method == "event.from" {
+		return s.eventFrom(params)
+	}
+
+	s.mu.Lock()
+	defer s.unlock()
+	return s.invoke(method, params)
+}
+
+// Calls returns how many times method has been called, over either
+// protocol.
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[canonicalMethod(method)]
+}
+
+// ProtocolCalls returns how many calls were made over protocol, "xmlrpc" or
+// "jsonrpc".
+func (s *Server) ProtocolCalls(protocol string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.protocols[protocol]
+}
+
+// Create adds an object of the given class and returns its reference.
+func (s *Server) Create(class string, fields Record) string {
+	s.mu.Lock()
+	defer s.unlock()
+	return s.create(class, fields)
+}
+
+// Records returns a copy of every object of class, keyed by reference.
+func (s *Server) Records(class string) map[string]Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make(map[string]Record)
+	for ref, record := range s.objects[strings.ToLower(class)] {
+		records[ref] = copyRecord(record)
+	}
+	return records
+}
+
+// Find returns the references of the objects of class whose name_label is
+// name.
+func (s *Server) Find(class, name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filter(class, "name_label", name)
+}
+
+// Content returns the data last written to the VDI with the given
+// reference, either by an import or by SetContent.
+func (s *Server) Content(vdi string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.contents[vdi]
+}
+
+// SetContent replaces the data of the VDI with the given reference.
+func (s *Server) SetContent(vdi string, data []byte) {
+	s.mu.Lock()
+	defer s.unlock()
+	s.contents[vdi] = data
+	s.objects["vdi"][vdi]["physical_utilisation"] = fmt.Sprint(len(data))
+}
+
+func (s *Server) populate() {
+	sr := s.create("SR", Record{
+		"name_label":   DefaultSR,
+		"type":         "ext",
+		"content_type": "user",
+	})
+	s.create("SR", Record{
+		"name_label":   ISOSR,
+		"type":         "iso",
+		"content_type": "iso",
+	})
+
+	host := s.create("host", Record{
+		"name_label": "fake-host",
+		"software_version": map[string]interface{}{
+			"product_brand":   "XCP-ng",
+			"product_version": "8.2.1",
+		},
+	})
+	s.create("pool", Record{
+		"master":     host,
+		"default_SR": sr,
+	})
+
+	network := s.create("network", Record{
+		"name_label": DefaultNetwork,
+		"bridge":     "xenbr0",
+	})
+	pif := s.create("PIF", Record{
+		"device":     "eth0",
+		"network":    network,
+		"host":       host,
+		"management": true,
+	})
+	s.objects["network"][network]["PIFs"] = []interface{}{pif}
+
+	s.create("VM", Record{
+		"name_label":      DefaultTemplate,
+		"is_a_template":   true,
+		"platform":        map[string]interface{}{"viridian": "false"},
+		"other_config":    map[string]interface{}{"install-methods": "cdrom", "disks": `<provision/>`},
+		"HVM_boot_policy": "BIOS order",
+	})
+}
+
+// create must be called with the lock held.
+func (s *Server) create(class string, fields Record) string {
+	key := strings.ToLower(class)
+	if _, ok := s.classes[key]; !ok {
+		s.classes[key] = class
+	}
+	if s.objects[key] == nil {
+		s.objects[key] = make(map[string]Record)
+	}
+
+	uuid := newUUID()
+	ref := "OpaqueRef:" + newUUID()
+
+	record := defaults(key)
+	for field, value := range fields {
+		record[field] = value
+	}
+	record["uuid"] = uuid
+
+	s.objects[key][ref] = record
+	return ref
+}
+
+// get must be called with the lock held.
+func (s *Server) get(class, ref string) (Record, error) {
+	record, ok := s.objects[strings.ToLower(class)][ref]
+	if !ok {
+		return nil, Failure{"HANDLE_INVALID", s.className(class), ref}
+	}
+	return record, nil
+}
+
+// filter must be called with the lock held.
+func (s *Server) filter(class, field string, value interface{}) []string {
+	refs := []string{}
+	for ref, record := range s.objects[strings.ToLower(class)] {
+		if record[field] == value {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// lookup returns the first object whose field has value. It must be called
+// with the lock held.
+func (s *Server) lookup(class, field string, value interface{}) string {
+	if refs := s.filter(class, field, value); len(refs) > 0 {
+		return refs[0]
+	}
+	return nullRef
+}
+
+func (s *Server) className(class string) string {
+	if name, ok := s.classes[strings.ToLower(class)]; ok {
+		return name
+	}
+	return class
+}
+
+func defaults(class string) Record {
+	switch class {
+	case "vm":
+		return Record{
+			"name_label":         "",
+			"name_description":   "",
+			"power_state":        "Halted",
+			"is_a_template":      false,
+			"is_control_domain":  false,
+			"VBDs":               []interface{}{},
+			"VIFs":               []interface{}{},
+			"consoles":           []interface{}{},
+			"tags":               []interface{}{},
+			"other_config":       map[string]interface{}{},
+			"platform":           map[string]interface{}{},
+			"blocked_operations": map[string]interface{}{},
+			"HVM_boot_policy":    "",
+			"HVM_boot_params":    map[string]interface{}{},
+			"VCPUs_max":          "1",
+			"VCPUs_at_startup":   "1",
+			"memory_static_min":  "0",
+			"memory_static_max":  "0",
+			"memory_dynamic_min": "0",
+			"memory_dynamic_max": "0",
+			"domid":              "-1",
+			"resident_on":        nullRef,
+			"affinity":           nullRef,
+			"guest_metrics":      nullRef,
+		}
+	case "vdi":
+		return Record{
+			"name_label":           "",
+			"name_description":     "",
+			"SR":                   nullRef,
+			"VBDs":                 []interface{}{},
+			"virtual_size":         "0",
+			"physical_utilisation": "0",
+			"type":                 "user",
+			"sharable":             false,
+			"read_only":            false,
+			"managed":              true,
+			"is_a_snapshot":        false,
+			"other_config":         map[string]interface{}{},
+			"sm_config":            map[string]interface{}{},
+			"tags":                 []interface{}{},
+		}
+	case "vbd":
+		return Record{
+			"VM":                   nullRef,
+			"VDI":                  nullRef,
+			"userdevice":           "",
+			"device":               "",
+			"bootable":             false,
+			"mode":                 "RW",
+			"type":                 "Disk",
+			"empty":                false,
+			"unpluggable":          true,
+			"currently_attached":   false,
+			"other_config":         map[string]interface{}{},
+			"qos_algorithm_type":   "",
+			"qos_algorithm_params": map[string]interface{}{},
+		}
+	case "vif":
+		return Record{
+			"device":             "",
+			"network":            nullRef,
+			"VM":                 nullRef,
+			"MAC":                "",
+			"MTU":                "1500",
+			"currently_attached": false,
+			"locking_mode":       "network_default",
+			"other_config":       map[string]interface{}{},
+		}
+	case "sr":
+		return Record{
+			"name_label":           "",
+			"name_description":     "",
+			"type":                 "",
+			"content_type":         "",
+			"shared":               false,
+			"VDIs":                 []interface{}{},
+			"PBDs":                 []interface{}{},
+			"physical_size":        fmt.Sprint(100 << 30),
+			"physical_utilisation": "0",
+			"virtual_allocation":   "0",
+			"other_config":         map[string]interface{}{},
+			"sm_config":            map[string]interface{}{},
+			"tags":                 []interface{}{},
+		}
+	case "network":
+		return Record{
+			"name_label":       "",
+			"name_description": "",
+			"bridge":           "",
+			"MTU":              "1500",
+			"VIFs":             []interface{}{},
+			"PIFs":             []interface{}{},
+			"assigned_ips":     map[string]interface{}{},
+			"other_config":     map[string]interface{}{},
+			"tags":             []interface{}{},
+		}
+	case "pif":
+		return Record{
+			"device":       "",
+			"network":      nullRef,
+			"host":         nullRef,
+			"management":   false,
+			"IP":           "",
+			"other_config": map[string]interface{}{},
+		}
+	case "task":
+		return Record{
+			"name_label":       "",
+			"name_description": "",
+			"status":           "pending",
+			"progress":         0.0,
+			"result":           "",
+			"error_info":       []interface{}{},
+			"other_config":     map[string]interface{}{},
+		}
+	case "host":
+		return Record{
+			"name_label":       "",
+			"address":          "",
+			"enabled":          true,
+			"software_version": map[string]interface{}{},
+			"other_config":     map[string]interface{}{},
+		}
+	case "pool":
+		return Record{
+			"name_label":   "",
+			"master":       nullRef,
+			"default_SR":   nullRef,
+			"other_config": map[string]interface{}{},
+		}
+	case "console":
+		return Record{
+			"protocol":     "rfb",
+			"location":     "",
+			"VM":           nullRef,
+			"other_config": map[string]interface{}{},
+		}
+	case "vm_guest_metrics":
+		return Record{
+			"networks":     map[string]interface{}{},
+			"os_version":   map[string]interface{}{},
+			"other_config": map[string]interface{}{},
+		}
+	case "session":
+		return Record{
+			"this_host":    nullRef,
+			"this_user":    nullRef,
+			"originator":   "",
+			"other_config": map[string]interface{}{},
+		}
+	}
+	return Record{}
+}
+
+func copyRecord(record Record) Record {
+	c := make(Record, len(record))
+	for field, value := range record {
+		c[field] = copyValue(value)
+	}
+	return c
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, item := range v {
+			c[i] = copyValue(item)
+		}
+		return c
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			c[key] = copyValue(item)
+		}
+		return c
+	}
+	return value
+}
+
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
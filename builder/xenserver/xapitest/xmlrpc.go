@@ -0,0 +1,190 @@
+package xapitest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The subset of XML-RPC spoken by XAPI. Integers travel as strings, so the
+// only scalar types needed in practice are strings, booleans and doubles.
+
+type methodCall struct {
+	MethodName string     `xml:"methodName"`
+	Params     []xmlValue `xml:"params>param>value"`
+}
+
+type xmlValue struct {
+	String   *string    `xml:"string"`
+	Int      *string    `xml:"int"`
+	I4       *string    `xml:"i4"`
+	I8       *string    `xml:"i8"`
+	Boolean  *string    `xml:"boolean"`
+	Double   *string    `xml:"double"`
+	DateTime *string    `xml:"dateTime.iso8601"`
+	Base64   *string    `xml:"base64"`
+	Struct   *xmlStruct `xml:"struct"`
+	Array    *xmlArray  `xml:"array"`
+	Text     string     `xml:",chardata"`
+}
+
+type xmlStruct struct {
+	Members []xmlMember `xml:"member"`
+}
+
+type xmlMember struct {
+	Name  string   `xml:"name"`
+	Value xmlValue `xml:"value"`
+}
+
+type xmlArray struct {
+	Values []xmlValue `xml:"data>value"`
+}
+
+func decodeCall(r io.Reader) (method string, params []interface{}, err error) {
+	var call methodCall
+	if err = xml.NewDecoder(r).Decode(&call); err != nil {
+		return "", nil, err
+	}
+
+	params = make([]interface{}, len(call.Params))
+	for i, v := range call.Params {
+		if params[i], err = v.decode(); err != nil {
+			return "", nil, err
+		}
+	}
+	return call.MethodName, params, nil
+}
+
+func (v xmlValue) decode() (interface{}, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Int != nil:
+		return strings.TrimSpace(*v.Int), nil
+	case v.I4 != nil:
+		return strings.TrimSpace(*v.I4), nil
+	case v.I8 != nil:
+		return strings.TrimSpace(*v.I8), nil
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1", nil
+	case v.Double != nil:
+		return strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+	case v.DateTime != nil:
+		return *v.DateTime, nil
+	case v.Base64 != nil:
+		return *v.Base64, nil
+	case v.Struct != nil:
+		m := make(map[string]interface{}, len(v.Struct.Members))
+		for _, member := range v.Struct.Members {
+			value, err := member.Value.decode()
+			if err != nil {
+				return nil, err
+			}
+			m[member.Name] = value
+		}
+		return m, nil
+	case v.Array != nil:
+		a := make([]interface{}, len(v.Array.Values))
+		for i, item := range v.Array.Values {
+			value, err := item.decode()
+			if err != nil {
+				return nil, err
+			}
+			a[i] = value
+		}
+		return a, nil
+	default:
+		return v.Text, nil
+	}
+}
+
+func encodeResponse(w io.Writer, value interface{}) error {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?><methodResponse><params><param>`)
+	if err := encodeValue(&b, value); err != nil {
+		return err
+	}
+	b.WriteString(`</param></params></methodResponse>`)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func encodeValue(b *strings.Builder, value interface{}) error {
+	b.WriteString("<value>")
+	switch v := value.(type) {
+	case nil:
+		b.WriteString("<string></string>")
+	case string:
+		b.WriteString("<string>")
+		xml.EscapeText(b, []byte(v))
+		b.WriteString("</string>")
+	case int:
+		fmt.Fprintf(b, "<string>%d</string>", v)
+	case int64:
+		fmt.Fprintf(b, "<string>%d</string>", v)
+	case bool:
+		if v {
+			b.WriteString("<boolean>1</boolean>")
+		} else {
+			b.WriteString("<boolean>0</boolean>")
+		}
+	case float64:
+		fmt.Fprintf(b, "<double>%s</double>", strconv.FormatFloat(v, 'f', -1, 64))
+	case []string:
+		b.WriteString("<array><data>")
+		for _, item := range v {
+			if err := encodeValue(b, item); err != nil {
+				return err
+			}
+		}
+		b.WriteString("</data></array>")
+	case []interface{}:
+		b.WriteString("<array><data>")
+		for _, item := range v {
+			if err := encodeValue(b, item); err != nil {
+				return err
+			}
+		}
+		b.WriteString("</data></array>")
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = item
+		}
+		return encodeStruct(b, m)
+	case Record:
+		return encodeStruct(b, v)
+	case map[string]interface{}:
+		return encodeStruct(b, v)
+	default:
+		return fmt.Errorf("cannot encode %T as XML-RPC", value)
+	}
+	b.WriteString("</value>")
+	return nil
+}
+
+func encodeStruct(b *strings.Builder, m map[string]interface{}) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b.WriteString("<struct>")
+	for _, key := range keys {
+		b.WriteString("<member><name>")
+		xml.EscapeText(b, []byte(key))
+		b.WriteString("</name>")
+		if err := encodeValue(b, m[key]); err != nil {
+			return err
+		}
+		b.WriteString("</member>")
+	}
+	b.WriteString("</struct></value>")
+	return nil
+}
@@ -0,0 +1,114 @@
+package xapitest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// The XVA archives produced and accepted by the server only resemble real
+// ones: an ova.xml describing the VM followed by one Ref:<n>/00000000
+// member per disk. They are meant to round trip through the server, not
+// to be imported into a real pool.
+
+type ovaXML struct {
+	XMLName   xml.Name `xml:"vm"`
+	NameLabel string   `xml:"name_label,attr"`
+}
+
+// WriteXVA writes an archive for a VM called name with the given disks.
+func WriteXVA(w io.Writer, name string, disks ...[]byte) error {
+	tw := tar.NewWriter(w)
+
+	ova, err := xml.Marshal(ovaXML{NameLabel: name})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "ova.xml", ova); err != nil {
+		return err
+	}
+	for i, data := range disks {
+		if err := writeTarFile(tw, fmt.Sprintf("Ref:%d/00000000", i), data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ReadXVA reads an archive written by WriteXVA, compressed or not.
+func ReadXVA(r io.Reader) (name string, disks [][]byte, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", nil, err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var ova *ovaXML
+	chunks := map[string][]byte{}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return "", nil, err
+		}
+
+		switch {
+		case header.Name == "ova.xml":
+			ova = &ovaXML{}
+			if err := xml.Unmarshal(content, ova); err != nil {
+				return "", nil, err
+			}
+		case strings.HasPrefix(header.Name, "Ref:"):
+			disk, _, _ := strings.Cut(header.Name, "/")
+			chunks[disk] = append(chunks[disk], content...)
+		}
+	}
+	if ova == nil {
+		return "", nil, errors.New("archive does not contain ova.xml")
+	}
+
+	refs := make([]string, 0, len(chunks))
+	for ref := range chunks {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		disks = append(disks, chunks[ref])
+	}
+	return ova.NameLabel, disks, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(data)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
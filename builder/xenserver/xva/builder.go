@@ -3,6 +3,8 @@ package xva
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
@@ -43,25 +45,25 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, warns []stri
 		errs, self.config.CommonConfig.Prepare(self.config.GetInterpContext(), &self.config.PackerConfig)...)
 	errs = packer.MultiErrorAppend(errs, self.config.SSHConfig.Prepare(self.config.GetInterpContext())...)
 
-	// Set default values
-	if self.config.VCPUsMax == 0 {
-		self.config.VCPUsMax = 1
-	}
-
-	if self.config.VCPUsAtStartup == 0 {
-		self.config.VCPUsAtStartup = 1
-	}
+	// Set default values. vCPUs and memory are left at zero, which keeps
+	// those of the XVA.
 
-	if self.config.VCPUsAtStartup > self.config.VCPUsMax {
+	if self.config.VCPUsMax != 0 && self.config.VCPUsAtStartup > self.config.VCPUsMax {
 		self.config.VCPUsAtStartup = self.config.VCPUsMax
 	}
 
-	if self.config.VMMemory == 0 {
-		self.config.VMMemory = 1024
+	if self.config.RawInstallTimeout == "" {
+		self.config.RawInstallTimeout = "200m"
 	}
 
 	// Validation
 
+	self.config.InstallTimeout, err = time.ParseDuration(self.config.RawInstallTimeout)
+	if err != nil {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("Failed to parse install_timeout: %s", err))
+	}
+
 	if self.config.SourcePath == "" && self.config.CloneTemplate == "" {
 		errs = packer.MultiErrorAppend(
 			errs, errors.New("Either source_path or clone_template must be specified"))
@@ -79,29 +81,34 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, warns []stri
 }
 
 func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
-	//Setup XAPI client
-	c, err := xscommon.NewXenAPIClient(self.config.HostIp, self.config.Username, self.config.Password)
-
+	state, logout, err := xscommon.NewBuildState(ctx, self.config, ui, hook)
 	if err != nil {
 		return nil, err
 	}
+	defer logout()
 
-	ui.Say("XAPI client session established")
-
-	c.GetClient().Host.GetAll(c.GetSessionRef())
+	httpReqChan := make(chan string, 1)
 
-	//Share state between the other steps using a statebag
-	state := new(multistep.BasicStateBag)
-	state.Put("client", c)
-	state.Put("config", self.config)
-	state.Put("commonconfig", self.config.CommonConfig)
-	state.Put("hook", hook)
-	state.Put("ui", ui)
+	// statePath returns the path a step stored under key, if any
+	statePath := func(key string) string {
+		if value, ok := state.GetOk(key); ok {
+			return value.(string)
+		}
+		return ""
+	}
 
-	httpReqChan := make(chan string, 1)
+	// The VM is either imported from source_path or cloned from
+	// clone_template
+	var sourceStep multistep.Step = new(stepImportInstance)
+	if self.config.SourcePath == "" {
+		sourceStep = &xscommon.StepCreateInstance{
+			AssumePreInstalledOS: true,
+		}
+	}
 
 	//Build the steps
 	steps := []multistep.Step{
+		new(xscommon.StepPreflight),
 		&xscommon.StepPrepareOutputDir{
 			Force: self.config.PackerForce,
 			Path:  self.config.OutputDir,
@@ -117,6 +124,18 @@ func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (p
 		&xscommon.StepHTTPServer{
 			Chan: httpReqChan,
 		},
+		&xscommon.StepCheckFreeSpace{
+			Uploads: func() []xscommon.Upload {
+				return []xscommon.Upload{
+					{Path: statePath("cd_path")},
+					{Path: statePath("floppy_path")},
+				}
+			},
+			ImportPath: self.config.SourcePath,
+			ImportSR: func(ctx context.Context, c xscommon.SRClient) (xsclient.SRRef, error) {
+				return importSR(ctx, c, self.config.CommonConfig)
+			},
+		},
 		&xscommon.StepUploadVdi{
 			VdiNameFunc: func() string {
 				return "Packer-CD"
@@ -145,10 +164,7 @@ func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (p
 			VdiName:    self.config.ToolsIsoName,
 			VdiUuidKey: "tools_vdi_uuid",
 		},
-		&xscommon.StepCreateInstance{
-			AssumePreInstalledOS: true,
-		},
-		new(stepImportInstance),
+		sourceStep,
 		&xscommon.StepAttachVdi{
 			VdiUuidKey: "floppy_vdi_uuid",
 			VdiType:    xsclient.VbdTypeFloppy,
@@ -161,6 +177,7 @@ func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (p
 			VdiUuidKey: "cd_vdi_uuid",
 			VdiType:    xsclient.VbdTypeCD,
 		},
+		new(xscommon.StepAttachExistingDisks),
 		new(xscommon.StepStartVmPaused),
 		new(xscommon.StepSetVmHostSshAddress),
 		new(xscommon.StepBootWait),
@@ -196,6 +213,7 @@ func (self *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (p
 		&xscommon.StepDetachVdi{
 			VdiUuidKey: "floppy_vdi_uuid",
 		},
+		new(xscommon.StepDetachExistingDisks),
 		new(xscommon.StepExport),
 	}
 
@@ -1,10 +1,23 @@
 package xva
 
 import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskformat"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/xapitest"
 )
 
 func testConfig() map[string]interface{} {
@@ -192,3 +205,546 @@ func TestBuilderPrepare_SourcePath(t *testing.T) {
 		t.Fatalf("should not have error: %s", err)
 	}
 }
+
+func testRunConfig(t *testing.T, server *xapitest.Server) (map[string]interface{}, string) {
+	config := testConfig()
+	dir := server.Configure(t, config)
+
+	fh, err := os.Create(filepath.Join(dir, "appliance.xva"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer fh.Close()
+	if err := xapitest.WriteXVA(fh, "appliance", []byte("root disk")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	config["source_path"] = fh.Name()
+	return config, dir
+}
+
+func TestBuilderRun_CloneTemplate(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config := testConfig()
+	delete(config, "source_path")
+	config["clone_template"] = xapitest.DefaultTemplate
+	dir := server.Configure(t, config)
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	artifact, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if artifact == nil {
+		t.Fatal("should have an artifact")
+	}
+
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	if vm := server.Records("VM")[vms[0]]; vm["is_a_template"] != true {
+		t.Errorf("VM should have been turned into a template")
+	}
+
+	fh, err := os.Open(filepath.Join(dir, "output", "foo.xva"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer fh.Close()
+	if name, _, err := xapitest.ReadXVA(fh); err != nil || name != "foo" {
+		t.Errorf("bad export: %q, %v", name, err)
+	}
+}
+
+func TestBuilderRun_ExportDisks(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server)
+	disks := []string{"root disk", "swap disk", "data disk"}
+	fh, err := os.Create(config["source_path"].(string))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := xapitest.WriteXVA(fh, "appliance", []byte(disks[0]), []byte(disks[1]), []byte(disks[2])); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fh.Close()
+	config["format"] = "vdi_raw"
+	config["export_parallelism"] = 2
+
+	var b Builder
+	_, _, err = b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "output", "*.raw"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(matches) != len(disks) {
+		t.Errorf("bad: expected %d exported disks, got %v", len(disks), matches)
+	}
+	for i, content := range disks {
+		filename := filepath.Join(dir, "output", fmt.Sprintf("foo-%d-appliance_%d.raw", i, i))
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Errorf("should have exported disk %d: %s", i, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("bad content of disk %d: %q", i, data)
+		}
+		if _, err := os.Stat(filename + ".sha256"); err != nil {
+			t.Errorf("should have recorded the checksum of disk %d: %s", i, err)
+		}
+	}
+}
+
+func TestBuilderRun_ExportVMDK(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server)
+	config["format"] = "vdi_vmdk"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	filename := filepath.Join(dir, "output", "foo-0-appliance_0.vmdk")
+	if format, err := diskformat.Detect(filename); err != nil || format != diskformat.VMDK {
+		t.Fatalf("should have exported a VMDK, got %s: %v", format, err)
+	}
+	raw := filepath.Join(dir, "disk.raw")
+	if _, err := diskformat.ConvertToRaw(raw, filename, diskformat.VMDK); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// VMDKs hold whole sectors, which the disk of the fake server isn't
+	data, err := os.ReadFile(raw)
+	if err != nil || len(data) != 512 || strings.TrimRight(string(data), "\x00") != "root disk" {
+		t.Errorf("bad exported disk of %d bytes: %v", len(data), err)
+	}
+}
+
+func TestBuilderRun_ExportOVA(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server)
+	config["format"] = "ova"
+	config["vcpus_max"] = 2
+	config["vm_memory"] = 2048
+	config["firmware"] = "uefi"
+	config["network_names"] = []string{xapitest.DefaultNetwork}
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "output"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, " ") != "foo.ova foo.ova.sha256" {
+		t.Errorf("bad output: %v", names)
+	}
+
+	fh, err := os.Open(filepath.Join(dir, "output", "foo.ova"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer fh.Close()
+	files := map[string][]byte{}
+	names = nil
+	tr := tar.NewReader(fh)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if files[header.Name], err = io.ReadAll(tr); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		names = append(names, header.Name)
+	}
+	if strings.Join(names, " ") != "foo.ovf foo.mf foo-0-appliance_0.vmdk" {
+		t.Fatalf("bad OVA: %v", names)
+	}
+
+	ovf := string(files["foo.ovf"])
+	if err := xml.Unmarshal(files["foo.ovf"], new(struct{})); err != nil {
+		t.Errorf("OVF descriptor should be well-formed: %s", err)
+	}
+	for _, expected := range []string{
+		`ovf:href="foo-0-appliance_0.vmdk"`,
+		`<rasd:VirtualQuantity>2</rasd:VirtualQuantity>`,
+		`<rasd:VirtualQuantity>2048</rasd:VirtualQuantity>`,
+		`<rasd:Connection>` + xapitest.DefaultNetwork + `</rasd:Connection>`,
+		`vmw:key="firmware" vmw:value="efi"`,
+		`vmdk.html#streamOptimized`,
+	} {
+		if !strings.Contains(ovf, expected) {
+			t.Errorf("OVF descriptor should contain %s:\n%s", expected, ovf)
+		}
+	}
+
+	for _, name := range []string{"foo.ovf", "foo-0-appliance_0.vmdk"} {
+		sum := sha256.Sum256(files[name])
+		line := fmt.Sprintf("SHA256(%s)= %s\n", name, hex.EncodeToString(sum[:]))
+		if !strings.Contains(string(files["foo.mf"]), line) {
+			t.Errorf("manifest should contain %q:\n%s", line, files["foo.mf"])
+		}
+	}
+}
+
+func TestBuilderRun_ExportOVAUnsafeName(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	// The OVA is named after the VM, minus the characters unsafe in file
+	// names
+	config, dir := testRunConfig(t, server)
+	config["format"] = "ova"
+	config["vm_name"] = "../web server"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "output"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, " ") != ".._web_server.ova .._web_server.ova.sha256" {
+		t.Errorf("bad output: %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "web server.ova")); err == nil {
+		t.Errorf("should not have written the OVA outside of the output directory")
+	}
+}
+
+func TestBuilderRun_ExportOVF(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server)
+	config["format"] = "ovf"
+	config["ovf_disk_format"] = "vhd"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	for _, name := range []string{"foo.ovf", "foo.mf", "foo-0-appliance_0.vhd"} {
+		if _, err := os.Stat(filepath.Join(dir, "output", name)); err != nil {
+			t.Errorf("should have exported %s: %s", name, err)
+		}
+	}
+	ovf, err := os.ReadFile(filepath.Join(dir, "output", "foo.ovf"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(string(ovf), `ovf:href="foo-0-appliance_0.vhd"`) || !strings.Contains(string(ovf), "xen-3.0-unknown") {
+		t.Errorf("bad OVF descriptor:\n%s", ovf)
+	}
+}
+
+func TestBuilderRun_ExportFormats(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server)
+	config["formats"] = []string{"xva_compressed", "vdi_vhd"}
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	artifact, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	files := artifact.Files()
+	for _, name := range []string{"foo.xva", "foo-0-appliance_0.vhd"} {
+		path := filepath.Join(dir, "output", name)
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("should have exported %s: %s", name, err)
+		}
+		if !slices.Contains(files, path) {
+			t.Errorf("artifact should contain %s: %v", path, files)
+		}
+	}
+}
+
+func TestBuilderPrepare_Formats(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	config["formats"] = []string{"xva", "ova"}
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	bad := [][]string{
+		{"xva", "xva_compressed"},
+		{"none", "xva"},
+		{"ova", "ova"},
+		{"ovf", "vdi_vmdk"},
+		{"foo"},
+	}
+	for _, formats := range bad {
+		config["formats"] = formats
+		b = Builder{}
+		if _, _, err := b.Prepare(config); err == nil {
+			t.Errorf("should have error for %v", formats)
+		}
+	}
+
+	config["formats"] = []string{"xva"}
+	config["format"] = "xva"
+	b = Builder{}
+	if _, _, err := b.Prepare(config); err == nil {
+		t.Fatal("should have error with both format and formats")
+	}
+}
+
+func TestBuilderRun_SourcePath(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	config, dir := testRunConfig(t, server)
+	config["vcpus_max"] = 2
+	config["vm_memory"] = 2048
+	config["vm_description"] = "imported"
+	config["network_names"] = []string{xapitest.DefaultNetwork}
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	artifact, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{})
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if artifact == nil {
+		t.Fatal("should have an artifact")
+	}
+
+	if vms := server.Find("VM", "appliance"); len(vms) != 0 {
+		t.Errorf("imported VM should have been renamed")
+	}
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	vm := server.Records("VM")[vms[0]]
+	if vm["is_a_template"] != true {
+		t.Errorf("VM should have been turned into a template")
+	}
+	if vm["VCPUs_max"] != "2" || vm["memory_static_max"] != fmt.Sprint(2048<<20) || vm["name_description"] != "imported" {
+		t.Errorf("VM settings should have been applied: %v vCPUs, %v bytes, %q",
+			vm["VCPUs_max"], vm["memory_static_max"], vm["name_description"])
+	}
+	if vifs := vm["VIFs"].([]interface{}); len(vifs) != 1 {
+		t.Errorf("bad: expected one VIF, got %d", len(vifs))
+	}
+
+	fh, err := os.Open(filepath.Join(dir, "output", "foo.xva"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer fh.Close()
+	name, disks, err := xapitest.ReadXVA(fh)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if name != "foo" || len(disks) != 1 || string(disks[0]) != "root disk" {
+		t.Errorf("bad export: %s with %d disks", name, len(disks))
+	}
+}
+
+func TestBuilderRun_SourcePathSizing(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	// Without vcpus_max, vcpus_atstartup and vm_memory the imported VM
+	// keeps its own sizing
+	config, _ := testRunConfig(t, server)
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	for _, method := range []string{"VM.set_VCPUs_max", "VM.set_VCPUs_at_startup", "VM.set_memory_limits"} {
+		if n := server.Calls(method); n != 0 {
+			t.Errorf("%s should not have been called, got %d calls", method, n)
+		}
+	}
+	vms := server.Find("VM", "foo")
+	if len(vms) != 1 {
+		t.Fatalf("bad: expected one VM, got %d", len(vms))
+	}
+	imported := server.Records("VM")[vms[0]]
+	if imported["VCPUs_max"] != "1" || imported["memory_static_max"] != "0" {
+		t.Errorf("VM settings should have been kept: %v vCPUs, %v bytes", imported["VCPUs_max"], imported["memory_static_max"])
+	}
+}
+
+func TestBuilderRun_SourcePathCleanup(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	// Never getting an IP fails the build once the VM has been imported
+	config, _ := testRunConfig(t, server)
+	config["ip_getter"] = "http"
+	config["install_timeout"] = "1s"
+	config["keep_vm"] = "never"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err == nil {
+		t.Fatal("should have error")
+	}
+
+	if n := len(server.Records("VM")); n != 1 {
+		t.Errorf("imported VM should have been destroyed, got %d VMs", n)
+	}
+	for _, vdi := range server.Records("VDI") {
+		if strings.HasPrefix(vdi["name_label"].(string), "appliance") {
+			t.Errorf("imported VDI '%s' should have been destroyed", vdi["name_label"])
+		}
+	}
+}
+
+func TestBuilderRun_SourcePathCleanupDisks(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	// Listing the disks fails right after the import, so only Cleanup can
+	// find them
+	server.Handle("VM.get_VBDs", func(params []interface{}) (interface{}, error) {
+		if server.Calls("VM.get_VBDs") == 1 {
+			return nil, xapitest.Failure{"INTERNAL_ERROR", "test"}
+		}
+		return server.Invoke("VM.get_VBDs", params)
+	})
+
+	config, _ := testRunConfig(t, server)
+	config["keep_vm"] = "never"
+
+	var b Builder
+	_, _, err := b.Prepare(config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := b.Run(ctx, packer.TestUi(t), &packer.MockHook{}); err == nil {
+		t.Fatal("should have error")
+	}
+
+	if n := len(server.Records("VM")); n != 1 {
+		t.Errorf("imported VM should have been destroyed, got %d VMs", n)
+	}
+	for _, vdi := range server.Records("VDI") {
+		if strings.HasPrefix(vdi["name_label"].(string), "appliance") {
+			t.Errorf("imported VDI '%s' should have been destroyed", vdi["name_label"])
+		}
+	}
+}
@@ -3,7 +3,6 @@ package xva
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
@@ -14,7 +13,35 @@ import (
 
 type stepImportInstance struct {
 	instance xsclient.VMRef
-	vdi      xsclient.VDIRef
+	vdis     []xsclient.VDIRef
+}
+
+// importSR returns the SR the XVA is imported to: the one given by sr_name,
+// else the default SR of the pool.
+func importSR(ctx context.Context, c xscommon.SRClient, config xscommon.CommonConfig) (xsclient.SRRef, error) {
+	sr, err := config.GetSR(ctx, c)
+	if err != nil {
+		return "", err
+	}
+
+	// ISO libraries and removable media cannot hold the disks of the VM
+	srType, err := c.GetSRType(ctx, sr)
+	if err != nil {
+		return "", err
+	}
+	contentType, err := c.GetSRContentType(ctx, sr)
+	if err != nil {
+		return "", err
+	}
+	if srType == "iso" || srType == "udev" || contentType == "iso" {
+		name, err := c.GetSRNameLabel(ctx, sr)
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("SR '%s' of type '%s' cannot hold the disks of the VM, set sr_name to an SR that can", name, srType)
+	}
+
+	return sr, nil
 }
 
 func (self *stepImportInstance) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -25,14 +52,7 @@ func (self *stepImportInstance) Run(ctx context.Context, state multistep.StateBa
 
 	ui.Say("Step: Import Instance")
 
-	if config.SourcePath == "" {
-		log.Println("Skipping importing instance - no `source_path` configured.")
-		return multistep.ActionContinue
-	}
-
-	// find the SR
-	srs, err := c.GetClient().SR.GetAll(c.GetSessionRef())
-	sr := srs[0]
+	sr, err := importSR(ctx, c, config.CommonConfig)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get SR: %s", err.Error()))
 		return multistep.ActionHalt
@@ -45,8 +65,8 @@ func (self *stepImportInstance) Run(ctx context.Context, state multistep.StateBa
 		return multistep.ActionHalt
 	}
 
-	result, err := xscommon.HTTPUpload(fmt.Sprintf("https://%s/import?session_id=%s&sr_id=%s",
-		c.Host,
+	result, err := xscommon.HTTPUpload(ctx, fmt.Sprintf("https://%s/import?session_id=%s&sr_id=%s",
+		c.GetHost(),
 		c.GetSession(),
 		sr,
 	), fh, state)
@@ -54,41 +74,44 @@ func (self *stepImportInstance) Run(ctx context.Context, state multistep.StateBa
 		ui.Error(fmt.Sprintf("Unable to upload VDI: %s", err.Error()))
 		return multistep.ActionHalt
 	}
-	if result == "" {
-		ui.Error("XAPI did not reply with an instance reference")
+	ref := xscommon.TaskResultRef(result)
+	if ref == "" {
+		ui.Error(fmt.Sprintf("XAPI did not reply with an instance reference: '%s'", result))
 		return multistep.ActionHalt
 	}
 
-	instance := xsclient.VMRef(result)
+	instance := xsclient.VMRef(ref)
+	self.instance = instance
 
-	instanceId, err := c.GetClient().VM.GetUUID(c.GetSessionRef(), instance)
+	self.vdis, err = xscommon.GetDisks(ctx, c, instance)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Unable to get VM UUID: %s", err.Error()))
+		ui.Error(fmt.Sprintf("Unable to get the disks of the VM: %s", err.Error()))
 		return multistep.ActionHalt
 	}
-	state.Put("instance_uuid", instanceId)
 
-	err = c.GetClient().VM.SetVCPUsMax(c.GetSessionRef(), instance, int(config.VCPUsMax))
+	instanceId, err := c.GetVMUUID(ctx, instance)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Error setting VM VCPUs Max=%d: %s", config.VCPUsMax, err.Error()))
+		ui.Error(fmt.Sprintf("Unable to get VM UUID: %s", err.Error()))
 		return multistep.ActionHalt
 	}
+	state.Put("instance_uuid", instanceId)
 
-	err = c.GetClient().VM.SetVCPUsAtStartup(c.GetSessionRef(), instance, int(config.VCPUsAtStartup))
+	// The XVA may have been exported from a template, under any name
+	err = c.SetVMIsATemplate(ctx, instance, false)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Error setting VM VCPUs At Startup=%d: %s", config.VCPUsAtStartup, err.Error()))
+		ui.Error(fmt.Sprintf("Error setting is_a_template=false: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	err = c.GetClient().VM.SetNameDescription(c.GetSessionRef(), instance, config.VMDescription)
+	err = c.SetVMNameLabel(ctx, instance, config.VMName)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Error setting VM description: %s", err.Error()))
+		ui.Error(fmt.Sprintf("Error setting VM name: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	err = xscommon.AddVMTags(c, instance, config.VMTags)
+	err = xscommon.ConfigureInstance(ctx, c, ui, instance, config)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Failed to add tags: %s", err.Error()))
+		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
@@ -98,29 +121,41 @@ func (self *stepImportInstance) Run(ctx context.Context, state multistep.StateBa
 }
 
 func (self *stepImportInstance) Cleanup(state multistep.StateBag) {
-	/*
-		config := state.Get("config").(config)
-		if config.ShouldKeepVM(state) {
-			return
-		}
+	config := state.Get("commonconfig").(xscommon.CommonConfig)
+	if config.ShouldKeepVM(state) {
+		return
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+	c := state.Get("client").(*xscommon.Connection)
 
-		ui := state.Get("ui").(packer.Ui)
+	ctx := context.Background()
 
-		if self.instance != nil {
-			ui.Say("Destroying VM")
-			_ = self.instance.HardShutdown() // redundant, just in case
-			err := self.instance.Destroy()
+	if self.instance != "" {
+		// The import may have failed before its disks were recorded; find
+		// them while the VM still has them attached
+		if self.vdis == nil {
+			vdis, err := xscommon.GetDisks(ctx, c, self.instance)
 			if err != nil {
-				ui.Error(err.Error())
+				ui.Error(fmt.Sprintf("Unable to get the disks of the VM: %s", err.Error()))
 			}
+			self.vdis = vdis
 		}
 
-		if self.vdi != nil {
-			ui.Say("Destroying VDI")
-			err := self.vdi.Destroy()
-			if err != nil {
-				ui.Error(err.Error())
-			}
+		ui.Say("Destroying VM")
+		_ = c.HardShutdownVM(ctx, self.instance) // redundant, just in case
+		err := c.DestroyVM(ctx, self.instance)
+		if err != nil {
+			ui.Error(err.Error())
 		}
-	*/
+	}
+
+	// Destroy the imported disks
+	for i, vdi := range self.vdis {
+		ui.Say(fmt.Sprintf("Destroying VDI %d", i))
+		err := c.DestroyVDI(ctx, vdi)
+		if err != nil {
+			ui.Error(err.Error())
+		}
+	}
 }
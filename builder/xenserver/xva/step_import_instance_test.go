@@ -0,0 +1,90 @@
+package xva
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	xsclient "github.com/terra-farm/go-xen-api-client"
+	xscommon "github.com/xenserver/packer-builder-xenserver/builder/xenserver/common"
+)
+
+// fakeSR is an SR of fakeSRClient.
+type fakeSR struct {
+	name, srType, contentType string
+}
+
+// fakeSRClient implements the parts of SRClient used by importSR; any other
+// call panics on the nil embedded interface.
+type fakeSRClient struct {
+	xscommon.SRClient
+
+	srs       map[xsclient.SRRef]fakeSR
+	defaultSR xsclient.SRRef
+}
+
+func (f *fakeSRClient) GetSRByNameLabel(ctx context.Context, name string) ([]xsclient.SRRef, error) {
+	var refs []xsclient.SRRef
+	for ref, sr := range f.srs {
+		if sr.name == name {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+func (f *fakeSRClient) GetDefaultSR(ctx context.Context) (xsclient.SRRef, error) {
+	return f.defaultSR, nil
+}
+
+func (f *fakeSRClient) GetSRNameLabel(ctx context.Context, sr xsclient.SRRef) (string, error) {
+	return f.srs[sr].name, nil
+}
+
+func (f *fakeSRClient) GetSRType(ctx context.Context, sr xsclient.SRRef) (string, error) {
+	return f.srs[sr].srType, nil
+}
+
+func (f *fakeSRClient) GetSRContentType(ctx context.Context, sr xsclient.SRRef) (string, error) {
+	return f.srs[sr].contentType, nil
+}
+
+func TestImportSR(t *testing.T) {
+	srs := map[xsclient.SRRef]fakeSR{
+		"OpaqueRef:local": {"Local storage", "ext", "user"},
+		"OpaqueRef:nfs":   {"NFS storage", "nfs", "user"},
+		"OpaqueRef:iso":   {"ISO library", "iso", "iso"},
+		"OpaqueRef:udev":  {"Removable storage", "udev", "disk"},
+		"OpaqueRef:dvd":   {"DVD drives", "udev", "iso"},
+	}
+
+	cases := []struct {
+		srName    string
+		defaultSR xsclient.SRRef
+		expected  xsclient.SRRef
+		err       string
+	}{
+		{"", "OpaqueRef:local", "OpaqueRef:local", ""},
+		{"NFS storage", "OpaqueRef:local", "OpaqueRef:nfs", ""},
+		{"", "OpaqueRef:NULL", "", "no default SR"},
+		{"", "OpaqueRef:iso", "", "SR 'ISO library' of type 'iso' cannot hold the disks of the VM"},
+		{"Removable storage", "OpaqueRef:local", "", "SR 'Removable storage' of type 'udev' cannot hold"},
+		{"DVD drives", "OpaqueRef:local", "", "SR 'DVD drives' of type 'udev' cannot hold"},
+		{"Fast storage", "OpaqueRef:local", "", "Couldn't find a SR"},
+	}
+
+	for _, tc := range cases {
+		c := &fakeSRClient{srs: srs, defaultSR: tc.defaultSR}
+		config := xscommon.CommonConfig{SrName: tc.srName}
+
+		sr, err := importSR(context.Background(), c, config)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("sr_name %q: should not have error: %s", tc.srName, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("sr_name %q: expected error containing %q, got %v", tc.srName, tc.err, err)
+		case sr != tc.expected:
+			t.Errorf("sr_name %q: expected SR %s, got %s", tc.srName, tc.expected, sr)
+		}
+	}
+}
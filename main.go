@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/clone"
+	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/diskimage"
 	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/iso"
 	"github.com/xenserver/packer-builder-xenserver/builder/xenserver/xva"
 	"github.com/xenserver/packer-builder-xenserver/version"
@@ -15,6 +17,8 @@ func main() {
 	pps := plugin.NewSet()
 	pps.RegisterBuilder("iso", new(iso.Builder))
 	pps.RegisterBuilder("xva", new(xva.Builder))
+	pps.RegisterBuilder("clone", new(clone.Builder))
+	pps.RegisterBuilder("disk-image", new(diskimage.Builder))
 	pps.SetVersion(version.PluginVersion)
 	err := pps.Run()
 	if err != nil {